@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vxcontrol/vxagent/mmodule"
+)
+
+// ctlUsage is description of ctl subcommand
+const ctlUsage = `Usage: vxagent ctl [options] <command> [args]
+
+Commands:
+  modules - list modules with status and versions
+  connection - show state of connection to server
+  config - dump effective configuration of running agent
+  log-level [level] - show or change log level (trace, debug, info, warning, error)
+  reconnect - drop current connection to server and connect again
+  reload - read local configuration again
+  messages [type] - show last messages from server (info, warning, error)
+
+Options:
+`
+
+// getCtlSocketPath is function which resolve path to control socket of running agent
+func getCtlSocketPath(socketPath, dataDir, cfgPath string) (string, error) {
+	if socketPath != "" {
+		return socketPath, nil
+	}
+
+	if dataDir == "" {
+		dataDir = os.Getenv("DATA_DIR")
+	}
+	if dataDir == "" {
+		dataDir = filepath.Join(filepath.Dir(os.Args[0]), "data")
+	}
+	dataDir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid value of 'datadir' argument: %s", dataDir)
+	}
+
+	if cfgPath == "" {
+		cfgPath = os.Getenv("CONFIG_FILE")
+	}
+	config, err := mmodule.LoadConfig(cfgPath)
+	if err != nil {
+		return "", err
+	}
+
+	return config.GetControlSocketPath(dataDir), nil
+}
+
+// printCtlResult is function which print response of running agent in human readable format
+func printCtlResult(w io.Writer, command string, data json.RawMessage) error {
+	switch command {
+	case mmodule.ControlCmdModules:
+		var modules []mmodule.ControlModule
+		if err := json.Unmarshal(data, &modules); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVERSION\tSTATUS\tREASON")
+		for _, m := range modules {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Name, m.Version, m.Status, m.Reason)
+		}
+		return tw.Flush()
+	case mmodule.ControlCmdConnection:
+		var conn mmodule.ControlConnection
+		if err := json.Unmarshal(data, &conn); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "agent id: %s\n", conn.AgentID)
+		fmt.Fprintf(w, "server: %s\n", conn.Server)
+		fmt.Fprintf(w, "connected: %t\n", conn.Connected)
+		fmt.Fprintf(w, "handshake: %t\n", conn.Handshake)
+		fmt.Fprintf(w, "receiver healthy: %t\n", conn.Receiver)
+		fmt.Fprintf(w, "reconnects: %d\n", conn.Reconnects)
+		fmt.Fprintf(w, "handshake failures: %d\n", conn.HandshakeFailures)
+		if conn.RTT != 0 {
+			fmt.Fprintf(w, "rtt: %.1fms\n", conn.RTT)
+		}
+		if len(conn.Agents) != 0 {
+			fmt.Fprintf(w, "connections: %s\n", strings.Join(conn.Agents, ", "))
+		}
+		return nil
+	case mmodule.ControlCmdLogLevel:
+		var resp map[string]string
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "log level: %s\n", resp["level"])
+		return nil
+	case mmodule.ControlCmdReconnect:
+		fmt.Fprintln(w, "reconnect was requested")
+		return nil
+	case mmodule.ControlCmdMessages:
+		var msgs mmodule.ControlServerMessages
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tTYPE\tSRC\tTEXT")
+		for _, m := range msgs.Messages {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Time.Format(time.RFC3339), m.Type, m.Src, m.Text)
+		}
+		return tw.Flush()
+	default:
+		var out bytes.Buffer
+		if err := json.Indent(&out, data, "", "  "); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, out.String())
+		return nil
+	}
+}
+
+// runCtl is function which execute ctl subcommand on running agent and return exit code
+func runCtl(args []string) int {
+	var socketPath, dataDir, cfgPath string
+	var jsonOutput bool
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), ctlUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&socketPath, "socket", "", "Path to control socket of running vxagent")
+	fs.StringVar(&dataDir, "datadir", "", "Data directory of running vxagent to find control socket")
+	fs.StringVar(&cfgPath, "config", "", "Path to the JSON file with local vxagent configuration")
+	fs.BoolVar(&jsonOutput, "json", false, "Print result in JSON format")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	req := mmodule.ControlRequest{Command: fs.Arg(0)}
+	switch req.Command {
+	case mmodule.ControlCmdModules, mmodule.ControlCmdConnection,
+		mmodule.ControlCmdConfig, mmodule.ControlCmdReconnect, mmodule.ControlCmdReload:
+	case mmodule.ControlCmdLogLevel:
+		if fs.NArg() > 1 {
+			req.Args = map[string]string{"level": fs.Arg(1)}
+		}
+	case mmodule.ControlCmdMessages:
+		if fs.NArg() > 1 {
+			req.Args = map[string]string{"type": fs.Arg(1)}
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command:", req.Command)
+		fs.Usage()
+		return exitUsage
+	}
+
+	socketPath, err := getCtlSocketPath(socketPath, dataDir, cfgPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+	data, err := mmodule.CallControl(socketPath, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return getExitCode(err)
+	}
+
+	if jsonOutput {
+		var out bytes.Buffer
+		if err = json.Indent(&out, data, "", "  "); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailure
+		}
+		fmt.Println(out.String())
+		return exitOK
+	}
+	if err = printCtlResult(os.Stdout, req.Command, data); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+
+	return exitOK
+}
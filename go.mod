@@ -7,5 +7,8 @@ require (
 	github.com/judwhite/go-svc v1.2.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/takama/daemon v1.0.0
+	github.com/vxcontrol/golua v1.0.0
+	github.com/vxcontrol/luar v1.0.0
 	github.com/vxcontrol/vxcommon v1.1.0
+	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
 )
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/judwhite/go-svc"
@@ -23,6 +31,25 @@ const (
 	description = "VXAgent service to the OS control"
 )
 
+// Exit codes of vxagent commands
+const (
+	exitOK         = 0
+	exitFailure    = 1
+	exitUsage      = 2
+	exitNotRunning = 3
+	// exitRestart is used after agent binary replacing, service manager starts new binary
+	// because of non-zero exit code (Restart=on-failure)
+	exitRestart = 4
+)
+
+// getExitCode is function which return exit code of failed command
+func getExitCode(err error) int {
+	if errors.Is(err, mmodule.ErrControlUnavailable) {
+		return exitNotRunning
+	}
+	return exitFailure
+}
+
 // PackageVer is semantic version of vxagent
 var PackageVer string
 
@@ -31,51 +58,235 @@ var PackageRev string
 
 // Agent implements daemon structure
 type Agent struct {
-	debug   bool
-	service bool
-	logDir  string
-	agentID string
-	connect string
-	command string
+	debug    bool
+	service  bool
+	logDir   string
+	dataDir  string
+	cfgPath  string
+	httpAddr string
+	agentID  string
+	connect  string
+	command  string
+	config   *mmodule.Config
+	// sources is map of agent option name to source of its value (flag or env)
+	sources map[string]string
 	module  *mmodule.MainModule
+	cancel  context.CancelFunc
 	wg      sync.WaitGroup
-	svc     daemon.Daemon
+	// stopOnce guards main module stopping from service signal and fatal error at the same time
+	stopOnce sync.Once
+	stopErr  error
+	svc      daemon.Daemon
 }
 
 // Init for preparing agent main module struct
 func (a *Agent) Init(env svc.Environment) (err error) {
 	utils.RemoveUnusedTempDir()
-	a.module = mmodule.New(a.connect, a.agentID)
+	a.module = mmodule.New(a.connect, a.agentID, a.dataDir, a.config)
 	if a.module == nil {
 		err = fmt.Errorf("failed to create new main module")
 		logrus.WithError(err).Error("failed to initialize")
 		return
 	}
+	a.module.SetConfigLoader(a.loadConfig)
+	if a.hasServiceRestart() {
+		a.module.SetRestartHandler(a.restartProcess)
+	} else {
+		logrus.Info("vxagent: service manager doesn't restart the agent, self-upgrade is disabled")
+	}
 
 	return
 }
 
 // Start logic of agent main module
-func (a *Agent) Start() (err error) {
+// It returns when main module is ready to work or failed to start
+func (a *Agent) Start() error {
 	logrus.Info("vxagent is starting...")
+	var ctx context.Context
+	ctx, a.cancel = context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	errc := make(chan error, 1)
 	a.wg.Add(1)
 	go func() {
 		defer a.wg.Done()
-		err = a.module.Start()
+		errc <- a.module.Start(ctx, ready)
 	}()
 
-	// Wait a little time to catch error on start
-	time.Sleep(time.Second)
+	select {
+	case <-ready:
+	case err := <-errc:
+		if err == nil {
+			err = fmt.Errorf("main module stopped before it became ready")
+		}
+		a.cancel()
+		logrus.WithError(err).Error("vxagent starting failed")
+		return err
+	}
+
+	go a.watch(ctx, errc)
+	go a.notify(ctx)
+	go a.handleReload(ctx)
+	if err := sdNotify("READY=1\nSTATUS=" + a.module.GetHealth().String()); err != nil {
+		logrus.WithError(err).Warn("vxagent: failed to notify systemd")
+	}
 	logrus.Info("vxagent started")
 
-	return
+	return nil
+}
+
+// watch is function which terminate the service if main module failed after starting
+func (a *Agent) watch(ctx context.Context, errc <-chan error) {
+	err := <-errc
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+
+	logrus.WithError(err).Error("vxagent: main module failed")
+	if errStop := a.Stop(); errStop != nil {
+		logrus.WithError(errStop).Error("vxagent: failed to stop after main module failure")
+	}
+	os.Exit(exitFailure)
+}
+
+// hasServiceRestart is function which check that service manager starts the agent again after exit with failure code
+// Services installed by the agent are restarted by systemd, launchd and windows service recovery,
+// other service managers and manual running don't do it
+func (a *Agent) hasServiceRestart() bool {
+	if !a.service {
+		return false
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		// systemd sets invocation ID for processes of its units
+		return os.Getenv("INVOCATION_ID") != ""
+	case "darwin", "windows":
+		return true
+	default:
+		return false
+	}
+}
+
+// restartProcess is function which stop the agent and exit to be started again by service manager
+func (a *Agent) restartProcess() {
+	logrus.Info("vxagent: agent process is restarting")
+	if err := a.Stop(); err != nil {
+		logrus.WithError(err).Error("vxagent: failed to stop before restart")
+	}
+	os.Exit(exitRestart)
+}
+
+// handleReload is function which reload local configuration on SIGHUP until the context will be canceled
+func (a *Agent) handleReload(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-sig:
+			if _, err := a.module.ReloadConfig(); err != nil {
+				logrus.WithError(err).Error("vxagent: failed to reload configuration")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loadConfig is function which read local configuration file and apply overrides from arguments
+func (a *Agent) loadConfig() (*mmodule.Config, error) {
+	config, err := mmodule.LoadConfig(a.cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	if a.httpAddr != "" {
+		config.HTTP.Listen = a.httpAddr
+	}
+
+	return config, nil
+}
+
+// reload is function which request running agent to read local configuration again
+func (a *Agent) reload() (string, error) {
+	data, err := mmodule.CallControl(a.config.GetControlSocketPath(a.dataDir),
+		mmodule.ControlRequest{Command: mmodule.ControlCmdReload})
+	if err != nil {
+		return "vxagent reloading failed", err
+	}
+
+	var resp struct {
+		Restart []string `json:"restart_required"`
+	}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return "vxagent reloading failed", err
+	}
+	if len(resp.Restart) != 0 {
+		return "vxagent configuration was reloaded, restart is required to apply: " +
+			strings.Join(resp.Restart, ", "), nil
+	}
+
+	return "vxagent configuration was reloaded", nil
+}
+
+// getServerMessages is function which describe messages received by running agent from server
+// it returns empty string if the agent isn't running or control socket is unavailable
+func (a *Agent) getServerMessages() string {
+	data, err := mmodule.CallControl(a.config.GetControlSocketPath(a.dataDir),
+		mmodule.ControlRequest{Command: mmodule.ControlCmdMessages})
+	if err != nil {
+		return ""
+	}
+
+	var msgs mmodule.ControlServerMessages
+	if err = json.Unmarshal(data, &msgs); err != nil {
+		return ""
+	}
+	status := fmt.Sprintf("server messages: %d errors, %d warnings, %d notices",
+		msgs.Counts["ERROR"], msgs.Counts["WARNING"], msgs.Counts["INFO"])
+	for i := len(msgs.Messages) - 1; i >= 0; i-- {
+		if m := msgs.Messages[i]; m.Type == "ERROR" || m.Type == "WARNING" {
+			status += fmt.Sprintf("\nlast %s from server at %s: %s",
+				strings.ToLower(m.Type), m.Time.Format(time.RFC3339), m.Text)
+			break
+		}
+	}
+
+	return status
+}
+
+// restart is function which stop the service if it is running and start it again
+func (a *Agent) restart() (string, error) {
+	if status, err := a.svc.Stop(); err != nil && err != daemon.ErrAlreadyStopped {
+		return status, err
+	}
+
+	return a.svc.Start()
 }
 
 // Stop logic of agent main module
-func (a *Agent) Stop() (err error) {
+// It is safe to call Stop many times, main module is stopped only once
+func (a *Agent) Stop() error {
+	a.stopOnce.Do(func() {
+		a.stopErr = a.stop()
+	})
+
+	return a.stopErr
+}
+
+// stop is internal function which stop main module in time of shutdown budget
+func (a *Agent) stop() (err error) {
 	logrus.Info("vxagent is stopping...")
-	if err = a.module.Stop(); err != nil {
-		return
+	if errNotify := sdNotify("STOPPING=1"); errNotify != nil {
+		logrus.WithError(errNotify).Warn("vxagent: failed to notify systemd")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.module.GetConfig().GetShutdownTimeout())
+	defer cancel()
+	if err = a.module.Stop(ctx); err != nil {
+		logrus.WithError(err).Error("vxagent: failed to stop main module gracefully")
+	}
+	if a.cancel != nil {
+		a.cancel()
 	}
 	logrus.Info("vxagent is waiting of modules release...")
 	a.wg.Wait()
@@ -84,6 +295,30 @@ func (a *Agent) Stop() (err error) {
 	return
 }
 
+// checkHealth is function which request health endpoint of running agent for container probes
+func checkHealth(addr string) (string, error) {
+	if addr == "" {
+		return "vxagent health check failed", fmt.Errorf("local HTTP server isn't enabled")
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + addr + "/healthz")
+	if err != nil {
+		return "vxagent health check failed", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "vxagent health check failed", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return string(body), fmt.Errorf("vxagent isn't healthy: %s", resp.Status)
+	}
+
+	return string(body), nil
+}
+
 // Manage by daemon commands or run the daemon
 func (a *Agent) Manage() (string, error) {
 	switch a.command {
@@ -93,10 +328,23 @@ func (a *Agent) Manage() (string, error) {
 			"-agent", a.agentID,
 			"-connect", a.connect,
 			"-logdir", a.logDir,
+			"-datadir", a.dataDir,
+		}
+		if a.cfgPath != "" {
+			opts = append(opts, "-config", a.cfgPath)
+		}
+		if a.httpAddr != "" {
+			opts = append(opts, "-http", a.httpAddr)
 		}
 		if a.debug {
 			opts = append(opts, "-debug")
 		}
+		// Only systemd unit template has service section, other service managers use default ones
+		if runtime.GOOS == "linux" && strings.Contains(a.svc.GetTemplate(), "[Service]") {
+			if err := a.svc.SetTemplate(getSystemdUnit(a.config.GetShutdownTimeout())); err != nil {
+				return "failed to set systemd unit template", err
+			}
+		}
 		return a.svc.Install(opts...)
 	case "uninstall":
 		return a.svc.Remove()
@@ -105,7 +353,21 @@ func (a *Agent) Manage() (string, error) {
 	case "stop":
 		return a.svc.Stop()
 	case "status":
-		return a.svc.Status()
+		status, err := a.svc.Status()
+		policy, _ := mmodule.LoadPolicy(a.config.GetPolicyPath(a.dataDir))
+		status += "\n" + policy.String()
+		if messages := a.getServerMessages(); messages != "" {
+			status += "\n" + messages
+		}
+		return status, err
+	case "restart":
+		return a.restart()
+	case "reload":
+		return a.reload()
+	case "show-config":
+		return a.showConfig()
+	case "healthcheck":
+		return checkHealth(a.config.HTTP.Listen)
 	}
 
 	if err := svc.Run(a); err != nil {
@@ -118,6 +380,11 @@ func (a *Agent) Manage() (string, error) {
 }
 
 func main() {
+	// ctl subcommand is client of running agent and it has own arguments
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+
 	var agent Agent
 	var version bool
 	flag.StringVar(&agent.connect, "connect", "ws://localhost:8080", "Connection string")
@@ -127,13 +394,26 @@ func main() {
   uninstall - uninstall the service from the system
   start - start the service
   stop - stop the service
-  status - status of the service`)
+  status - status of the service
+  restart - stop the service if it's running and start it again
+  reload - request the running service to read configuration again
+  show-config - print effective configuration with source of every value
+  healthcheck - check health of the running agent through local HTTP server
+Exit codes: 0 - success, 1 - failure, 2 - invalid arguments, 3 - the agent isn't running, 4 - the agent restarted after upgrade`)
 	flag.StringVar(&agent.logDir, "logdir", "", "System option to define log directory to vxagent")
+	flag.StringVar(&agent.dataDir, "datadir", "", "System option to define data directory to vxagent")
+	flag.StringVar(&agent.cfgPath, "config", "", "Path to the JSON file with local vxagent configuration (not required)")
+	flag.StringVar(&agent.httpAddr, "http", "", "Localhost address of HTTP server with health endpoints, e.g. 127.0.0.1:8091 (not required)")
 	flag.BoolVar(&agent.debug, "debug", false, "System option to run vxagent in debug mode")
 	flag.BoolVar(&agent.service, "service", false, "System option to run vxagent as a service")
 	flag.BoolVar(&version, "version", false, "Print current version of vxagent and exit")
 	flag.Parse()
 
+	agent.sources = make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		agent.sources[f.Name] = "flag"
+	})
+
 	if version {
 		fmt.Printf("vxagent version is ")
 		if PackageVer != "" {
@@ -156,24 +436,44 @@ func main() {
 	case "start":
 	case "stop":
 	case "status":
+	case "restart":
+	case "reload":
+	case "show-config":
+	case "healthcheck":
 	case "":
 	default:
 		fmt.Println("invalid value of 'command' argument: ", agent.command)
 		flag.PrintDefaults()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	if os.Getenv("CONNECT") != "" {
 		agent.connect = os.Getenv("CONNECT")
+		agent.sources["connect"] = "env CONNECT"
 	}
 	if os.Getenv("AGENT_ID") != "" {
 		agent.agentID = os.Getenv("AGENT_ID")
+		agent.sources["agent"] = "env AGENT_ID"
 	}
 	if os.Getenv("LOG_DIR") != "" {
 		agent.logDir = os.Getenv("LOG_DIR")
+		agent.sources["logdir"] = "env LOG_DIR"
+	}
+	if os.Getenv("DATA_DIR") != "" {
+		agent.dataDir = os.Getenv("DATA_DIR")
+		agent.sources["datadir"] = "env DATA_DIR"
+	}
+	if os.Getenv("CONFIG_FILE") != "" {
+		agent.cfgPath = os.Getenv("CONFIG_FILE")
+		agent.sources["config"] = "env CONFIG_FILE"
+	}
+	if os.Getenv("HTTP_LISTEN") != "" {
+		agent.httpAddr = os.Getenv("HTTP_LISTEN")
+		agent.sources["http"] = "env HTTP_LISTEN"
 	}
 	if os.Getenv("DEBUG") != "" {
 		agent.debug = true
+		agent.sources["debug"] = "env DEBUG"
 	}
 
 	if agent.logDir == "" {
@@ -182,11 +482,35 @@ func main() {
 	logDir, err := filepath.Abs(agent.logDir)
 	if err != nil {
 		fmt.Println("invalid value of 'logdir' argument: ", agent.logDir)
-		os.Exit(1)
+		os.Exit(exitFailure)
 	} else {
 		agent.logDir = logDir
 	}
 
+	if agent.dataDir == "" {
+		agent.dataDir = filepath.Join(filepath.Dir(os.Args[0]), "data")
+	}
+	dataDir, err := filepath.Abs(agent.dataDir)
+	if err != nil {
+		fmt.Println("invalid value of 'datadir' argument: ", agent.dataDir)
+		os.Exit(exitFailure)
+	} else {
+		agent.dataDir = dataDir
+	}
+
+	if agent.cfgPath != "" {
+		cfgPath, err := filepath.Abs(agent.cfgPath)
+		if err != nil {
+			fmt.Println("invalid value of 'config' argument: ", agent.cfgPath)
+			os.Exit(exitFailure)
+		}
+		agent.cfgPath = cfgPath
+	}
+	if agent.config, err = agent.loadConfig(); err != nil {
+		fmt.Println("failed to load config: ", err.Error())
+		os.Exit(exitFailure)
+	}
+
 	if agent.debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	} else {
@@ -197,7 +521,7 @@ func main() {
 	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		fmt.Println("failed to open log file: ", logPath)
-		os.Exit(1)
+		os.Exit(exitFailure)
 	}
 	if agent.service {
 		logrus.SetOutput(logFile)
@@ -220,19 +544,20 @@ func main() {
 		}
 	default:
 		logrus.Error("unsupported OS type")
-		os.Exit(1)
+		os.Exit(exitFailure)
 	}
 
 	agent.svc, err = daemon.New(name, description, kind, dependencies...)
 	if err != nil {
 		logrus.WithError(err).Error("vxagent service creating failed")
-		os.Exit(1)
+		os.Exit(exitFailure)
 	}
 
 	status, err := agent.Manage()
 	if err != nil {
 		fmt.Println(status, "\n", err.Error())
-		os.Exit(1)
+		os.Exit(getExitCode(err))
 	}
 	fmt.Println(status)
+	os.Exit(exitOK)
 }
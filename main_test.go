@@ -1,9 +1,210 @@
-package main
-
-import "testing"
-
-func TestMain(t *testing.T) {
-	if true != true {
-		t.Errorf("Test error\n")
-	}
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vxcontrol/vxagent/mmodule"
+)
+
+func TestMain(t *testing.T) {
+	if true != true {
+		t.Errorf("Test error\n")
+	}
+}
+
+func newTestAgent(t *testing.T, config *mmodule.Config) (*Agent, func()) {
+	dataDir, err := ioutil.TempDir("", "vxagent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens this port so the agent keeps reconnecting
+	a := &Agent{
+		connect: "ws://127.0.0.1:1",
+		agentID: "test",
+		dataDir: dataDir,
+		config:  config,
+	}
+	if a.module = mmodule.New(a.connect, a.agentID, a.dataDir, config); a.module == nil {
+		os.RemoveAll(dataDir)
+		t.Fatal("failed to create main module")
+	}
+
+	return a, func() { os.RemoveAll(dataDir) }
+}
+
+func TestAgentStartError(t *testing.T) {
+	config := mmodule.DefaultConfig()
+	config.HTTP.Listen = "192.0.2.1:8080"
+	a, cleanup := newTestAgent(t, config)
+	defer cleanup()
+
+	if err := a.Start(); err == nil {
+		t.Fatal("agent was started with invalid HTTP address")
+	}
+	// Main module goroutine is finished after starting failure
+	a.wg.Wait()
+	if a.module.GetHealth().Started {
+		t.Fatal("main module is started after failure")
+	}
+}
+
+func TestAgentStartStop(t *testing.T) {
+	a, cleanup := newTestAgent(t, mmodule.DefaultConfig())
+	defer cleanup()
+
+	if err := a.Start(); err != nil {
+		t.Fatalf("failed to start agent: %v", err)
+	}
+	// Start returns when main module is ready without waiting for server connection
+	if health := a.module.GetHealth(); !health.IsHealthy() || health.Connected {
+		t.Fatalf("unexpected health state %+v", health)
+	}
+
+	if err := a.Stop(); err != nil {
+		t.Fatalf("failed to stop agent: %v", err)
+	}
+	if err := a.Stop(); err != nil {
+		t.Fatalf("repeated stopping returned error: %v", err)
+	}
+	if a.module.GetHealth().Started {
+		t.Fatal("main module is running after stopping")
+	}
+}
+
+// readTestNotify is function which read next state sent by agent to notify socket
+func readTestNotify(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read notify state: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifyWatchdog(t *testing.T) {
+	a, cleanup := newTestAgent(t, mmodule.DefaultConfig())
+	defer cleanup()
+
+	addr := filepath.Join(a.dataDir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for key, value := range map[string]string{
+		"NOTIFY_SOCKET": addr,
+		"WATCHDOG_USEC": "200000",
+		"WATCHDOG_PID":  "",
+	} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+
+	// Main module isn't started so watchdog isn't pinged
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.notify(ctx)
+	}()
+	if state := readTestNotify(t, conn); !strings.HasPrefix(state, "STATUS=") || strings.Contains(state, "WATCHDOG=1") {
+		t.Fatalf("unexpected notify state %q", state)
+	}
+	cancel()
+	<-done
+
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	for !strings.Contains(readTestNotify(t, conn), "WATCHDOG=1") {
+	}
+}
+
+func TestShowConfigSources(t *testing.T) {
+	a, cleanup := newTestAgent(t, mmodule.DefaultConfig())
+	defer cleanup()
+
+	a.cfgPath = filepath.Join(a.dataDir, "config.json")
+	if err := ioutil.WriteFile(a.cfgPath, []byte(`{"commands": {"workers": 2, "queue_size": 16}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := a.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.config = config
+	a.httpAddr, a.config.HTTP.Listen = "127.0.0.1:8091", "127.0.0.1:8091"
+	a.sources = map[string]string{"agent": "flag", "http": "flag"}
+
+	out, err := a.showConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string][]string)
+	for _, line := range strings.Split(out, "\n")[1:] {
+		fields := strings.Fields(line)
+		values[fields[0]] = fields[1:]
+	}
+	expected := map[string][]string{
+		"agent":            {"test", "flag"},
+		"connect":          {"ws://127.0.0.1:1", "default"},
+		"commands.workers": {"2", "file", a.cfgPath},
+		"http.listen":      {"127.0.0.1:8091", "flag"},
+		"control.socket":   {filepath.Join(a.dataDir, "control.sock"), "default"},
+	}
+	for key, value := range expected {
+		if strings.Join(values[key], " ") != strings.Join(value, " ") {
+			t.Errorf("option %s is %v instead of %v", key, values[key], value)
+		}
+	}
+}
+
+func TestReloadCommand(t *testing.T) {
+	a, cleanup := newTestAgent(t, mmodule.DefaultConfig())
+	defer cleanup()
+	a.cfgPath = filepath.Join(a.dataDir, "config.json")
+	if err := ioutil.WriteFile(a.cfgPath, []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a.module.SetConfigLoader(a.loadConfig)
+
+	if _, err := a.reload(); !errors.Is(err, mmodule.ErrControlUnavailable) || getExitCode(err) != exitNotRunning {
+		t.Fatalf("unexpected error of reloading not running agent: %v", err)
+	}
+
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	if err := ioutil.WriteFile(a.cfgPath, []byte(`{"commands": {"workers": 2, "queue_size": 16}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	status, err := a.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(status, "restart is required to apply: commands") {
+		t.Fatalf("unexpected reloading result %q", status)
+	}
+	if workers := a.module.GetConfig().Commands.Workers; workers != 2 {
+		t.Fatalf("configuration wasn't reloaded, workers %d", workers)
+	}
+
+	if err := ioutil.WriteFile(a.cfgPath, []byte(`{"limits": {"interval": -1}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.reload(); err == nil || getExitCode(err) != exitFailure {
+		t.Fatalf("invalid configuration was reloaded: %v", err)
+	}
+}
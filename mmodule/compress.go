@@ -0,0 +1,92 @@
+package mmodule
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+// payloadEncodingGzip is name of gzip encoding of message payload
+const payloadEncodingGzip = "gzip"
+
+// supportedEncodings is list of payload encodings which the agent is able to decode
+var supportedEncodings = []string{payloadEncodingGzip}
+
+// compressPayload is function which encode data by gzip
+func compressPayload(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompressPayload is function which decode data by encoding with limit of decoded size
+func decompressPayload(encoding string, data []byte, maxSize int64) ([]byte, error) {
+	if encoding != payloadEncodingGzip {
+		return nil, errors.New("unsupported payload encoding " + encoding)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	payload, err := ioutil.ReadAll(io.LimitReader(zr, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) > maxSize {
+		return nil, errors.New("decompressed payload exceeds maximum size")
+	}
+
+	return payload, nil
+}
+
+// encodeMessage is function which advertise supported encodings and compress payload of message
+// Payload is compressed if server advertised gzip support and it's bigger than threshold
+func (mm *MainModule) encodeMessage(dst string, message *agent.Message) {
+	message.XXX_unrecognized = appendUnknownString(message.XXX_unrecognized,
+		fieldMessageEncodings, strings.Join(supportedEncodings, ","))
+
+	config := mm.GetConfig().Compression
+	if config.Disabled || len(message.Payload) < config.Threshold || !mm.encodings.has(dst, payloadEncodingGzip) {
+		return
+	}
+	payload, err := compressPayload(message.Payload)
+	if err != nil || len(payload) >= len(message.Payload) {
+		return
+	}
+	mm.metrics.addCompressed(len(message.Payload), len(payload))
+	message.Payload = payload
+	message.XXX_unrecognized = appendUnknownString(message.XXX_unrecognized,
+		fieldMessageEncoding, payloadEncodingGzip)
+}
+
+// decodeMessage is function which store encodings advertised by server and decompress payload of message
+func (mm *MainModule) decodeMessage(src string, message *agent.Message) error {
+	mm.encodings.set(src, message)
+
+	encoding, ok := getUnknownString(message.XXX_unrecognized, fieldMessageEncoding)
+	if !ok || encoding == "" {
+		return nil
+	}
+	payload, err := decompressPayload(encoding, message.Payload, mm.GetConfig().Compression.MaxSize)
+	if err != nil {
+		return newCommandError(errCodeBadRequest, "error decompress of message payload: "+err.Error())
+	}
+	message.Payload = payload
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package mmodule
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+func TestCompressionNegotiation(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	payload := bytes.Repeat([]byte("module status "), 1024)
+	req := newRequest("server", "req-1", "GET_STATUS_MODULES")
+
+	// old server doesn't advertise encodings so payload is sent as is
+	message := req.newMessage(agent.Message_STATUS_MODULES_RESULT, payload)
+	mm.encodeMessage(req.src, message)
+	if !bytes.Equal(message.Payload, payload) {
+		t.Fatal("payload was compressed for server without compression support")
+	}
+
+	request := &agent.Message{Type: agent.Message_GET_STATUS_MODULES.Enum()}
+	request.XXX_unrecognized = appendUnknownString(nil, fieldMessageEncodings, "br, gzip")
+	if err := mm.decodeMessage(req.src, request); err != nil {
+		t.Fatal(err)
+	}
+	message = req.newMessage(agent.Message_STATUS_MODULES_RESULT, payload)
+	mm.encodeMessage(req.src, message)
+	if len(message.Payload) >= len(payload) {
+		t.Fatal("payload wasn't compressed for server with gzip support")
+	}
+
+	// the agent decodes own messages in the same way as server messages
+	data, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received agent.Message
+	if err = proto.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	if err = mm.decodeMessage("other", &received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received.Payload, payload) {
+		t.Fatal("decompressed payload doesn't match origin one")
+	}
+	if id, _ := getUnknownString(received.XXX_unrecognized, fieldMessageRequestID); id != "req-1" {
+		t.Fatalf("request ID was lost on compression: %q", id)
+	}
+
+	mm.encodings.del(req.src)
+	message = req.newMessage(agent.Message_STATUS_MODULES_RESULT, payload)
+	mm.encodeMessage(req.src, message)
+	if !bytes.Equal(message.Payload, payload) {
+		t.Fatal("payload was compressed after server disconnection")
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	data, err := compressPayload(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decompressPayload(payloadEncodingGzip, data, 1<<10); err == nil {
+		t.Fatal("payload bigger than maximum size was decompressed")
+	}
+	if _, err = decompressPayload("zstd", data, 1<<30); err == nil {
+		t.Fatal("payload with unsupported encoding was decompressed")
+	}
+}
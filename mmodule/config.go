@@ -0,0 +1,436 @@
+package mmodule
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// defaultPolicyFileName is name of modules policy file into data directory
+const defaultPolicyFileName = "policy.json"
+
+// defaultControlSocketName is name of control socket into data directory
+const defaultControlSocketName = "control.sock"
+
+// defaultOutboxMaxSize is maximum total size of module events into outbox by default
+const defaultOutboxMaxSize = 64 << 20
+
+// defaultInboxDirName is name of directory for files pushed by server into data directory
+const defaultInboxDirName = "inbox"
+
+// ModuleLimits is struct which contains resource limits for one module
+// Zero value of limit means that this resource is unlimited
+type ModuleLimits struct {
+	// Memory is maximum size of lua state heap in bytes
+	Memory int64 `json:"memory,omitempty"`
+	// CPUTime is maximum time of lua state execution per interval in milliseconds
+	CPUTime int64 `json:"cpu_time,omitempty"`
+	// Events is maximum amount of sent packets per interval
+	Events int64 `json:"events,omitempty"`
+}
+
+// LimitsConfig is struct which contains local settings of modules limits
+type LimitsConfig struct {
+	// Interval is period of usage accounting in seconds
+	Interval int `json:"interval"`
+	// Violations is amount of intervals in a row with throttling before module stop
+	Violations int `json:"violations"`
+	// Default is limits which used for module when it doesn't declare own value
+	Default ModuleLimits `json:"default"`
+}
+
+// PolicyConfig is struct which contains local settings of modules policy
+type PolicyConfig struct {
+	// Path is path to policy file, empty value means policy.json into data directory
+	Path string `json:"path,omitempty"`
+	// ReloadInterval is period of policy file changes checking in seconds
+	ReloadInterval int `json:"reload_interval"`
+}
+
+// VersionsConfig is struct which contains local restrictions of modules versions
+type VersionsConfig struct {
+	// Min is map of module name to minimal allowed semantic version
+	Min map[string]string `json:"min,omitempty"`
+}
+
+// ShutdownConfig is struct which contains local settings of agent stopping
+type ShutdownConfig struct {
+	// Timeout is overall time budget of main module stopping in seconds
+	Timeout int `json:"timeout"`
+	// ModuleTimeout is time of one module stopping in seconds before it will be abandoned
+	ModuleTimeout int `json:"module_timeout"`
+}
+
+// HTTPConfig is struct which contains settings of local HTTP server
+type HTTPConfig struct {
+	// Listen is localhost address of the server, empty value means that the server is disabled
+	Listen string `json:"listen,omitempty"`
+	// Metrics is flag that /metrics endpoint in Prometheus format is enabled
+	Metrics bool `json:"metrics,omitempty"`
+}
+
+// ControlConfig is struct which contains settings of local control socket
+type ControlConfig struct {
+	// Socket is path to control socket, empty value means control.sock into data directory
+	Socket string `json:"socket,omitempty"`
+	// Disabled is flag that control socket shouldn't be opened
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// CommandsConfig is struct which contains settings of server commands execution
+type CommandsConfig struct {
+	// Workers is maximum amount of commands which are executed in parallel
+	Workers int `json:"workers"`
+	// QueueSize is maximum amount of commands waiting for execution
+	QueueSize int `json:"queue_size"`
+}
+
+// UpgradeConfig is struct which contains settings of agent self-upgrade
+type UpgradeConfig struct {
+	// PublicKeys is list of base64 encoded ed25519 keys which are trusted to sign agent binary,
+	// empty list means that agent upgrade is disabled
+	PublicKeys []string `json:"public_keys,omitempty"`
+	// HealthTimeout is time in seconds to connect to server by new binary before rollback
+	HealthTimeout int `json:"health_timeout"`
+	// MaxSize is maximum size of new binary in bytes
+	MaxSize int64 `json:"max_size"`
+}
+
+// InboxConfig is struct which contains settings of files pushed by server to the agent
+type InboxConfig struct {
+	// Dir is path to inbox directory, empty value means inbox into data directory
+	Dir string `json:"dir,omitempty"`
+	// AllowedPaths is list of shell patterns of relative paths which can be written into inbox,
+	// empty list means that file drop is disabled
+	AllowedPaths []string `json:"allowed_paths,omitempty"`
+	// MaxFileSize is maximum size of one file in bytes
+	MaxFileSize int64 `json:"max_file_size"`
+	// Quota is maximum total size of files into inbox in bytes
+	Quota int64 `json:"quota"`
+}
+
+// ScriptConfig is struct which contains limits of ad-hoc lua scripts from server
+type ScriptConfig struct {
+	// Enabled is flag that ad-hoc scripts are accepted, they are rejected by default
+	Enabled bool `json:"enabled,omitempty"`
+	// Timeout is maximum time of script execution in seconds
+	Timeout int `json:"timeout"`
+	// Memory is maximum size of lua state heap in bytes
+	Memory int64 `json:"memory"`
+	// MaxOutput is maximum size of printed output in bytes, the rest is truncated
+	MaxOutput int `json:"max_output"`
+}
+
+// OutboxConfig is struct which contains settings of module events buffering while agent is disconnected
+type OutboxConfig struct {
+	// Disabled is flag that module events aren't buffered and are lost while agent is disconnected
+	Disabled bool `json:"disabled,omitempty"`
+	// MaxSize is maximum total size of buffered events in bytes
+	MaxSize int64 `json:"max_size"`
+	// MaxAge is time in seconds after which buffered event is dropped
+	MaxAge int `json:"max_age"`
+	// Overflow is policy of full outbox: drop_oldest or drop_newest
+	Overflow string `json:"overflow"`
+}
+
+// OutboundLimits is struct which contains rate limits of one class of traffic to server
+// Zero value of limit means that this class is unlimited
+type OutboundLimits struct {
+	// Rate is maximum amount of packets per second
+	Rate float64 `json:"rate"`
+	// Burst is maximum amount of packets which can be sent at once, zero value means rate
+	Burst int `json:"burst"`
+	// ByteRate is maximum amount of bytes per second
+	ByteRate int64 `json:"byte_rate"`
+}
+
+// OutboundConfig is struct which contains settings of traffic from agent to server
+// Traffic is sent by priority: control responses before modules status before modules events
+type OutboundConfig struct {
+	// Control is limits of responses to server commands and reports
+	Control OutboundLimits `json:"control"`
+	// Status is limits of modules status
+	Status OutboundLimits `json:"status"`
+	// Events is limits of packets which are produced by modules
+	Events OutboundLimits `json:"events"`
+	// QueueSize is maximum amount of modules events waiting for sending
+	QueueSize int `json:"queue_size"`
+}
+
+// validate is internal function which check values of limits
+func (c OutboundConfig) validate() error {
+	for _, limits := range c.list() {
+		if limits.Rate < 0 || limits.Burst < 0 || limits.ByteRate < 0 {
+			return errors.New("limits can't be negative")
+		}
+	}
+	if c.QueueSize < 0 {
+		return errors.New("queue size can't be negative")
+	}
+
+	return nil
+}
+
+// CompressionConfig is struct which contains settings of messages payload compression
+type CompressionConfig struct {
+	// Disabled is flag that payload of agent messages isn't compressed
+	Disabled bool `json:"disabled,omitempty"`
+	// Threshold is minimal size of payload in bytes which is compressed
+	Threshold int `json:"threshold"`
+	// MaxSize is maximum size of decompressed payload of server message in bytes
+	MaxSize int64 `json:"max_size"`
+}
+
+// HeartbeatConfig is struct which contains settings of server connection checking
+type HeartbeatConfig struct {
+	// Disabled is flag that agent doesn't ping server
+	Disabled bool `json:"disabled,omitempty"`
+	// Interval is period between pings in seconds
+	Interval int `json:"interval"`
+	// MaxMissed is amount of pings in a row without answer before reconnect
+	MaxMissed int `json:"max_missed"`
+}
+
+// StatusPushConfig is struct which contains settings of unsolicited modules status updates
+type StatusPushConfig struct {
+	// Disabled is flag that server receives modules status on request only
+	Disabled bool `json:"disabled,omitempty"`
+	// Interval is period of modules status checking in milliseconds
+	Interval int `json:"interval"`
+	// Debounce is time in milliseconds without new changes before update is pushed
+	Debounce int `json:"debounce"`
+}
+
+// Config is struct which contains local agent configuration
+type Config struct {
+	Limits      LimitsConfig      `json:"limits"`
+	Policy      PolicyConfig      `json:"policy"`
+	Versions    VersionsConfig    `json:"versions"`
+	Shutdown    ShutdownConfig    `json:"shutdown"`
+	HTTP        HTTPConfig        `json:"http"`
+	Control     ControlConfig     `json:"control"`
+	Upgrade     UpgradeConfig     `json:"upgrade"`
+	Commands    CommandsConfig    `json:"commands"`
+	Inbox       InboxConfig       `json:"inbox"`
+	Script      ScriptConfig      `json:"script"`
+	Outbox      OutboxConfig      `json:"outbox"`
+	Outbound    OutboundConfig    `json:"outbound"`
+	Compression CompressionConfig `json:"compression"`
+	Heartbeat   HeartbeatConfig   `json:"heartbeat"`
+	StatusPush  StatusPushConfig  `json:"status_push"`
+}
+
+// DefaultConfig is function which return agent configuration with default values
+func DefaultConfig() *Config {
+	return &Config{
+		Limits: LimitsConfig{
+			Interval:   10,
+			Violations: 3,
+		},
+		Policy: PolicyConfig{
+			ReloadInterval: 10,
+		},
+		Shutdown: ShutdownConfig{
+			Timeout:       30,
+			ModuleTimeout: 10,
+		},
+		Upgrade: UpgradeConfig{
+			HealthTimeout: 300,
+			MaxSize:       256 << 20,
+		},
+		Commands: CommandsConfig{
+			Workers:   4,
+			QueueSize: 100,
+		},
+		Inbox: InboxConfig{
+			MaxFileSize: 64 << 20,
+			Quota:       1 << 30,
+		},
+		Script: ScriptConfig{
+			Timeout:   30,
+			Memory:    64 << 20,
+			MaxOutput: 1 << 20,
+		},
+		Outbox: OutboxConfig{
+			MaxSize:  defaultOutboxMaxSize,
+			MaxAge:   86400,
+			Overflow: OutboxDropOldest,
+		},
+		Outbound: OutboundConfig{
+			QueueSize: 1000,
+		},
+		Compression: CompressionConfig{
+			Threshold: 4096,
+			MaxSize:   256 << 20,
+		},
+		Heartbeat: HeartbeatConfig{
+			Interval:  30,
+			MaxMissed: 3,
+		},
+		StatusPush: StatusPushConfig{
+			Interval: 1000,
+			Debounce: 1000,
+		},
+	}
+}
+
+// LoadConfig is function which read agent configuration from JSON file
+// Empty path means that default configuration will be used
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("failed to read config file: " + err.Error())
+	}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, errors.New("failed to parse config file: " + err.Error())
+	}
+	if err = config.validate(); err != nil {
+		return nil, errors.New("invalid config file: " + err.Error())
+	}
+
+	return config, nil
+}
+
+// validate is internal function which check values of configuration
+func (c *Config) validate() error {
+	if c.Limits.Interval <= 0 {
+		return errors.New("limits interval should be positive")
+	}
+	if c.Limits.Violations <= 0 {
+		return errors.New("limits violations should be positive")
+	}
+	if c.Policy.ReloadInterval <= 0 {
+		return errors.New("policy reload interval should be positive")
+	}
+	if c.Shutdown.Timeout <= 0 || c.Shutdown.ModuleTimeout <= 0 {
+		return errors.New("shutdown timeouts should be positive")
+	}
+	if c.HTTP.Metrics && c.HTTP.Listen == "" {
+		return errors.New("http: metrics endpoint requires listen address")
+	}
+	if c.HTTP.Listen != "" {
+		if err := checkLoopbackAddress(c.HTTP.Listen); err != nil {
+			return errors.New("http: " + err.Error())
+		}
+	}
+	for name, version := range c.Versions.Min {
+		if _, err := parseVersion(version); err != nil {
+			return errors.New("minimal version of module " + name + ": " + err.Error())
+		}
+	}
+	if c.Commands.Workers <= 0 || c.Commands.QueueSize <= 0 {
+		return errors.New("commands workers and queue size should be positive")
+	}
+	if c.Script.Timeout <= 0 || c.Script.Memory <= 0 || c.Script.MaxOutput <= 0 {
+		return errors.New("script timeout, memory and max output should be positive")
+	}
+	if c.Inbox.MaxFileSize <= 0 || c.Inbox.Quota <= 0 {
+		return errors.New("inbox max file size and quota should be positive")
+	}
+	for _, pattern := range c.Inbox.AllowedPaths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("inbox: invalid allowed path " + pattern + ": " + err.Error())
+		}
+	}
+	if c.Outbox.MaxSize <= 0 || c.Outbox.MaxAge <= 0 {
+		return errors.New("outbox max size and max age should be positive")
+	}
+	if c.Outbox.Overflow != OutboxDropOldest && c.Outbox.Overflow != OutboxDropNewest {
+		return errors.New("outbox: unknown overflow policy " + c.Outbox.Overflow)
+	}
+	if err := c.Outbound.validate(); err != nil {
+		return errors.New("outbound: " + err.Error())
+	}
+	if c.Outbound.QueueSize <= 0 {
+		return errors.New("outbound queue size should be positive")
+	}
+	if c.Compression.Threshold < 0 || c.Compression.MaxSize <= 0 {
+		return errors.New("compression threshold can't be negative and max size should be positive")
+	}
+	if c.Heartbeat.Interval <= 0 || c.Heartbeat.MaxMissed <= 0 {
+		return errors.New("heartbeat interval and max missed should be positive")
+	}
+	if c.StatusPush.Interval <= 0 || c.StatusPush.Debounce < 0 {
+		return errors.New("status push interval should be positive and debounce can't be negative")
+	}
+	if c.Upgrade.HealthTimeout <= 0 || c.Upgrade.MaxSize <= 0 {
+		return errors.New("upgrade health timeout and max size should be positive")
+	}
+	if _, err := c.GetUpgradeKeys(); err != nil {
+		return err
+	}
+	if c.Limits.Default.Memory < 0 || c.Limits.Default.CPUTime < 0 || c.Limits.Default.Events < 0 {
+		return errors.New("default limits can't be negative")
+	}
+
+	return nil
+}
+
+// GetPolicyPath is function which return path to modules policy file
+func (c *Config) GetPolicyPath(dataDir string) string {
+	if c.Policy.Path != "" {
+		return c.Policy.Path
+	}
+
+	return filepath.Join(dataDir, defaultPolicyFileName)
+}
+
+// GetShutdownTimeout is function which return overall time budget of main module stopping
+func (c *Config) GetShutdownTimeout() time.Duration {
+	return time.Second * time.Duration(c.Shutdown.Timeout)
+}
+
+// GetModuleStopTimeout is function which return time of one module stopping
+func (c *Config) GetModuleStopTimeout() time.Duration {
+	return time.Second * time.Duration(c.Shutdown.ModuleTimeout)
+}
+
+// GetControlSocketPath is function which return path to local control socket
+func (c *Config) GetControlSocketPath(dataDir string) string {
+	if c.Control.Socket != "" {
+		return c.Control.Socket
+	}
+
+	return filepath.Join(dataDir, defaultControlSocketName)
+}
+
+// GetUpgradeHealthTimeout is function which return time to connect to server by new agent binary
+func (c *Config) GetUpgradeHealthTimeout() time.Duration {
+	return time.Second * time.Duration(c.Upgrade.HealthTimeout)
+}
+
+// GetUpgradeKeys is function which return decoded keys which are trusted to sign agent binary
+func (c *Config) GetUpgradeKeys() ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, key := range c.Upgrade.PublicKeys {
+		data, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, errors.New("upgrade: failed to decode public key: " + err.Error())
+		}
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New("upgrade: invalid size of public key")
+		}
+		keys = append(keys, ed25519.PublicKey(data))
+	}
+
+	return keys, nil
+}
+
+// GetInboxDir is function which return path to directory for files pushed by server
+func (c *Config) GetInboxDir(dataDir string) string {
+	if c.Inbox.Dir != "" {
+		return c.Inbox.Dir
+	}
+
+	return filepath.Join(dataDir, defaultInboxDirName)
+}
@@ -0,0 +1,304 @@
+package mmodule
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+// controlTimeout is deadline of one request handling on control socket
+const controlTimeout = 10 * time.Second
+
+// Commands of control socket
+const (
+	ControlCmdModules    = "modules"
+	ControlCmdConnection = "connection"
+	ControlCmdConfig     = "config"
+	ControlCmdLogLevel   = "log-level"
+	ControlCmdReconnect  = "reconnect"
+	ControlCmdReload     = "reload"
+	ControlCmdMessages   = "messages"
+)
+
+// ErrControlUnavailable is error which means that there isn't running agent on control socket
+var ErrControlUnavailable = errors.New("control socket of running agent is unavailable")
+
+// ControlRequest is struct of request to running agent through control socket
+type ControlRequest struct {
+	Command string            `json:"command"`
+	Args    map[string]string `json:"args,omitempty"`
+}
+
+// ControlResponse is struct of response from running agent through control socket
+type ControlResponse struct {
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// ControlModule is struct which contains state of one module for control client
+type ControlModule struct {
+	Name    string          `json:"name"`
+	Version string          `json:"version"`
+	Status  string          `json:"status"`
+	Reason  string          `json:"reason,omitempty"`
+	Usage   json.RawMessage `json:"usage,omitempty"`
+}
+
+// ControlConnection is struct which contains state of server connection for control client
+type ControlConnection struct {
+	AgentID           string   `json:"agent_id"`
+	Server            string   `json:"server"`
+	Connected         bool     `json:"connected"`
+	Handshake         bool     `json:"handshake"`
+	Receiver          bool     `json:"receiver"`
+	Agents            []string `json:"agents,omitempty"`
+	Reconnects        uint64   `json:"reconnects"`
+	HandshakeFailures uint64   `json:"handshake_failures"`
+	RTT               float64  `json:"rtt,omitempty"`
+}
+
+// ControlConfigDump is struct which contains effective configuration of running agent
+type ControlConfigDump struct {
+	AgentID    string  `json:"agent_id"`
+	Connection string  `json:"connection"`
+	DataDir    string  `json:"data_dir"`
+	LogLevel   string  `json:"log_level"`
+	Config     *Config `json:"config"`
+}
+
+// controlServer is struct which serves requests of control clients on local socket
+type controlServer struct {
+	listener net.Listener
+	handler  func(ControlRequest) (interface{}, error)
+	wg       sync.WaitGroup
+}
+
+// newControlServer is function which run control server on the listener
+func newControlServer(listener net.Listener, handler func(ControlRequest) (interface{}, error)) *controlServer {
+	cs := &controlServer{
+		listener: listener,
+		handler:  handler,
+	}
+
+	cs.wg.Add(1)
+	go cs.serve()
+
+	return cs
+}
+
+// serve is internal function which accept connections until the listener will be closed
+func (cs *controlServer) serve() {
+	defer cs.wg.Done()
+
+	logrus.WithFields(logrus.Fields{
+		"module": "main",
+		"socket": cs.listener.Addr().String(),
+	}).Info("vxagent: control socket was opened")
+	for {
+		conn, err := cs.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		cs.wg.Add(1)
+		go func() {
+			defer cs.wg.Done()
+			cs.handleConn(conn)
+		}()
+	}
+}
+
+// handleConn is internal function which read one request from connection and write response
+func (cs *controlServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req ControlRequest
+	var resp ControlResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		resp.Error = "failed to parse request: " + err.Error()
+	} else if data, err := cs.handler(req); err != nil {
+		resp.Error = err.Error()
+	} else if resp.Data, err = json.Marshal(data); err != nil {
+		resp.Error = "failed to marshal response: " + err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		logrus.WithError(err).Warn("vxagent: failed to send control response")
+	}
+}
+
+// Close is function which stop accepting of new connections and wait current requests
+func (cs *controlServer) Close() error {
+	err := cs.listener.Close()
+	cs.wg.Wait()
+
+	return err
+}
+
+// serveControl is function which open control socket of running agent
+// Control socket is optional so the error is logged only
+func (mm *MainModule) serveControl() *controlServer {
+	if mm.GetConfig().Control.Disabled {
+		return nil
+	}
+
+	socketPath := mm.GetConfig().GetControlSocketPath(mm.dataDir)
+	listener, err := listenControl(socketPath)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"module": "main",
+			"socket": socketPath,
+		}).Warn("vxagent: failed to open control socket")
+		return nil
+	}
+
+	return newControlServer(listener, mm.handleControl)
+}
+
+// CallControl is function which send request to running agent through control socket
+func CallControl(socketPath string, req ControlRequest) (json.RawMessage, error) {
+	conn, err := dialControl(socketPath, controlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrControlUnavailable, err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err = json.NewEncoder(conn).Encode(&req); err != nil {
+		return nil, errors.New("failed to send request: " + err.Error())
+	}
+
+	var resp ControlResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, errors.New("failed to read response: " + err.Error())
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return resp.Data, nil
+}
+
+// handleControl is function which execute command from control client
+func (mm *MainModule) handleControl(req ControlRequest) (interface{}, error) {
+	logrus.WithFields(logrus.Fields{
+		"module":  "main",
+		"command": req.Command,
+	}).Debug("vxagent: got control request")
+
+	switch req.Command {
+	case ControlCmdModules:
+		return mm.getControlModules(), nil
+	case ControlCmdConnection:
+		return mm.getControlConnection(), nil
+	case ControlCmdConfig:
+		return &ControlConfigDump{
+			AgentID:    mm.agentID,
+			Connection: mm.connectionString,
+			DataDir:    mm.dataDir,
+			LogLevel:   logrus.GetLevel().String(),
+			Config:     mm.GetConfig(),
+		}, nil
+	case ControlCmdLogLevel:
+		if level, ok := req.Args["level"]; ok {
+			lvl, err := logrus.ParseLevel(level)
+			if err != nil {
+				return nil, err
+			}
+			logrus.SetLevel(lvl)
+			logrus.WithField("level", lvl.String()).Info("vxagent: log level was changed by control request")
+		}
+		return map[string]string{"level": logrus.GetLevel().String()}, nil
+	case ControlCmdReconnect:
+		if err := mm.reconnect(); err != nil {
+			return nil, err
+		}
+		return map[string]bool{"reconnecting": true}, nil
+	case ControlCmdReload:
+		restart, err := mm.ReloadConfig()
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"restart_required": restart}, nil
+	case ControlCmdMessages:
+		return mm.getControlMessages(req.Args["type"]), nil
+	default:
+		return nil, errors.New("unknown control command " + req.Command)
+	}
+}
+
+// getControlModules is function which collect registered modules with their status
+func (mm *MainModule) getControlModules() []ControlModule {
+	modules := []ControlModule{}
+	for _, entry := range mm.registry.Snapshot() {
+		cm := ControlModule{
+			Name:    entry.Config.Name,
+			Version: entry.Config.Version,
+			Status:  getModuleStatusName(entry.Status),
+		}
+		if status, reason, usage := mm.limits.GetStatus(entry.ID); usage != nil {
+			if status != agent.ModuleStatus_UNKNOWN {
+				cm.Status = getModuleStatusName(status)
+				cm.Reason = reason
+			}
+			cm.Usage, _ = json.Marshal(usage)
+		}
+		modules = append(modules, cm)
+	}
+
+	return modules
+}
+
+// getControlConnection is function which collect state of server connection
+func (mm *MainModule) getControlConnection() *ControlConnection {
+	health := mm.GetHealth()
+	conn := &ControlConnection{
+		AgentID:   mm.agentID,
+		Server:    mm.connectionString,
+		Connected: health.Connected,
+		Handshake: health.Handshake,
+		Receiver:  health.Receiver,
+	}
+	if p := mm.getProto(); p != nil {
+		for dst := range p.GetAgentList() {
+			conn.Agents = append(conn.Agents, dst)
+		}
+		sort.Strings(conn.Agents)
+	}
+
+	mm.metrics.mutex.Lock()
+	conn.Reconnects = mm.metrics.reconnects
+	conn.HandshakeFailures = mm.metrics.handshakeFailures
+	mm.metrics.mutex.Unlock()
+	conn.RTT = mm.heartbeat.getRTT().Seconds() * 1000
+
+	return conn
+}
+
+// reconnect is function which drop current connections to server,
+// the connection loop of main module will establish new one
+// Only sockets of server connections are closed, VXProto and modules sockets are kept
+func (mm *MainModule) reconnect() error {
+	if mm.getProto() == nil {
+		return errors.New("main module isn't started")
+	}
+	if len(mm.getAgentList()) == 0 {
+		return errors.New("agent isn't connected to server")
+	}
+
+	logrus.WithField("module", "main").Info("vxagent: reconnect was requested")
+	if mm.closeConnections() == 0 {
+		return errors.New("agent isn't connected to server")
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package mmodule
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// listenControl is function which open Unix socket of control server available for owner only
+// Stale socket file is removed if there isn't running agent on it
+func listenControl(socketPath string) (net.Listener, error) {
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("control socket path " + socketPath + " isn't socket")
+		}
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			conn.Close()
+			return nil, errors.New("control socket " + socketPath + " is used by another process")
+		}
+		if err = os.Remove(socketPath); err != nil {
+			return nil, errors.New("failed to remove stale control socket: " + err.Error())
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, errors.New("failed to listen control socket: " + err.Error())
+	}
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, errors.New("failed to set control socket permissions: " + err.Error())
+	}
+
+	return listener, nil
+}
+
+// dialControl is function which connect to control socket of running agent
+func dialControl(socketPath string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", socketPath, timeout)
+}
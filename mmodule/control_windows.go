@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package mmodule
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// listenControl is function which open control server socket
+// Control socket isn't supported on Windows yet
+func listenControl(socketPath string) (net.Listener, error) {
+	return nil, errors.New("control socket isn't supported on windows")
+}
+
+// dialControl is function which connect to control socket of running agent
+func dialControl(socketPath string, timeout time.Duration) (net.Conn, error) {
+	return nil, errors.New("control socket isn't supported on windows")
+}
@@ -0,0 +1,169 @@
+package mmodule
+
+import (
+	"sync"
+)
+
+// commandTask is struct which describes server command waiting for execution
+// Keys are names of modules which are affected by the command, empty list means read-only query
+type commandTask struct {
+	keys []string
+	run  func()
+}
+
+// commandDispatcher is struct which executes server commands on bounded pool of workers
+// Commands with common keys are executed in order of receiving one by one,
+// other commands are executed in parallel
+type commandDispatcher struct {
+	workers int
+	slots   chan struct{}
+	pending []*commandTask
+	running int
+	busy    map[string]int
+	closed  bool
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	mutex   *sync.Mutex
+}
+
+// newCommandDispatcher is function which constructed commandDispatcher object
+// queueSize is maximum amount of commands waiting for execution before receiver will be blocked
+func newCommandDispatcher(workers, queueSize int) *commandDispatcher {
+	return &commandDispatcher{
+		workers: workers,
+		slots:   make(chan struct{}, workers+queueSize),
+		busy:    make(map[string]int),
+		closed:  true,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Open is function which allow commands dispatching after dispatcher closing
+func (d *commandDispatcher) Open() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		d.closed = false
+		d.quit = make(chan struct{})
+	}
+}
+
+// Dispatch is function which put command to the queue, it blocks while the queue is full
+// Result is false if the dispatcher was closed and the command was dropped
+func (d *commandDispatcher) Dispatch(keys []string, run func()) bool {
+	d.mutex.Lock()
+	quit := d.quit
+	closed := d.closed
+	d.mutex.Unlock()
+	if closed {
+		return false
+	}
+
+	select {
+	case d.slots <- struct{}{}:
+	case <-quit:
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		<-d.slots
+		return false
+	}
+	d.pending = append(d.pending, &commandTask{keys: keys, run: run})
+	d.schedule()
+
+	return true
+}
+
+// schedule is internal function which run pending commands while there are free workers
+// Command can't overtake earlier pending or running command with common key
+func (d *commandDispatcher) schedule() {
+	blocked := make(map[string]struct{})
+	pending := d.pending[:0]
+	for _, t := range d.pending {
+		if d.running < d.workers && !d.hasConflict(t, blocked) {
+			d.start(t)
+			continue
+		}
+		for _, key := range t.keys {
+			blocked[key] = struct{}{}
+		}
+		pending = append(pending, t)
+	}
+	for i := len(pending); i < len(d.pending); i++ {
+		d.pending[i] = nil
+	}
+	d.pending = pending
+}
+
+// hasConflict is internal function which check that command has common key with running or blocked ones
+func (d *commandDispatcher) hasConflict(t *commandTask, blocked map[string]struct{}) bool {
+	for _, key := range t.keys {
+		if _, ok := blocked[key]; ok || d.busy[key] != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// start is internal function which execute command in separate goroutine
+func (d *commandDispatcher) start(t *commandTask) {
+	d.running++
+	for _, key := range t.keys {
+		d.busy[key]++
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		t.run()
+
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.running--
+		for _, key := range t.keys {
+			if d.busy[key]--; d.busy[key] == 0 {
+				delete(d.busy, key)
+			}
+		}
+		<-d.slots
+		if !d.closed {
+			d.schedule()
+		}
+	}()
+}
+
+// Stats is function which return amount of waiting and executing commands
+func (d *commandDispatcher) Stats() (queued, inFlight int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.pending), d.running
+}
+
+// Close is function which drop waiting commands and wait executing ones
+// Result is amount of dropped commands
+func (d *commandDispatcher) Close() int {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return 0
+	}
+	d.closed = true
+	close(d.quit)
+	dropped := len(d.pending)
+	for range d.pending {
+		<-d.slots
+	}
+	d.pending = nil
+	d.mutex.Unlock()
+
+	d.wg.Wait()
+
+	return dropped
+}
@@ -0,0 +1,70 @@
+package mmodule
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherModuleOrder(t *testing.T) {
+	d := newCommandDispatcher(4, 100)
+	d.Open()
+
+	var mutex sync.Mutex
+	order := make(map[string][]int)
+	active := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		key := []string{"module_a", "module_b"}[i%2]
+		i := i
+		wg.Add(1)
+		d.Dispatch([]string{key}, func() {
+			defer wg.Done()
+			mutex.Lock()
+			if active[key] {
+				t.Errorf("commands for %s were executed in parallel", key)
+			}
+			active[key] = true
+			mutex.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mutex.Lock()
+			active[key] = false
+			order[key] = append(order[key], i)
+			mutex.Unlock()
+		})
+	}
+	wg.Wait()
+	d.Close()
+
+	for key, list := range order {
+		for j := 1; j < len(list); j++ {
+			if list[j] < list[j-1] {
+				t.Fatalf("commands for %s were executed out of order: %v", key, list)
+			}
+		}
+	}
+}
+
+func TestDispatcherQueryNotBlocked(t *testing.T) {
+	d := newCommandDispatcher(2, 10)
+	d.Open()
+	defer d.Close()
+
+	release := make(chan struct{})
+	d.Dispatch([]string{"module"}, func() { <-release })
+	d.Dispatch([]string{"module"}, func() {})
+	if queued, inFlight := d.Stats(); queued != 1 || inFlight != 1 {
+		t.Errorf("unexpected stats: queued %d, in flight %d", queued, inFlight)
+	}
+
+	done := make(chan struct{})
+	d.Dispatch(nil, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("read-only query was blocked by module command")
+	}
+	close(release)
+}
@@ -0,0 +1,105 @@
+package mmodule
+
+import (
+	"errors"
+	"strings"
+)
+
+// Codes of errors which are reported to server about failed commands
+const (
+	// errCodeBadRequest means that the request can't be parsed or it has unknown type
+	errCodeBadRequest = "bad_request"
+	// errCodeNotFound means that the request refers to module which isn't registered
+	errCodeNotFound = "not_found"
+	// errCodeConflict means that the request contradicts current state of the agent
+	errCodeConflict = "conflict"
+	// errCodePolicyDenied means that the request was rejected by local restrictions
+	errCodePolicyDenied = "policy_denied"
+	// errCodeInternal means that the agent failed to execute valid request
+	errCodeInternal = "internal"
+)
+
+// moduleError is struct which describes failure of command for one module
+type moduleError struct {
+	Name    string `json:"name"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// commandError is struct of error which is reported to server about failed command
+// Code is taken from first failure and modules contain details for each failed module
+type commandError struct {
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	Modules []moduleError `json:"modules,omitempty"`
+}
+
+// Error is function which return human readable message of the error
+func (e *commandError) Error() string {
+	return e.Message
+}
+
+// newCommandError is function which constructed commandError object
+func newCommandError(code, message string) *commandError {
+	return &commandError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// getCommandError is function which convert any error to commandError
+// Errors without code are considered as internal
+func getCommandError(err error) *commandError {
+	var cerr *commandError
+	if errors.As(err, &cerr) {
+		return cerr
+	}
+
+	return newCommandError(errCodeInternal, err.Error())
+}
+
+// wrapModuleError is function which attach module details to error of command
+func wrapModuleError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	cerr := getCommandError(err)
+	if len(cerr.Modules) != 0 {
+		return cerr
+	}
+
+	return &commandError{
+		Code:    cerr.Code,
+		Message: cerr.Message,
+		Modules: []moduleError{{
+			Name:    name,
+			Code:    cerr.Code,
+			Message: cerr.Message,
+		}},
+	}
+}
+
+// joinErrors is function which merge errors of command into one
+// Result is nil if all errors are nil, code of result is code of first error
+func joinErrors(errs ...error) error {
+	var result *commandError
+	var messages []string
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		cerr := getCommandError(err)
+		if result == nil {
+			result = &commandError{Code: cerr.Code}
+		}
+		messages = append(messages, cerr.Message)
+		result.Modules = append(result.Modules, cerr.Modules...)
+	}
+	if result == nil {
+		return nil
+	}
+	result.Message = strings.Join(messages, " | ")
+
+	return result
+}
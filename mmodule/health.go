@@ -0,0 +1,204 @@
+package mmodule
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+// receiverBusyTimeout is maximum time of one packet handling while receiver is considered healthy
+const receiverBusyTimeout = time.Minute
+
+// Health is struct which contains current state of main module for service supervisors
+type Health struct {
+	// Started is flag that main module socket is registered and packets receiver is running
+	Started bool `json:"started"`
+	// Receiver is flag that packets receiver isn't hung on packet handling
+	Receiver bool `json:"receiver"`
+	// Connected is flag that agent has connection to server
+	Connected bool `json:"connected"`
+	// Handshake is flag that handshake with server was passed on current connection
+	Handshake bool `json:"handshake"`
+	// Modules is amount of registered modules
+	Modules int `json:"modules"`
+	// Running is amount of running modules
+	Running int `json:"running"`
+	// QueuedCommands is amount of server commands waiting for execution
+	QueuedCommands int `json:"queued_commands"`
+	// InFlightCommands is amount of server commands which are executing now
+	InFlightCommands int `json:"in_flight_commands"`
+	// OutboxEvents is amount of module events waiting for connection to server
+	OutboxEvents int `json:"outbox_events"`
+	// OutboxBytes is total size of module events waiting for connection to server
+	OutboxBytes int64 `json:"outbox_bytes"`
+	// OutboundQueued is map of traffic class to amount of packets waiting for sending to server
+	OutboundQueued map[string]int `json:"outbound_queued"`
+	// NotRunning is map of module name to status for registered modules which aren't running
+	NotRunning map[string]string `json:"not_running,omitempty"`
+	// Suspended is map of module name to reason for modules which were stopped by the agent itself
+	// after limits violation or denied by local policy, they aren't expected to run
+	Suspended map[string]string `json:"suspended,omitempty"`
+}
+
+// IsHealthy is function which check that main module is able to handle packets
+func (h Health) IsHealthy() bool {
+	return h.Started && h.Receiver
+}
+
+// IsReady is function which check that agent is connected to server and all modules are running
+// except suspended ones
+func (h Health) IsReady() bool {
+	return h.IsHealthy() && h.Connected && h.Handshake && h.Running+len(h.Suspended) == h.Modules
+}
+
+// String is function which return short human readable state of main module
+func (h Health) String() string {
+	conn := "disconnected from server"
+	if h.Connected {
+		conn = "connected to server"
+	}
+
+	return fmt.Sprintf("%s, modules: %d running of %d", conn, h.Running, h.Modules)
+}
+
+// receiverState is struct which tracks activity of packets receiver loop and server connection
+type receiverState struct {
+	running   bool
+	busySince time.Time
+	handshake bool
+	agents    map[string]struct{}
+	mutex     sync.Mutex
+}
+
+// setRunning is function which mark start or exit of receiver loop
+func (rs *receiverState) setRunning(running bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	rs.running = running
+	rs.busySince = time.Time{}
+	rs.handshake = false
+	rs.agents = make(map[string]struct{})
+}
+
+// setBusy is function which mark beginning and ending of packet handling
+func (rs *receiverState) setBusy(busy bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if busy {
+		rs.busySince = time.Now()
+	} else {
+		rs.busySince = time.Time{}
+	}
+}
+
+// setHandshake is function which store result of handshake with server
+func (rs *receiverState) setHandshake(done bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	rs.handshake = done
+}
+
+// setAgent is function which store connection state of agent socket
+func (rs *receiverState) setAgent(id string, connected bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if rs.agents == nil {
+		rs.agents = make(map[string]struct{})
+	}
+	if connected {
+		rs.agents[id] = struct{}{}
+	} else {
+		delete(rs.agents, id)
+	}
+	if len(rs.agents) == 0 {
+		rs.handshake = false
+	}
+}
+
+// isReady is function which return flag that agent is connected to server and passed handshake
+func (rs *receiverState) isReady() bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	return len(rs.agents) != 0 && rs.handshake
+}
+
+// fill is function which set receiver and connection fields of health state
+func (rs *receiverState) fill(h *Health) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	h.Started = rs.running
+	h.Receiver = rs.running && (rs.busySince.IsZero() || time.Since(rs.busySince) < receiverBusyTimeout)
+	h.Connected = len(rs.agents) != 0
+	h.Handshake = rs.handshake
+}
+
+// CheckLiveness is function which check that packets receiver loop of main module is alive
+// The probe is received by the loop itself, so exited loop or hung packet handling fail it
+func (mm *MainModule) CheckLiveness(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case mm.liveness <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errors.New("packets receiver loop doesn't answer in " + timeout.String())
+	}
+}
+
+// getSuspendReason is function which return reason of module stopping by the agent itself
+// Result is empty string if the module should be running
+func (mm *MainModule) getSuspendReason(entry moduleEntry) string {
+	if status, reason, _ := mm.limits.GetStatus(entry.ID); status == moduleStatusLimited {
+		return reason
+	}
+
+	item := entry.State.GetItem()
+	if item == nil || mm.policy.Get() == nil {
+		return ""
+	}
+	pm := newPolicyModule(entry.Config.Name, entry.Config.Version, item.GetArgs(), getFilesManifest(item.GetFiles()))
+	if err := mm.policy.Check(pm); err != nil {
+		return err.Error()
+	}
+
+	return ""
+}
+
+// GetHealth is function which return current state of main module
+func (mm *MainModule) GetHealth() Health {
+	var h Health
+	mm.receiver.fill(&h)
+	h.QueuedCommands, h.InFlightCommands = mm.commands.Stats()
+	h.OutboxEvents, h.OutboxBytes = mm.outbox.Stats()
+	h.OutboundQueued = mm.outbound.Stats()
+	for _, entry := range mm.registry.Snapshot() {
+		h.Modules++
+		if entry.Status == agent.ModuleStatus_RUNNING {
+			h.Running++
+			continue
+		}
+		if reason := mm.getSuspendReason(entry); reason != "" {
+			if h.Suspended == nil {
+				h.Suspended = make(map[string]string)
+			}
+			h.Suspended[entry.ID] = reason
+			continue
+		}
+		if h.NotRunning == nil {
+			h.NotRunning = make(map[string]string)
+		}
+		h.NotRunning[entry.ID] = entry.Status.String()
+	}
+
+	return h
+}
@@ -0,0 +1,121 @@
+package mmodule
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+func TestCheckLiveness(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	if err := mm.CheckLiveness(50 * time.Millisecond); err == nil {
+		t.Fatal("liveness probe passed without receiver loop")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	receiver := make(chan *vxproto.Packet)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mm.recvPacket(ctx, receiver)
+	}()
+	if err := mm.CheckLiveness(time.Second); err != nil {
+		t.Fatalf("liveness probe failed: %v", err)
+	}
+
+	// Packet handling is hung on receiver state lock
+	mm.receiver.mutex.Lock()
+	receiver <- &vxproto.Packet{PType: vxproto.PTText, Payload: &vxproto.Text{}}
+	err := mm.CheckLiveness(50 * time.Millisecond)
+	mm.receiver.mutex.Unlock()
+	if err == nil {
+		t.Fatal("liveness probe passed while packet handling is hung")
+	}
+	if err := mm.CheckLiveness(time.Second); err != nil {
+		t.Fatalf("liveness probe failed after packet handling: %v", err)
+	}
+
+	cancel()
+	<-done
+	if err := mm.CheckLiveness(50 * time.Millisecond); err == nil {
+		t.Fatal("liveness probe passed after receiver loop exit")
+	}
+}
+
+// getTestReadyz is function which request readyz handler and return status code and modules details
+func getTestReadyz(t *testing.T, mm *MainModule) (int, map[string]map[string]string) {
+	rec := httptest.NewRecorder()
+	mm.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	var body struct {
+		Modules struct {
+			NotRunning map[string]string `json:"not_running"`
+			Suspended  map[string]string `json:"suspended"`
+		} `json:"modules"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, map[string]map[string]string{
+		"not_running": body.Modules.NotRunning,
+		"suspended":   body.Modules.Suspended,
+	}
+}
+
+func TestReadyzSuspendedModules(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	p := vxproto.New(mm)
+	mm.receiver.setRunning(true)
+	mm.receiver.setAgent("server", true)
+	mm.receiver.setHandshake(true)
+
+	add := func(id, code string) func() error {
+		mc := newTestModuleConfig(id, "1.0.0")
+		ms, start := newTestModuleState(t, p, mc, code)
+		if err := mm.registry.Add(id, mc, ms); err != nil {
+			t.Fatal(err)
+		}
+		if err := mm.limits.Attach(id, mc, ms); err != nil {
+			t.Fatal(err)
+		}
+		return start
+	}
+	defer mm.registry.Close(context.Background(), time.Second)
+	if err := add("module_a", `__api.await(-1) return "done"`)(); err != nil {
+		t.Fatal(err)
+	}
+	// Module stopped after limits violation
+	add("module_b", `return "done"`)
+	l := mm.limits.limiters["module_b"]
+	l.status, l.reason = moduleStatusLimited, "memory limit exceeded"
+	// Module denied by local policy
+	add("module_c", `return "done"`)
+	mm.policy.policy = &Policy{Deny: []PolicyRule{{Name: "module_c"}}}
+
+	code, modules := getTestReadyz(t, mm)
+	if code != http.StatusOK {
+		t.Fatalf("agent isn't ready with suspended modules: %d %v", code, modules)
+	}
+	if len(modules["not_running"]) != 0 || len(modules["suspended"]) != 2 ||
+		modules["suspended"]["module_b"] != "memory limit exceeded" || modules["suspended"]["module_c"] == "" {
+		t.Fatalf("unexpected modules details %v", modules)
+	}
+
+	// Module which should run isn't started yet
+	add("module_d", `return "done"`)
+	code, modules = getTestReadyz(t, mm)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("agent is ready with not running module: %d", code)
+	}
+	if status := modules["not_running"]["module_d"]; status != "LOADED" {
+		t.Fatalf("unexpected modules details %v", modules)
+	}
+}
@@ -0,0 +1,157 @@
+package mmodule
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+// heartbeatPing is struct of ping and pong messages payload, pong echoes payload of ping
+// RTT is last measured round-trip time in milliseconds which is reported to server
+type heartbeatPing struct {
+	Seq  uint64  `json:"seq"`
+	Time int64   `json:"time"`
+	RTT  float64 `json:"rtt,omitempty"`
+}
+
+// heartbeatState is struct which tracks pings to server on current connection
+// Only servers which advertise heartbeat capability are pinged, so every unanswered
+// ping is counted as missed even before first pong
+type heartbeatState struct {
+	seq     uint64
+	pending bool
+	missed  int
+	rtt     time.Duration
+	mutex   *sync.Mutex
+}
+
+// newHeartbeatState is function which constructed heartbeatState object
+func newHeartbeatState() *heartbeatState {
+	return &heartbeatState{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// reset is function which forget state of previous connection
+func (hs *heartbeatState) reset() {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	hs.pending, hs.missed, hs.rtt = false, 0, 0
+}
+
+// next is function which account unanswered ping and return payload of new one
+// Result is payload of ping and amount of pings in a row which server didn't answer
+func (hs *heartbeatState) next() (*heartbeatPing, int) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	if hs.pending {
+		hs.missed++
+	}
+	hs.seq++
+	hs.pending = true
+
+	return &heartbeatPing{
+		Seq:  hs.seq,
+		Time: time.Now().UnixNano(),
+		RTT:  hs.rtt.Seconds() * 1000,
+	}, hs.missed
+}
+
+// pong is function which handle answer of server to the last ping
+// Result is measured round-trip time and flag that the pong is for the last ping
+func (hs *heartbeatState) pong(ping *heartbeatPing) (time.Duration, bool) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	if ping.Seq != hs.seq || !hs.pending {
+		return 0, false
+	}
+	hs.rtt = time.Since(time.Unix(0, ping.Time))
+	hs.pending, hs.missed = false, 0
+
+	return hs.rtt, true
+}
+
+// getRTT is function which return last measured round-trip time, zero if it isn't measured yet
+func (hs *heartbeatState) getRTT() time.Duration {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	return hs.rtt
+}
+
+// recvHeartbeat is function which handle ping and pong messages out of commands queue
+// Result is flag that the message was heartbeat one
+func (mm *MainModule) recvHeartbeat(req *request, message *agent.Message) bool {
+	switch message.GetType() {
+	case messageAgentPing:
+		if err := mm.responseAgent(req, messageAgentPong, message.Payload); err != nil {
+			req.logger.WithError(err).Warn("vxagent: failed to answer ping of server")
+		}
+	case messageAgentPong:
+		var ping heartbeatPing
+		if err := json.Unmarshal(message.Payload, &ping); err != nil {
+			req.logger.WithError(err).Warn("vxagent: failed to parse pong of server")
+			return true
+		}
+		if rtt, ok := mm.heartbeat.pong(&ping); ok {
+			mm.metrics.setHeartbeatRTT(rtt)
+			req.logger.WithField("rtt", rtt).Debug("vxagent: received pong from server")
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// runHeartbeat is function which periodically ping server and force reconnect
+// when server doesn't answer configured amount of pings in a row
+func (mm *MainModule) runHeartbeat(ctx context.Context) {
+	for {
+		config := mm.GetConfig().Heartbeat
+		select {
+		case <-time.After(time.Second * time.Duration(config.Interval)):
+		case <-ctx.Done():
+			return
+		}
+		if config.Disabled || !mm.receiver.isReady() {
+			continue
+		}
+		// Old servers don't answer pings so they must not be pinged and considered dead
+		dsts := mm.getCapableAgents(mm.getAgentList(), capabilityHeartbeat)
+		if len(dsts) == 0 {
+			continue
+		}
+
+		ping, missed := mm.heartbeat.next()
+		if missed >= config.MaxMissed {
+			logrus.WithFields(logrus.Fields{
+				"module": "main",
+				"missed": missed,
+			}).Warn("vxagent: server doesn't answer pings, connection is considered dead")
+			mm.metrics.addHeartbeatFailure()
+			mm.heartbeat.reset()
+			if err := mm.reconnect(); err != nil {
+				logrus.WithError(err).Warn("vxagent: failed to drop dead connection")
+			}
+			continue
+		}
+
+		payload, err := json.Marshal(ping)
+		if err != nil {
+			continue
+		}
+		for _, dst := range dsts {
+			if err := mm.responseAgent(newRequest(dst, "", ""), messageAgentPing, payload); err != nil {
+				logrus.WithError(err).WithField("dst", dst).Debug("vxagent: failed to send ping to server")
+			}
+		}
+	}
+}
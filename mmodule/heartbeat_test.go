@@ -0,0 +1,77 @@
+package mmodule
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+func TestHeartbeatMissedPongs(t *testing.T) {
+	hs := newHeartbeatState()
+
+	// server which hangs right after connect is detected without any pong
+	var missed int
+	for i := 0; i < 5; i++ {
+		if _, missed = hs.next(); missed != i {
+			t.Fatalf("unexpected amount of missed pings before first pong: %d", missed)
+		}
+	}
+
+	ping, _ := hs.next()
+	if _, ok := hs.pong(&heartbeatPing{Seq: ping.Seq - 1, Time: ping.Time}); ok {
+		t.Fatal("pong for previous ping was accepted")
+	}
+	if rtt, ok := hs.pong(ping); !ok || rtt <= 0 {
+		t.Fatalf("pong for last ping wasn't accepted: %v, %s", ok, rtt)
+	}
+
+	for i := 0; i < 4; i++ {
+		_, missed = hs.next()
+	}
+	if missed != 3 {
+		t.Fatalf("unexpected amount of missed pings: %d", missed)
+	}
+
+	hs.reset()
+	if _, missed = hs.next(); missed != 0 || hs.getRTT() != 0 {
+		t.Fatal("heartbeat state wasn't reset on new connection")
+	}
+}
+
+func TestHeartbeatCapability(t *testing.T) {
+	mm, socket, cleanup := newTestConnectedModule(t)
+	defer cleanup()
+	agents := map[string]*vxproto.AgentInfo{"old": {}, "new": {}}
+
+	// old server doesn't advertise capabilities and it isn't pinged
+	sendTestCommand(t, mm, &agent.Message{Type: agent.Message_GET_INFORMATION.Enum()})
+	message := &agent.Message{Type: agent.Message_GET_INFORMATION.Enum()}
+	message.XXX_unrecognized = appendUnknownString(nil, fieldMessageCapabilities, "other, heartbeat")
+	data, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm.recvData("new", &vxproto.Data{Data: data})
+	if dsts := mm.getCapableAgents(agents, capabilityHeartbeat); len(dsts) != 1 || dsts[0] != "new" {
+		t.Fatalf("unexpected servers to ping %v", dsts)
+	}
+
+	// agent advertises own capabilities into responses
+	waitCondition(t, 5*time.Second, "information wasn't sent", func() bool {
+		return len(socket.getMessages(agent.Message_INFORMATION_RESULT)) == 2
+	})
+	for _, message := range socket.getMessages(agent.Message_INFORMATION_RESULT) {
+		if value, _ := getUnknownString(message.XXX_unrecognized, fieldMessageCapabilities); value != strings.Join(supportedCapabilities, ",") {
+			t.Fatalf("capabilities weren't advertised: %q", value)
+		}
+	}
+
+	mm.capabilities.del("new")
+	if dsts := mm.getCapableAgents(agents, capabilityHeartbeat); len(dsts) != 0 {
+		t.Fatalf("capabilities of disconnected server weren't forgotten: %v", dsts)
+	}
+}
@@ -0,0 +1,151 @@
+package mmodule
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// processStartTime is time of agent process starting for uptime reporting
+var processStartTime = time.Now()
+
+// checkLoopbackAddress is function which check that listen address is bound to localhost only
+func checkLoopbackAddress(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New("invalid listen address " + addr + ": " + err.Error())
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.New("listen address " + addr + " isn't loopback address")
+	}
+
+	return nil
+}
+
+// listenHTTP is function which open listener of local HTTP server
+// Result is nil listener without error if the server is disabled
+func listenHTTP(addr string) (net.Listener, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	if err := checkLoopbackAddress(addr); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.New("failed to listen HTTP address: " + err.Error())
+	}
+
+	return listener, nil
+}
+
+// serveHTTP is function which run local HTTP server with health and metrics endpoints on the listener
+func (mm *MainModule) serveHTTP(listener net.Listener) *http.Server {
+	if listener == nil {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", mm.handleHealthz)
+	mux.HandleFunc("/readyz", mm.handleReadyz)
+	if mm.GetConfig().HTTP.Metrics {
+		mux.HandleFunc("/metrics", mm.handleMetrics)
+	}
+	server := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		logger := logrus.WithFields(logrus.Fields{
+			"module": "main",
+			"addr":   listener.Addr().String(),
+		})
+		logger.Info("vxagent: local HTTP server was started")
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.WithError(err).Error("vxagent: local HTTP server failed")
+		}
+	}()
+
+	return server
+}
+
+// writeJSON is function which write response with JSON body and status code
+func writeJSON(w http.ResponseWriter, ok bool, body interface{}) {
+	data, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(append(data, '\n'))
+}
+
+// getStatusName is function which return name of probe result
+func getStatusName(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "fail"
+}
+
+// handleHealthz is function which report liveness of the process and packets receiver
+func (mm *MainModule) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	health := mm.GetHealth()
+	ok := health.IsHealthy()
+	writeJSON(w, ok, map[string]interface{}{
+		"status": getStatusName(ok),
+		"receiver": map[string]bool{
+			"running": health.Started,
+			"healthy": health.Receiver,
+		},
+		"process": map[string]interface{}{
+			"pid":        os.Getpid(),
+			"uptime":     int64(time.Since(processStartTime).Seconds()),
+			"goroutines": runtime.NumGoroutine(),
+		},
+	})
+}
+
+// handleReadyz is function which report server connection and modules state
+func (mm *MainModule) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	health := mm.GetHealth()
+	ok := health.IsReady()
+	if health.NotRunning == nil {
+		health.NotRunning = make(map[string]string)
+	}
+	if health.Suspended == nil {
+		health.Suspended = make(map[string]string)
+	}
+	writeJSON(w, ok, map[string]interface{}{
+		"status": getStatusName(ok),
+		"server": map[string]bool{
+			"connected": health.Connected,
+			"handshake": health.Handshake,
+		},
+		"modules": map[string]interface{}{
+			"total":       health.Modules,
+			"running":     health.Running,
+			"not_running": health.NotRunning,
+			"suspended":   health.Suspended,
+		},
+	})
+}
@@ -0,0 +1,321 @@
+package mmodule
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+// inboxKey is dispatcher key of file drop commands which keeps manifest before its file
+const inboxKey = "inbox"
+
+// inboxManifestTTL is time of waiting file after its manifest was received
+const inboxManifestTTL = 10 * time.Minute
+
+// Statuses of received file which are reported to server
+const (
+	fileStatusStored   = "stored"
+	fileStatusRejected = "rejected"
+)
+
+// fileManifest is struct which describes file that server is going to push to the inbox
+// Path is relative path into inbox directory, Name of file is used if it's empty
+type fileManifest struct {
+	Uniq   string `json:"uniq"`
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// fileResult is struct of acknowledgement about file received by agent
+type fileResult struct {
+	Uniq   string `json:"uniq"`
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// inboxEntry is struct which keeps manifest with request that announced it
+type inboxEntry struct {
+	manifest fileManifest
+	req      *request
+	expires  time.Time
+}
+
+// fileInbox is struct which stores files pushed by server into inbox directory
+type fileInbox struct {
+	entries map[string]*inboxEntry
+	mutex   *sync.Mutex
+}
+
+// newFileInbox is function which constructed fileInbox object
+func newFileInbox() *fileInbox {
+	return &fileInbox{
+		entries: make(map[string]*inboxEntry),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// add is function which store manifest until its file will be received
+func (fi *fileInbox) add(req *request, manifest fileManifest) {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	now := time.Now()
+	for uniq, entry := range fi.entries {
+		if now.After(entry.expires) {
+			delete(fi.entries, uniq)
+		}
+	}
+	fi.entries[manifest.Uniq] = &inboxEntry{
+		manifest: manifest,
+		req:      req,
+		expires:  now.Add(inboxManifestTTL),
+	}
+}
+
+// take is function which return and forget manifest of the file
+func (fi *fileInbox) take(uniq string) *inboxEntry {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	entry, ok := fi.entries[uniq]
+	if !ok || time.Now().After(entry.expires) {
+		delete(fi.entries, uniq)
+		return nil
+	}
+	delete(fi.entries, uniq)
+
+	return entry
+}
+
+// getInboxPath is function which check relative path of file and match it by allowlist
+func getInboxPath(name string, allowed []string) (string, error) {
+	name = filepath.ToSlash(name)
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errors.New("path of file should be relative")
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.New("path of file is outside of inbox")
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", errors.New("path of file can't contain hidden entries")
+		}
+	}
+
+	for _, pattern := range allowed {
+		if matched, err := path.Match(pattern, clean); err == nil && matched {
+			return clean, nil
+		}
+	}
+
+	return "", errors.New("path " + clean + " isn't allowed")
+}
+
+// getInboxUsage is function which return total size of files into inbox directory
+func getInboxUsage(dir string) (int64, error) {
+	var usage int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			usage += info.Size()
+		}
+		return nil
+	})
+
+	return usage, err
+}
+
+// checkInboxPath is function which check that existing entries of relative path into inbox
+// aren't symbolic links, so the file can't be redirected outside of inbox directory
+func checkInboxPath(dir, rel string) error {
+	parts := strings.Split(rel, "/")
+	cur := dir
+	for idx, part := range parts {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("path of file contains symbolic link " + path.Join(parts[:idx+1]...))
+		}
+		if idx == len(parts)-1 && !info.Mode().IsRegular() {
+			return errors.New("path of file isn't regular file")
+		}
+	}
+
+	return nil
+}
+
+// writeInboxFile is function which copy file content into temporary file near destination
+// Size and hash are verified while copying, destination is replaced only by verified file
+func writeInboxFile(dst string, r io.Reader, manifest fileManifest) error {
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.New("failed to write file into inbox: " + err.Error())
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return errors.New("failed to write file into inbox: " + err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, manifest.Size+1))
+	if err != nil {
+		tmp.Close()
+		return errors.New("failed to write file into inbox: " + err.Error())
+	}
+	if size != manifest.Size {
+		tmp.Close()
+		return errors.New("size of file mismatch")
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != strings.ToLower(manifest.SHA256) {
+		tmp.Close()
+		return errors.New("hash of file mismatch")
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.New("failed to write file into inbox: " + err.Error())
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.New("failed to write file into inbox: " + err.Error())
+	}
+	if err = os.Rename(tmp.Name(), dst); err != nil {
+		return errors.New("failed to write file into inbox: " + err.Error())
+	}
+
+	return nil
+}
+
+// storeInboxFile is function which verify received file by its manifest and write it into inbox
+// Limits are checked by manifest before reading, result is relative path of stored file
+func (mm *MainModule) storeInboxFile(manifest fileManifest, r io.Reader) (string, error) {
+	config := mm.GetConfig()
+	if len(config.Inbox.AllowedPaths) == 0 {
+		return "", errors.New("file drop is disabled because allowed paths aren't configured")
+	}
+
+	name := manifest.Path
+	if name == "" {
+		name = manifest.Name
+	}
+	rel, err := getInboxPath(name, config.Inbox.AllowedPaths)
+	if err != nil {
+		return "", err
+	}
+
+	if manifest.Size < 0 {
+		return rel, errors.New("size of file mismatch")
+	}
+	if manifest.Size > config.Inbox.MaxFileSize {
+		return rel, errors.New("file exceeds maximum size " + strconv.FormatInt(config.Inbox.MaxFileSize, 10))
+	}
+
+	dir := config.GetInboxDir(mm.dataDir)
+	dst := filepath.Join(dir, filepath.FromSlash(rel))
+	if err = checkInboxPath(dir, rel); err != nil {
+		return rel, err
+	}
+	usage, err := getInboxUsage(dir)
+	if err != nil {
+		return rel, errors.New("failed to get inbox usage: " + err.Error())
+	}
+	if info, err := os.Lstat(dst); err == nil && info.Mode().IsRegular() {
+		usage -= info.Size()
+	}
+	if usage+manifest.Size > config.Inbox.Quota {
+		return rel, errors.New("inbox quota " + strconv.FormatInt(config.Inbox.Quota, 10) + " is exceeded")
+	}
+
+	return rel, writeInboxFile(dst, r, manifest)
+}
+
+// sendFileResult is function which acknowledge to server about received file
+func (mm *MainModule) sendFileResult(req *request, result *fileResult) {
+	logger := req.logger.WithFields(logrus.Fields{
+		"uniq":   result.Uniq,
+		"name":   result.Name,
+		"path":   result.Path,
+		"status": result.Status,
+	})
+	if result.Error != "" {
+		logger.WithField("reason", result.Error).Warn("vxagent: file was rejected")
+	} else {
+		logger.Info("vxagent: file was stored into inbox")
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	if err = mm.responseAgent(req, messageFileResult, data); err != nil {
+		logger.WithError(err).Warn("vxagent: failed to send file result")
+	}
+}
+
+// serveFileManifest is function which handle announcement of file that server is going to push
+func (mm *MainModule) serveFileManifest(req *request, data []byte) error {
+	var manifest fileManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return newCommandError(errCodeBadRequest, "error unmarshal of file manifest: "+err.Error())
+	}
+	if manifest.Uniq == "" || manifest.SHA256 == "" {
+		return newCommandError(errCodeBadRequest, "file manifest should contain uniq and sha256")
+	}
+
+	mm.inbox.add(req, manifest)
+	return nil
+}
+
+// execFile is function which store file pushed by server and acknowledge it
+func (mm *MainModule) execFile(src string, file *vxproto.File) {
+	entry := mm.inbox.take(file.Uniq)
+	if entry == nil {
+		mm.sendFileResult(newRequest(src, "", "FILE"), &fileResult{
+			Uniq:   file.Uniq,
+			Name:   file.Name,
+			Status: fileStatusRejected,
+			Error:  "file manifest wasn't received or it was expired",
+		})
+		return
+	}
+
+	result := &fileResult{
+		Uniq:   file.Uniq,
+		Name:   entry.manifest.Name,
+		Status: fileStatusStored,
+	}
+	rel, err := mm.storeInboxFile(entry.manifest, bytes.NewReader(file.Data))
+	result.Path = rel
+	if err != nil {
+		result.Status = fileStatusRejected
+		result.Error = err.Error()
+	}
+	mm.sendFileResult(entry.req, result)
+}
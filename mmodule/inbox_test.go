@@ -0,0 +1,202 @@
+package mmodule
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+func newTestManifest(uniq, path string, data []byte) fileManifest {
+	sum := sha256.Sum256(data)
+	return fileManifest{
+		Uniq:   uniq,
+		Name:   filepath.Base(path),
+		Path:   path,
+		Size:   int64(len(data)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+// getInboxFiles is function which return relative paths of all entries into inbox directory
+func getInboxFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestGetInboxPath(t *testing.T) {
+	allowed := []string{"*.txt", "reports/*"}
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"simple file", "notes.txt", true},
+		{"nested file", "reports/2021.csv", true},
+		{"cleaned path", "reports/../notes.txt", true},
+		{"empty path", "", false},
+		{"parent directory", "../notes.txt", false},
+		{"escape by nested parents", "reports/../../notes.txt", false},
+		{"absolute path", "/etc/notes.txt", false},
+		{"hidden file", ".notes.txt", false},
+		{"hidden directory", "reports/.ssh/keys", false},
+		{"not allowed extension", "notes.sh", false},
+		{"not allowed directory", "other/2021.csv", false},
+	}
+	for _, tt := range tests {
+		if _, err := getInboxPath(tt.path, allowed); (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected result %v", tt.name, err)
+		}
+	}
+}
+
+func TestStoreInboxFileRejected(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	config := mm.GetConfig()
+	config.Inbox.AllowedPaths = []string{"*", "*/*"}
+	config.Inbox.MaxFileSize = 16
+	config.Inbox.Quota = 15
+	dir := config.GetInboxDir(mm.dataDir)
+
+	data := []byte("0123456789")
+	corrupted := newTestManifest("1", "file", data)
+	corrupted.SHA256 = strings.Repeat("0", 64)
+	short := newTestManifest("2", "file", data)
+	short.Size--
+	large := newTestManifest("3", "file", bytes.Repeat(data, 2))
+
+	tests := []struct {
+		name     string
+		manifest fileManifest
+		data     []byte
+		reason   string
+	}{
+		{"hash mismatch", corrupted, data, "hash of file mismatch"},
+		{"size mismatch", short, data, "size of file mismatch"},
+		{"too large file", large, bytes.Repeat(data, 2), "maximum size"},
+		{"traversal", newTestManifest("4", "../file", data), data, "outside of inbox"},
+	}
+	for _, tt := range tests {
+		if _, err := mm.storeInboxFile(tt.manifest, bytes.NewReader(tt.data)); err == nil ||
+			!strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+	if files := getInboxFiles(t, dir); len(files) != 0 {
+		t.Fatalf("rejected files were left into inbox: %v", files)
+	}
+
+	// Quota accounts existing files except replaced one
+	if _, err := mm.storeInboxFile(newTestManifest("5", "first", data), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mm.storeInboxFile(newTestManifest("6", "second", data), bytes.NewReader(data)); err == nil ||
+		!strings.Contains(err.Error(), "quota") {
+		t.Fatalf("inbox quota wasn't enforced: %v", err)
+	}
+	if _, err := mm.storeInboxFile(newTestManifest("7", "first", data), bytes.NewReader(data)); err != nil {
+		t.Fatalf("file wasn't replaced: %v", err)
+	}
+
+	config.Inbox.AllowedPaths = nil
+	if _, err := mm.storeInboxFile(newTestManifest("8", "third", data), bytes.NewReader(data)); err == nil {
+		t.Fatal("file was stored without allowed paths")
+	}
+}
+
+func TestStoreInboxFileSymlink(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	config := mm.GetConfig()
+	config.Inbox.AllowedPaths = []string{"*", "*/*"}
+	dir := config.GetInboxDir(mm.dataDir)
+
+	outside := filepath.Join(mm.dataDir, "outside")
+	for _, path := range []string{dir, outside} {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skipf("symbolic links aren't supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "target"), filepath.Join(dir, "file")); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("data")
+	for _, path := range []string{"link/file", "file"} {
+		if _, err := mm.storeInboxFile(newTestManifest("1", path, data), bytes.NewReader(data)); err == nil ||
+			!strings.Contains(err.Error(), "symbolic link") {
+			t.Errorf("file %s was written by symbolic link: %v", path, err)
+		}
+	}
+	if files := getInboxFiles(t, outside); len(files) != 0 {
+		t.Fatalf("files were written outside of inbox: %v", files)
+	}
+}
+
+func TestFileDrop(t *testing.T) {
+	mm, socket, cleanup := newTestConnectedModule(t)
+	defer cleanup()
+	config := mm.GetConfig()
+	config.Inbox.AllowedPaths = []string{"drop/*"}
+	dir := config.GetInboxDir(mm.dataDir)
+
+	data := []byte("file content")
+	manifest, err := json.Marshal(newTestManifest("uniq", "drop/file.txt", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendTestCommand(t, mm, newTestRequestMessage(messageFileManifest, "req", manifest))
+	mm.recvFile("server", &vxproto.File{Data: data, Name: "file.txt", Uniq: "uniq"})
+	// File without manifest is rejected
+	mm.recvFile("server", &vxproto.File{Data: data, Name: "other.txt", Uniq: "other"})
+	waitCondition(t, 5*time.Second, "file results weren't sent", func() bool {
+		return len(socket.getMessages(messageFileResult)) == 2
+	})
+
+	results := make(map[string]fileResult)
+	for _, message := range socket.getMessages(messageFileResult) {
+		var result fileResult
+		if err := json.Unmarshal(message.Payload, &result); err != nil {
+			t.Fatal(err)
+		}
+		results[result.Uniq] = result
+	}
+	if result := results["uniq"]; result.Status != fileStatusStored || result.Path != "drop/file.txt" {
+		t.Fatalf("unexpected result of stored file %+v", result)
+	}
+	if result := results["other"]; result.Status != fileStatusRejected || result.Error == "" {
+		t.Fatalf("unexpected result of file without manifest %+v", result)
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "drop", "file.txt"))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("file wasn't stored into inbox: %v", err)
+	}
+	if files := getInboxFiles(t, dir); len(files) != 1 {
+		t.Fatalf("unexpected files into inbox: %v", files)
+	}
+}
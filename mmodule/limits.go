@@ -0,0 +1,454 @@
+package mmodule
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/golua/lua"
+	"github.com/vxcontrol/luar"
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/loader"
+	vxlua "github.com/vxcontrol/vxcommon/lua"
+)
+
+const (
+	// limitsProbesPerInterval is amount of lua state probes during one accounting interval
+	limitsProbesPerInterval = 20
+	// limitsMinProbePeriod is minimal period between lua state probes
+	limitsMinProbePeriod = 100 * time.Millisecond
+)
+
+// limitsLuaWrapper is lua code which passes all sent packets through events limiter
+const limitsLuaWrapper = `
+for _, name in ipairs({"send_data_to", "send_file_to", "send_text_to", "send_msg_to", "send_file_from_fs_to"}) do
+	local send = __api[name]
+	__api[name] = function(...)
+		if not __limits.allow_event() then
+			return false
+		end
+		return send(...)
+	end
+end
+`
+
+// moduleUsage is struct which contains resources usage of module for last interval
+type moduleUsage struct {
+	Memory  int64 `json:"memory"`
+	CPUTime int64 `json:"cpu_time"`
+	Events  int64 `json:"events"`
+	Dropped int64 `json:"dropped"`
+}
+
+// moduleLimiter is struct which accounts resources usage of one module
+// CPU time is estimated as time while lua state kept own lock,
+// the module releases it only into blocked API calls (await, recv and etc.)
+type moduleLimiter struct {
+	id         string
+	state      *vxlua.State
+	ms         *loader.ModuleState
+	limits     ModuleLimits
+	quit       chan struct{}
+	mutex      *sync.Mutex
+	memory     int64
+	events     int64
+	dropped    int64
+	busy       time.Duration
+	probing    bool
+	probeStart time.Time
+	throttling bool
+	usage      moduleUsage
+	violations int
+	status     agent.ModuleStatus_Status
+	reason     string
+}
+
+// limitsMonitor is struct which controls resources limits of all modules
+type limitsMonitor struct {
+	config   LimitsConfig
+	limiters map[string]*moduleLimiter
+	mutex    *sync.Mutex
+	wg       sync.WaitGroup
+	quit     chan struct{}
+	onStop   func(id, reason string) error
+	onChange func()
+}
+
+// newLimitsMonitor is function which constructed limitsMonitor object
+// onStop callback is used to stop module which violated limits,
+// onChange callback is used to notify about changes of modules status
+func newLimitsMonitor(config LimitsConfig, onStop func(id, reason string) error, onChange func()) *limitsMonitor {
+	return &limitsMonitor{
+		config:   config,
+		limiters: make(map[string]*moduleLimiter),
+		mutex:    &sync.Mutex{},
+		onStop:   onStop,
+		onChange: onChange,
+	}
+}
+
+// getModuleLimits is function which merge default limits with declared in module config
+// Module declares limits into "limits" object of current config
+func getModuleLimits(mc *loader.ModuleConfig, def ModuleLimits) ModuleLimits {
+	limits := def
+	var config struct {
+		Limits *ModuleLimits `json:"limits"`
+	}
+	if err := json.Unmarshal([]byte(mc.GetCurrentConfig()), &config); err != nil || config.Limits == nil {
+		return limits
+	}
+
+	if config.Limits.Memory > 0 {
+		limits.Memory = config.Limits.Memory
+	}
+	if config.Limits.CPUTime > 0 {
+		limits.CPUTime = config.Limits.CPUTime
+	}
+	if config.Limits.Events > 0 {
+		limits.Events = config.Limits.Events
+	}
+
+	return limits
+}
+
+// Attach is function which start accounting of module and install events limiter into lua state
+func (lm *limitsMonitor) Attach(id string, mc *loader.ModuleConfig, ms *loader.ModuleState) error {
+	l := &moduleLimiter{
+		id:     id,
+		state:  ms.GetState(),
+		ms:     ms,
+		limits: getModuleLimits(mc, lm.getConfig().Default),
+		quit:   make(chan struct{}),
+		mutex:  &sync.Mutex{},
+	}
+	if l.state == nil {
+		return fmt.Errorf("lua state of module %s not initialized", id)
+	}
+
+	luar.Register(l.state.L, "__limits", luar.Map{
+		"allow_event": l.allowEvent,
+	})
+	if err := l.state.L.DoString(limitsLuaWrapper); err != nil {
+		return fmt.Errorf("failed to install events limiter into module %s: %s", id, err.Error())
+	}
+
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	if ol, ok := lm.limiters[id]; ok {
+		close(ol.quit)
+	}
+	lm.limiters[id] = l
+
+	return nil
+}
+
+// Detach is function which stop accounting of module and release its lua state
+func (lm *limitsMonitor) Detach(id string) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	if l, ok := lm.limiters[id]; ok {
+		close(l.quit)
+		delete(lm.limiters, id)
+	}
+}
+
+// SetLimits is function which update module limits after config changing
+func (lm *limitsMonitor) SetLimits(id string, mc *loader.ModuleConfig) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	if l, ok := lm.limiters[id]; ok {
+		l.mutex.Lock()
+		l.limits = getModuleLimits(mc, lm.config.Default)
+		l.mutex.Unlock()
+	}
+}
+
+// GetStatus is function which return extended status, reason and usage of module
+// Zero status value means that module works into own limits
+func (lm *limitsMonitor) GetStatus(id string) (agent.ModuleStatus_Status, string, *moduleUsage) {
+	lm.mutex.Lock()
+	l, ok := lm.limiters[id]
+	lm.mutex.Unlock()
+	if !ok {
+		return agent.ModuleStatus_UNKNOWN, "", nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	usage := l.usage
+
+	return l.status, l.reason, &usage
+}
+
+// getConfig is internal function which return current limits settings
+func (lm *limitsMonitor) getConfig() LimitsConfig {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	return lm.config
+}
+
+// SetConfig is function which apply new limits settings
+// Modules limits should be updated by SetLimits and accounting loop is restarted if interval was changed
+func (lm *limitsMonitor) SetConfig(config LimitsConfig) {
+	lm.mutex.Lock()
+	restart := lm.quit != nil && lm.config.Interval != config.Interval
+	lm.config = config
+	if restart {
+		close(lm.quit)
+		lm.quit = nil
+	}
+	lm.mutex.Unlock()
+
+	if restart {
+		lm.wg.Wait()
+		lm.Start()
+	}
+}
+
+// Start is function which run background accounting of modules usage
+func (lm *limitsMonitor) Start() {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	if lm.quit != nil {
+		return
+	}
+	lm.quit = make(chan struct{})
+
+	interval := time.Second * time.Duration(lm.config.Interval)
+	period := interval / limitsProbesPerInterval
+	if period < limitsMinProbePeriod {
+		period = limitsMinProbePeriod
+	}
+
+	lm.wg.Add(1)
+	go func(quit chan struct{}) {
+		defer lm.wg.Done()
+
+		probeTicker := time.NewTicker(period)
+		defer probeTicker.Stop()
+		accountTicker := time.NewTicker(interval)
+		defer accountTicker.Stop()
+
+		for {
+			select {
+			case <-probeTicker.C:
+				for _, l := range lm.getLimiters() {
+					l.probe()
+				}
+			case <-accountTicker.C:
+				lm.account(interval)
+			case <-quit:
+				return
+			}
+		}
+	}(lm.quit)
+}
+
+// Stop is function which stop background accounting and release all throttled states
+func (lm *limitsMonitor) Stop() {
+	lm.mutex.Lock()
+	if lm.quit == nil {
+		lm.mutex.Unlock()
+		return
+	}
+	close(lm.quit)
+	lm.quit = nil
+	for id, l := range lm.limiters {
+		close(l.quit)
+		delete(lm.limiters, id)
+	}
+	lm.mutex.Unlock()
+
+	lm.wg.Wait()
+}
+
+// getLimiters is internal function which return snapshot of limiters list
+func (lm *limitsMonitor) getLimiters() []*moduleLimiter {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	limiters := make([]*moduleLimiter, 0, len(lm.limiters))
+	for _, l := range lm.limiters {
+		limiters = append(limiters, l)
+	}
+
+	return limiters
+}
+
+// account is internal function which check usage of all modules for last interval
+func (lm *limitsMonitor) account(interval time.Duration) {
+	var changed bool
+	violations := lm.getConfig().Violations
+	for _, l := range lm.getLimiters() {
+		action, reason := l.account(interval, violations)
+		switch action {
+		case limiterActionChange:
+			changed = true
+		case limiterActionStop:
+			changed = true
+			logger := logrus.WithFields(logrus.Fields{
+				"module": "main",
+				"name":   l.id,
+				"reason": reason,
+			})
+			logger.Warn("vxagent: module will be stopped because it exceeded limits")
+			if err := lm.onStop(l.id, reason); err != nil {
+				logger.WithError(err).Error("vxagent: failed to stop module which exceeded limits")
+			}
+		}
+	}
+
+	if changed && lm.onChange != nil {
+		lm.onChange()
+	}
+}
+
+type limiterAction int
+
+const (
+	limiterActionNone limiterAction = iota
+	limiterActionChange
+	limiterActionStop
+)
+
+// allowEvent is function which called from lua state before each packet sending
+func (l *moduleLimiter) allowEvent() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.events++
+	if l.limits.Events != 0 && l.events > l.limits.Events {
+		l.dropped++
+		return false
+	}
+
+	return true
+}
+
+// probe is function which measure time of waiting lua state lock and its heap size
+func (l *moduleLimiter) probe() {
+	l.mutex.Lock()
+	if l.probing || l.throttling {
+		l.mutex.Unlock()
+		return
+	}
+	l.probing = true
+	l.probeStart = time.Now()
+	l.mutex.Unlock()
+
+	go func() {
+		L := l.state.L
+		L.Lock()
+		memory := int64(L.GC(lua.LUA_GCCOUNT, 0))*1024 + int64(L.GC(lua.LUA_GCCOUNTB, 0))
+		L.Unlock()
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.busy += time.Since(l.probeStart)
+		l.memory = memory
+		l.probing = false
+	}()
+}
+
+// throttle is function which hold lua state lock to pause module execution
+func (l *moduleLimiter) throttle(penalty time.Duration) {
+	l.throttling = true
+	go func() {
+		L := l.state.L
+		L.Lock()
+		select {
+		case <-time.After(penalty):
+		case <-l.quit:
+		}
+		L.Unlock()
+
+		l.mutex.Lock()
+		l.throttling = false
+		l.mutex.Unlock()
+	}()
+}
+
+// account is function which close usage interval and check module limits
+// Result is action which should be applied by monitor and reason of it
+func (l *moduleLimiter) account(interval time.Duration, maxViolations int) (limiterAction, string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	select {
+	case <-l.quit:
+		return limiterActionNone, ""
+	default:
+	}
+
+	if l.probing {
+		// The probe is waiting a lock yet so rest of time will account in next interval
+		now := time.Now()
+		l.busy += now.Sub(l.probeStart)
+		l.probeStart = now
+	}
+	l.usage = moduleUsage{
+		Memory:  l.memory,
+		CPUTime: int64(l.busy / time.Millisecond),
+		Events:  l.events,
+		Dropped: l.dropped,
+	}
+	l.busy, l.events, l.dropped = 0, 0, 0
+
+	if l.status == moduleStatusLimited || l.ms.GetStatus() != agent.ModuleStatus_RUNNING {
+		return limiterActionNone, ""
+	}
+
+	var reasons []string
+	if l.limits.Memory != 0 && l.usage.Memory > l.limits.Memory {
+		reason := fmt.Sprintf("memory limit exceeded: %d > %d bytes", l.usage.Memory, l.limits.Memory)
+		l.status, l.reason = moduleStatusLimited, reason
+		return limiterActionStop, reason
+	}
+	if l.limits.CPUTime != 0 && l.usage.CPUTime > l.limits.CPUTime {
+		reasons = append(reasons, fmt.Sprintf("cpu time limit exceeded: %d > %d ms", l.usage.CPUTime, l.limits.CPUTime))
+		penalty := time.Duration(l.usage.CPUTime-l.limits.CPUTime) * time.Millisecond
+		if penalty > interval/2 {
+			penalty = interval / 2
+		}
+		if !l.throttling {
+			l.throttle(penalty)
+		}
+	}
+	if l.usage.Dropped != 0 {
+		reasons = append(reasons, fmt.Sprintf("events limit exceeded: %d > %d", l.usage.Events, l.limits.Events))
+	}
+
+	if len(reasons) == 0 {
+		l.violations = 0
+		if l.status != agent.ModuleStatus_UNKNOWN {
+			l.status, l.reason = agent.ModuleStatus_UNKNOWN, ""
+			return limiterActionChange, ""
+		}
+		return limiterActionNone, ""
+	}
+
+	l.violations++
+	reason := reasons[0]
+	for _, r := range reasons[1:] {
+		reason += "; " + r
+	}
+	if l.violations >= maxViolations {
+		reason = fmt.Sprintf("%s (%d intervals in a row)", reason, l.violations)
+		l.status, l.reason = moduleStatusLimited, reason
+		return limiterActionStop, reason
+	}
+
+	previous := l.status
+	l.status, l.reason = moduleStatusThrottled, reason
+	if previous != moduleStatusThrottled {
+		return limiterActionChange, reason
+	}
+
+	return limiterActionNone, reason
+}
@@ -0,0 +1,284 @@
+package mmodule
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vxcontrol/luar"
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/loader"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+// newTestModuleState is function which create lua state of module with main.lua code
+// Result start function runs the module and waits until its code is executed
+// because lua module ignores stopping before it was started
+// Loader and lua module of vxcommon change their flags from own goroutines without
+// synchronization, so tests of running modules are skipped under race detector
+func newTestModuleState(t *testing.T, p vxproto.IVXProto, mc *loader.ModuleConfig, code string) (*loader.ModuleState, func() error) {
+	mi := loader.NewItem()
+	mi.SetFiles(map[string][]byte{"main.lua": []byte("__test.started()\n" + code)})
+	mi.SetArgs(make(map[string][]string))
+	ms, err := loader.NewState(mc, mi, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{}, 1)
+	luar.Register(ms.GetState().L, "__test", luar.Map{
+		"started": func() { started <- struct{}{} },
+	})
+	return ms, func() error {
+		if raceEnabled {
+			t.Skip("running lua module races inside vxcommon loader")
+		}
+		if err := ms.Start(); err != nil {
+			return err
+		}
+		select {
+		case <-started:
+			return nil
+		case <-time.After(5 * time.Second):
+			return errors.New("module " + mc.Name + " wasn't started")
+		}
+	}
+}
+
+// waitCondition is function which wait until condition is true or fail test after timeout
+func waitCondition(t *testing.T, timeout time.Duration, msg string, cond func() bool) {
+	for deadline := time.Now().Add(timeout); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testLimitsStops struct {
+	reasons map[string]string
+	mutex   sync.Mutex
+}
+
+func (s *testLimitsStops) onStop(id, reason string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reasons[id] = reason
+	return nil
+}
+
+func (s *testLimitsStops) get(id string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reasons[id]
+}
+
+func newTestLimitsMonitor(t *testing.T, config LimitsConfig, id, code string) (*limitsMonitor, *moduleLimiter, *testLimitsStops, func()) {
+	mm, cleanup := newTestMainModule(t)
+	stops := &testLimitsStops{reasons: make(map[string]string)}
+	lm := newLimitsMonitor(config, stops.onStop, nil)
+
+	mc := newTestModuleConfig(id, "1.0.0")
+	ms, start := newTestModuleState(t, vxproto.New(mm), mc, code)
+	if err := lm.Attach(id, mc, ms); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err := start(); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return lm, lm.limiters[id], stops, func() {
+		lm.Detach(id)
+		ms.Close()
+		cleanup()
+	}
+}
+
+func TestLimitsEventsLimiter(t *testing.T) {
+	config := DefaultConfig().Limits
+	config.Default.Events = 2
+	code := `
+		for i = 1, 5 do
+			__api.send_data_to("unknown", "data")
+		end
+		__api.await(-1)
+		return "done"
+	`
+	lm, l, _, cleanup := newTestLimitsMonitor(t, config, "module_a", code)
+	defer cleanup()
+
+	waitCondition(t, 5*time.Second, "module didn't send events", func() bool {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return l.events == 5
+	})
+	lm.account(time.Second)
+	status, reason, usage := lm.GetStatus("module_a")
+	if usage == nil || usage.Events != 5 || usage.Dropped != 3 {
+		t.Fatalf("unexpected events usage %+v", usage)
+	}
+	if status != moduleStatusThrottled || !strings.Contains(reason, "events limit exceeded") {
+		t.Fatalf("unexpected module status %s (%s)", getModuleStatusName(status), reason)
+	}
+}
+
+func TestLimitsThrottlingAndStop(t *testing.T) {
+	config := DefaultConfig().Limits
+	config.Default.CPUTime = 10
+	config.Violations = 2
+	lm, l, stops, cleanup := newTestLimitsMonitor(t, config, "module_a", `__api.await(-1) return "done"`)
+	defer cleanup()
+
+	l.mutex.Lock()
+	l.busy = 110 * time.Millisecond
+	l.mutex.Unlock()
+	lm.account(time.Second)
+	status, reason, _ := lm.GetStatus("module_a")
+	if status != moduleStatusThrottled || !strings.Contains(reason, "cpu time limit exceeded") {
+		t.Fatalf("unexpected module status %s (%s)", getModuleStatusName(status), reason)
+	}
+
+	// Throttled module is paused by holding lua state lock during penalty
+	l.mutex.Lock()
+	throttling := l.throttling
+	l.mutex.Unlock()
+	if !throttling {
+		t.Fatal("module exceeded cpu time limit wasn't throttled")
+	}
+	waitCondition(t, 2*time.Second, "penalty wasn't released", func() bool {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return !l.throttling
+	})
+
+	// Module is stopped after violations in a row
+	l.mutex.Lock()
+	l.busy = 110 * time.Millisecond
+	l.mutex.Unlock()
+	lm.account(time.Second)
+	if status, _, _ = lm.GetStatus("module_a"); status != moduleStatusLimited {
+		t.Fatalf("unexpected module status %s", getModuleStatusName(status))
+	}
+	if reason := stops.get("module_a"); !strings.Contains(reason, "2 intervals in a row") {
+		t.Fatalf("unexpected stop reason %q", reason)
+	}
+}
+
+func TestLimitsRecovery(t *testing.T) {
+	config := DefaultConfig().Limits
+	config.Default.CPUTime = 1000
+	lm, l, stops, cleanup := newTestLimitsMonitor(t, config, "module_a", `__api.await(-1) return "done"`)
+	defer cleanup()
+
+	l.mutex.Lock()
+	l.events, l.dropped = 10, 1
+	l.mutex.Unlock()
+	lm.account(time.Second)
+	if status, _, _ := lm.GetStatus("module_a"); status != moduleStatusThrottled {
+		t.Fatalf("unexpected module status %s", getModuleStatusName(status))
+	}
+
+	lm.account(time.Second)
+	if status, reason, _ := lm.GetStatus("module_a"); status != agent.ModuleStatus_UNKNOWN || reason != "" {
+		t.Fatalf("module status wasn't reset: %s (%s)", getModuleStatusName(status), reason)
+	}
+	if reason := stops.get("module_a"); reason != "" {
+		t.Fatalf("module was stopped: %s", reason)
+	}
+}
+
+func TestLimitsMemoryStop(t *testing.T) {
+	config := DefaultConfig().Limits
+	config.Default.Memory = 1024
+	lm, l, stops, cleanup := newTestLimitsMonitor(t, config, "module_a", `__api.await(-1) return "done"`)
+	defer cleanup()
+
+	l.probe()
+	waitCondition(t, 2*time.Second, "lua state wasn't probed", func() bool {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return !l.probing && l.memory != 0
+	})
+	lm.account(time.Second)
+	if status, _, _ := lm.GetStatus("module_a"); status != moduleStatusLimited {
+		t.Fatalf("unexpected module status %s", getModuleStatusName(status))
+	}
+	if reason := stops.get("module_a"); !strings.Contains(reason, "memory limit exceeded") {
+		t.Fatalf("unexpected stop reason %q", reason)
+	}
+}
+
+func TestGetModuleLimits(t *testing.T) {
+	def := ModuleLimits{Memory: 100, CPUTime: 200, Events: 300}
+	mc := newTestModuleConfig("module_a", "1.0.0")
+	mc.IConfigItem = &loader.ModuleConfigItem{CurrentConfig: `{"limits": {"cpu_time": 50}}`}
+	limits := getModuleLimits(mc, def)
+	if limits.Memory != 100 || limits.CPUTime != 50 || limits.Events != 300 {
+		t.Fatalf("unexpected module limits %+v", limits)
+	}
+}
+
+func TestStatusModulesExtendedStatus(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	mc := newTestModuleConfig("module_a", "1.0.0")
+	ms, _ := newTestModuleState(t, vxproto.New(mm), mc, `return "done"`)
+	if err := mm.registry.Add("module_a", mc, ms); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.limits.Attach("module_a", mc, ms); err != nil {
+		t.Fatal(err)
+	}
+	l := mm.limits.limiters["module_a"]
+	l.status, l.reason = moduleStatusThrottled, "cpu time limit exceeded"
+
+	list := mm.getStatusModules().GetList()
+	if len(list) != 1 {
+		t.Fatalf("unexpected modules list %v", list)
+	}
+	if list[0].GetStatus() != agent.ModuleStatus_LOADED {
+		t.Fatalf("standard status field contains %d", list[0].GetStatus())
+	}
+	if status, _ := getUnknownString(list[0].XXX_unrecognized, fieldModuleStatusExtended); status != "THROTTLED" {
+		t.Fatalf("unexpected extended status %q", status)
+	}
+	if reason, _ := getUnknownString(list[0].XXX_unrecognized, fieldModuleStatusReason); reason != l.reason {
+		t.Fatalf("unexpected status reason %q", reason)
+	}
+}
+
+func TestStartModuleRollbackOnAttachError(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	// Limits monitor can't attach to module without lua state
+	if err := mm.startModule("module_a", newTestModuleConfig("module_a", "1.0.0"), &loader.ModuleState{}); err == nil {
+		t.Fatal("module without lua state was started")
+	}
+	if ms, _ := mm.registry.Get("module_a"); ms != nil {
+		t.Fatal("module which failed to start was left in the registry")
+	}
+
+	// Loader of agent can't close loaded module state, so it should be stopped on rollback
+	mm.registry = newRegistry(loader.New())
+	mc := newTestModuleConfig("module_b", "1.0.0")
+	ms, _ := newTestModuleState(t, vxproto.New(mm), mc, "")
+	ms.GetState().L.PushNil()
+	ms.GetState().L.SetGlobal("__api")
+	if err := mm.startModule("module_b", mc, ms); err == nil {
+		t.Fatal("module without API was attached to limits monitor")
+	} else if strings.Contains(err.Error(), "rollback failed") {
+		t.Fatal(err)
+	}
+	if ms, _ := mm.registry.Get("module_b"); ms != nil {
+		t.Fatal("loaded module which failed to start was left in the registry")
+	}
+	if status := ms.GetStatus(); status != agent.ModuleStatus_FREED {
+		t.Fatalf("module state wasn't released: %s", status)
+	}
+}
@@ -0,0 +1,127 @@
+package mmodule
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+// serverMessagesLimit is amount of last messages from server which are kept for control clients
+const serverMessagesLimit = 100
+
+// serverMessageMaxText is maximum size of message text which is logged and kept
+const serverMessageMaxText = 4096
+
+// ControlServerMessage is struct which contains message received from server
+type ControlServerMessage struct {
+	Time time.Time `json:"time"`
+	Src  string    `json:"src"`
+	Type string    `json:"type"`
+	Text string    `json:"text"`
+}
+
+// ControlServerMessages is struct which contains counters and last messages received from server
+// Counts is map of message type to amount of received messages since agent start
+type ControlServerMessages struct {
+	Counts   map[string]uint64      `json:"counts"`
+	Messages []ControlServerMessage `json:"messages"`
+}
+
+// serverMessages is struct which keeps last messages from server except debug ones
+type serverMessages struct {
+	list  []ControlServerMessage
+	mutex *sync.Mutex
+}
+
+// newServerMessages is function which constructed serverMessages object
+func newServerMessages() *serverMessages {
+	return &serverMessages{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// add is function which store message and drop the oldest one over the limit
+func (sm *serverMessages) add(msg ControlServerMessage) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	sm.list = append(sm.list, msg)
+	if len(sm.list) > serverMessagesLimit {
+		sm.list = append([]ControlServerMessage{}, sm.list[len(sm.list)-serverMessagesLimit:]...)
+	}
+}
+
+// get is function which return stored messages of the type, empty type means all messages
+func (sm *serverMessages) get(mtype string) []ControlServerMessage {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	list := []ControlServerMessage{}
+	for _, msg := range sm.list {
+		if mtype == "" || strings.EqualFold(msg.Type, mtype) {
+			list = append(list, msg)
+		}
+	}
+
+	return list
+}
+
+// getMessageText is function which return printable text of server message cut by limit
+func getMessageText(data []byte) string {
+	text := strings.TrimSpace(string(data))
+	if len(text) > serverMessageMaxText {
+		text = text[:serverMessageMaxText] + "..."
+	}
+
+	return text
+}
+
+// routeMsg is function which surface message from server in local logs, metrics and control interface
+func (mm *MainModule) routeMsg(src string, msg *vxproto.Msg) {
+	smsg := ControlServerMessage{
+		Time: time.Now(),
+		Src:  src,
+		Type: msg.MType.String(),
+		Text: getMessageText(msg.Data),
+	}
+	mm.metrics.addServerMessage(smsg.Type)
+
+	logger := logrus.WithFields(logrus.Fields{
+		"module": "main",
+		"src":    src,
+		"text":   smsg.Text,
+	})
+	switch msg.MType {
+	case vxproto.MTDebug:
+		logger.Debug("vxagent: debug message from server")
+		return
+	case vxproto.MTInfo:
+		logger.Info("vxagent: notice from server")
+	case vxproto.MTWarning:
+		logger.Warn("vxagent: warning from server")
+	case vxproto.MTError:
+		logger.Error("vxagent: error from server")
+	default:
+		logger.WithField("msg", int32(msg.MType)).Warn("vxagent: message of unknown type from server")
+	}
+	mm.messages.add(smsg)
+}
+
+// getControlMessages is function which collect counters and stored messages from server
+func (mm *MainModule) getControlMessages(mtype string) *ControlServerMessages {
+	msgs := &ControlServerMessages{
+		Counts:   make(map[string]uint64),
+		Messages: mm.messages.get(mtype),
+	}
+
+	mm.metrics.mutex.Lock()
+	for t, count := range mm.metrics.serverMessages {
+		msgs.Counts[t] = count
+	}
+	mm.metrics.mutex.Unlock()
+
+	return msgs
+}
@@ -0,0 +1,90 @@
+package mmodule
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+func TestRouteServerMessages(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	level := logrus.GetLevel()
+	defer logrus.SetLevel(level)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	tests := []struct {
+		mtype vxproto.MsgType
+		text  string
+		level logrus.Level
+	}{
+		{vxproto.MTDebug, "debug", logrus.DebugLevel},
+		{vxproto.MTInfo, "maintenance at 02:00", logrus.InfoLevel},
+		{vxproto.MTWarning, "certificate expires soon", logrus.WarnLevel},
+		{vxproto.MTError, "agent is blocked", logrus.ErrorLevel},
+		{vxproto.MTError, strings.Repeat("x", serverMessageMaxText+1), logrus.ErrorLevel},
+	}
+	for _, tt := range tests {
+		hook.Reset()
+		mm.recvMsg("server", &vxproto.Msg{MType: tt.mtype, Data: []byte(tt.text)})
+		entry := hook.LastEntry()
+		if entry == nil || entry.Level != tt.level || entry.Data["src"] != "server" {
+			t.Errorf("message %s wasn't logged with level %s: %v", tt.mtype, tt.level, entry)
+		}
+	}
+
+	// Debug messages are counted but they aren't kept for control clients
+	msgs, err := mm.handleControl(ControlRequest{Command: ControlCmdMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := msgs.(*ControlServerMessages)
+	if len(all.Messages) != 4 || all.Messages[0].Text != "maintenance at 02:00" || all.Messages[0].Type != "INFO" {
+		t.Fatalf("unexpected stored messages %+v", all.Messages)
+	}
+	if text := all.Messages[3].Text; len(text) != serverMessageMaxText+3 || !strings.HasSuffix(text, "...") {
+		t.Fatalf("long message wasn't truncated to %d bytes", serverMessageMaxText)
+	}
+	expected := map[string]uint64{"DEBUG": 1, "INFO": 1, "WARNING": 1, "ERROR": 2}
+	for mtype, count := range expected {
+		if all.Counts[mtype] != count {
+			t.Errorf("messages %s were counted %d times instead of %d", mtype, all.Counts[mtype], count)
+		}
+	}
+
+	msgs, err = mm.handleControl(ControlRequest{Command: ControlCmdMessages, Args: map[string]string{"type": "warning"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings := msgs.(*ControlServerMessages).Messages; len(warnings) != 1 || warnings[0].Text != "certificate expires soon" {
+		t.Fatalf("unexpected warnings %+v", warnings)
+	}
+
+	var buf bytes.Buffer
+	mm.metrics.write(&buf, Health{}, nil)
+	if samples := getTestMetrics(t, buf.String()); samples[`vxagent_server_messages_total{type="ERROR"}`] != "2" {
+		t.Fatalf("server messages weren't exposed in metrics: %v", samples)
+	}
+}
+
+func TestServerMessagesLimit(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	for i := 0; i < serverMessagesLimit+10; i++ {
+		mm.routeMsg("server", &vxproto.Msg{MType: vxproto.MTInfo, Data: []byte(strings.Repeat("x", i))})
+	}
+	msgs := mm.getControlMessages("")
+	if len(msgs.Messages) != serverMessagesLimit || len(msgs.Messages[0].Text) != 10 {
+		t.Fatalf("oldest messages weren't dropped: %d", len(msgs.Messages))
+	}
+	if msgs.Counts["INFO"] != serverMessagesLimit+10 {
+		t.Fatalf("unexpected count of messages %d", msgs.Counts["INFO"])
+	}
+}
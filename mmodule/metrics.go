@@ -0,0 +1,368 @@
+package mmodule
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+// commandDurationBuckets is upper bounds of command handling latency histogram in seconds
+var commandDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// commandMetrics is struct which contains handling statistics of one command type
+type commandMetrics struct {
+	count   uint64
+	errors  uint64
+	sum     float64
+	buckets []uint64
+}
+
+// agentMetrics is struct which collects counters of main module for metrics endpoint
+type agentMetrics struct {
+	reconnects        uint64
+	handshakeFailures uint64
+	packets           map[string]uint64
+	sentBytes         map[string]uint64
+	serverMessages    map[string]uint64
+	outbox            map[string]uint64
+	outboundPackets   map[string]uint64
+	outboundBytes     map[string]uint64
+	outboundDropped   map[string]uint64
+	compressedRaw     uint64
+	compressedBytes   uint64
+	heartbeatRTT      time.Duration
+	heartbeatFailures uint64
+	commands          map[string]*commandMetrics
+	mutex             *sync.Mutex
+}
+
+// newMetrics is function which constructed agentMetrics object
+func newMetrics() *agentMetrics {
+	return &agentMetrics{
+		packets:         make(map[string]uint64),
+		sentBytes:       make(map[string]uint64),
+		serverMessages:  make(map[string]uint64),
+		outbox:          make(map[string]uint64),
+		outboundPackets: make(map[string]uint64),
+		outboundBytes:   make(map[string]uint64),
+		outboundDropped: make(map[string]uint64),
+		commands:        make(map[string]*commandMetrics),
+		mutex:           &sync.Mutex{},
+	}
+}
+
+// addReconnect is function which count connection attempt after connection loss or failure
+func (am *agentMetrics) addReconnect() {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.reconnects++
+}
+
+// addHandshakeFailure is function which count failed handshake with server
+func (am *agentMetrics) addHandshakeFailure() {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.handshakeFailures++
+}
+
+// addPacket is function which count received packet by its type
+func (am *agentMetrics) addPacket(ptype string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.packets[ptype]++
+}
+
+// addServerMessage is function which count message received from server by its type
+func (am *agentMetrics) addServerMessage(mtype string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.serverMessages[mtype]++
+}
+
+// addOutboxEvent is function which count module event which was buffered, replayed or dropped by outbox
+func (am *agentMetrics) addOutboxEvent(action string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.outbox[action]++
+}
+
+// addOutboundPacket is function which count packet which was sent to server by its traffic class
+func (am *agentMetrics) addOutboundPacket(class string, size int) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.outboundPackets[class]++
+	am.outboundBytes[class] += uint64(size)
+}
+
+// addOutboundDropped is function which count packet which was dropped because of full queue
+func (am *agentMetrics) addOutboundDropped(class string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.outboundDropped[class]++
+}
+
+// addCompressed is function which count size of payload before and after compression
+func (am *agentMetrics) addCompressed(raw, compressed int) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.compressedRaw += uint64(raw)
+	am.compressedBytes += uint64(compressed)
+}
+
+// setHeartbeatRTT is function which store last measured round-trip time to server
+func (am *agentMetrics) setHeartbeatRTT(rtt time.Duration) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.heartbeatRTT = rtt
+}
+
+// addHeartbeatFailure is function which count connection which was dropped because of missed pongs
+func (am *agentMetrics) addHeartbeatFailure() {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.heartbeatFailures++
+}
+
+// addSentBytes is function which count size of packet which was sent to server
+func (am *agentMetrics) addSentBytes(ptype string, size int) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.sentBytes[ptype] += uint64(size)
+}
+
+// observeCommand is function which count handled command with its latency and result
+func (am *agentMetrics) observeCommand(mtype string, duration time.Duration, err error) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	cm, ok := am.commands[mtype]
+	if !ok {
+		cm = &commandMetrics{buckets: make([]uint64, len(commandDurationBuckets))}
+		am.commands[mtype] = cm
+	}
+	cm.count++
+	if err != nil {
+		cm.errors++
+	}
+	seconds := duration.Seconds()
+	cm.sum += seconds
+	for i, bound := range commandDurationBuckets {
+		if seconds <= bound {
+			cm.buckets[i]++
+		}
+	}
+}
+
+// copyCounters is function which return copy of map of counters
+func copyCounters(values map[string]uint64) map[string]uint64 {
+	result := make(map[string]uint64, len(values))
+	for k, v := range values {
+		result[k] = v
+	}
+
+	return result
+}
+
+// snapshot is function which return copy of all counters, so they can be written without the lock
+func (am *agentMetrics) snapshot() *agentMetrics {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	snap := *am
+	snap.packets = copyCounters(am.packets)
+	snap.sentBytes = copyCounters(am.sentBytes)
+	snap.serverMessages = copyCounters(am.serverMessages)
+	snap.outbox = copyCounters(am.outbox)
+	snap.outboundPackets = copyCounters(am.outboundPackets)
+	snap.outboundBytes = copyCounters(am.outboundBytes)
+	snap.outboundDropped = copyCounters(am.outboundDropped)
+	snap.commands = make(map[string]*commandMetrics, len(am.commands))
+	for mtype, cm := range am.commands {
+		ccm := *cm
+		ccm.buckets = append([]uint64(nil), cm.buckets...)
+		snap.commands[mtype] = &ccm
+	}
+	snap.mutex = nil
+
+	return &snap
+}
+
+// metricsWriter is struct which write metrics in Prometheus text exposition format
+type metricsWriter struct {
+	w io.Writer
+}
+
+// header is function which write help and type lines of metric family
+func (mw metricsWriter) header(name, mtype, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+}
+
+// value is function which write one sample of metric with optional label pairs
+func (mw metricsWriter) value(name string, value interface{}, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], v))
+	}
+	if len(pairs) != 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(mw.w, "%s %v\n", name, value)
+}
+
+// counters is function which write metric family from map of label value to counter
+func (mw metricsWriter) counters(name, help, label string, values map[string]uint64) {
+	mw.header(name, "counter", help)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mw.value(name, values[k], label, k)
+	}
+}
+
+// boolToInt is function which convert flag to gauge value
+func boolToInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// write is function which write all metrics of main module and Go runtime
+// Counters are copied before writing, so slow reader doesn't block their updating
+func (am *agentMetrics) write(w io.Writer, health Health, modules map[string]int) {
+	mw := metricsWriter{w: w}
+	snap := am.snapshot()
+
+	mw.header("vxagent_connected", "gauge", "Whether the agent is connected to server.")
+	mw.value("vxagent_connected", boolToInt(health.Connected))
+	mw.header("vxagent_handshake", "gauge", "Whether the handshake with server was passed on current connection.")
+	mw.value("vxagent_handshake", boolToInt(health.Handshake))
+	mw.header("vxagent_receiver_healthy", "gauge", "Whether the packets receiver of main module is healthy.")
+	mw.value("vxagent_receiver_healthy", boolToInt(health.Receiver))
+
+	mw.header("vxagent_commands_queued", "gauge", "Number of server commands waiting for execution.")
+	mw.value("vxagent_commands_queued", health.QueuedCommands)
+	mw.header("vxagent_commands_in_flight", "gauge", "Number of server commands which are executing now.")
+	mw.value("vxagent_commands_in_flight", health.InFlightCommands)
+	mw.header("vxagent_outbox_events", "gauge", "Number of module events waiting for connection to server.")
+	mw.value("vxagent_outbox_events", health.OutboxEvents)
+	mw.header("vxagent_outbox_bytes", "gauge", "Total size of module events waiting for connection to server.")
+	mw.value("vxagent_outbox_bytes", health.OutboxBytes)
+	mw.header("vxagent_outbound_queued", "gauge", "Number of packets waiting for sending to server by traffic class.")
+	for _, class := range outboundClassNames {
+		mw.value("vxagent_outbound_queued", health.OutboundQueued[class], "class", class)
+	}
+
+	mw.header("vxagent_modules", "gauge", "Number of registered modules by status.")
+	statuses := make([]string, 0, len(modules))
+	for status := range modules {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		mw.value("vxagent_modules", modules[status], "status", status)
+	}
+
+	mw.header("vxagent_reconnects_total", "counter", "Number of reconnections to server.")
+	mw.value("vxagent_reconnects_total", snap.reconnects)
+	mw.header("vxagent_handshake_failures_total", "counter", "Number of failed handshakes with server.")
+	mw.value("vxagent_handshake_failures_total", snap.handshakeFailures)
+	mw.header("vxagent_heartbeat_rtt_seconds", "gauge", "Last measured round-trip time of ping to server.")
+	mw.value("vxagent_heartbeat_rtt_seconds", snap.heartbeatRTT.Seconds())
+	mw.header("vxagent_heartbeat_failures_total", "counter", "Number of connections dropped because server didn't answer pings.")
+	mw.value("vxagent_heartbeat_failures_total", snap.heartbeatFailures)
+	mw.counters("vxagent_packets_received_total", "Number of packets received by main module.", "type", snap.packets)
+	mw.counters("vxagent_sent_bytes_total", "Number of bytes sent to server by main module.", "type", snap.sentBytes)
+	mw.counters("vxagent_server_messages_total", "Number of messages received from server.", "type", snap.serverMessages)
+	mw.counters("vxagent_outbox_events_total", "Number of module events which were buffered, replayed or dropped by outbox.",
+		"action", snap.outbox)
+	mw.header("vxagent_compression_raw_bytes_total", "counter", "Number of payload bytes before compression.")
+	mw.value("vxagent_compression_raw_bytes_total", snap.compressedRaw)
+	mw.header("vxagent_compression_compressed_bytes_total", "counter", "Number of payload bytes after compression.")
+	mw.value("vxagent_compression_compressed_bytes_total", snap.compressedBytes)
+	mw.counters("vxagent_outbound_packets_total", "Number of packets sent to server by traffic class.",
+		"class", snap.outboundPackets)
+	mw.counters("vxagent_outbound_bytes_total", "Number of bytes sent to server by traffic class.",
+		"class", snap.outboundBytes)
+	mw.counters("vxagent_outbound_dropped_total", "Number of packets dropped because of full outbound queue.",
+		"class", snap.outboundDropped)
+
+	mtypes := make([]string, 0, len(snap.commands))
+	for mtype := range snap.commands {
+		mtypes = append(mtypes, mtype)
+	}
+	sort.Strings(mtypes)
+	mw.header("vxagent_commands_total", "counter", "Number of handled commands from server.")
+	for _, mtype := range mtypes {
+		mw.value("vxagent_commands_total", snap.commands[mtype].count, "type", mtype)
+	}
+	mw.header("vxagent_command_errors_total", "counter", "Number of commands from server which were handled with error.")
+	for _, mtype := range mtypes {
+		mw.value("vxagent_command_errors_total", snap.commands[mtype].errors, "type", mtype)
+	}
+	mw.header("vxagent_command_duration_seconds", "histogram", "Latency of commands handling.")
+	for _, mtype := range mtypes {
+		cm := snap.commands[mtype]
+		for i, bound := range commandDurationBuckets {
+			mw.value("vxagent_command_duration_seconds_bucket", cm.buckets[i],
+				"type", mtype, "le", fmt.Sprintf("%g", bound))
+		}
+		mw.value("vxagent_command_duration_seconds_bucket", cm.count, "type", mtype, "le", "+Inf")
+		mw.value("vxagent_command_duration_seconds_sum", cm.sum, "type", mtype)
+		mw.value("vxagent_command_duration_seconds_count", cm.count, "type", mtype)
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	mw.header("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	mw.value("go_goroutines", runtime.NumGoroutine())
+	mw.header("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	mw.value("go_memstats_alloc_bytes", ms.Alloc)
+	mw.header("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	mw.value("go_memstats_heap_inuse_bytes", ms.HeapInuse)
+	mw.header("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.")
+	mw.value("go_memstats_sys_bytes", ms.Sys)
+	mw.header("go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	mw.value("go_gc_cycles_total", ms.NumGC)
+	mw.header("go_gc_pause_seconds_total", "counter", "Total time of GC stop-the-world pauses.")
+	mw.value("go_gc_pause_seconds_total", time.Duration(ms.PauseTotalNs).Seconds())
+	mw.header("process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.")
+	mw.value("process_start_time_seconds", processStartTime.Unix())
+}
+
+// handleMetrics is function which report metrics of agent in Prometheus text format
+func (mm *MainModule) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	modules := make(map[string]int)
+	for _, entry := range mm.registry.Snapshot() {
+		status := entry.Status
+		if lstatus, _, usage := mm.limits.GetStatus(entry.ID); usage != nil && lstatus != agent.ModuleStatus_UNKNOWN {
+			status = lstatus
+		}
+		modules[getModuleStatusName(status)]++
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mm.metrics.write(w, mm.GetHealth(), modules)
+}
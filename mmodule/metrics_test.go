@@ -0,0 +1,143 @@
+package mmodule
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vxcontrol/vxcommon/loader"
+)
+
+// getTestMetrics is function which return samples of metrics text by name with labels
+// and check that each sample follows type line of its family
+func getTestMetrics(t *testing.T, text string) map[string]string {
+	samples := make(map[string]string)
+	families := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			families[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.LastIndex(line, " ")
+		if idx < 0 {
+			t.Fatalf("invalid sample %q", line)
+		}
+		name := line[:idx]
+		family := strings.SplitN(name, "{", 2)[0]
+		if _, ok := families[family]; !ok {
+			base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(family, "_bucket"), "_sum"), "_count")
+			if families[base] != "histogram" {
+				t.Fatalf("sample %q doesn't have type line", line)
+			}
+		}
+		samples[name] = line[idx+1:]
+	}
+	return samples
+}
+
+func TestMetricsCommandsHistogram(t *testing.T) {
+	am := newMetrics()
+	am.observeCommand("GET_STATUS", 20*time.Millisecond, nil)
+	am.observeCommand("GET_STATUS", 2*time.Second, errors.New("failed"))
+	am.observeCommand("GET_STATUS", time.Minute, nil)
+	am.addPacket("Data")
+	am.addPacket("Data")
+	am.addReconnect()
+
+	var buf bytes.Buffer
+	am.write(&buf, Health{Connected: true}, map[string]int{"RUNNING": 2})
+	samples := getTestMetrics(t, buf.String())
+
+	expected := map[string]string{
+		`vxagent_connected`:                                                     "1",
+		`vxagent_reconnects_total`:                                              "1",
+		`vxagent_packets_received_total{type="Data"}`:                           "2",
+		`vxagent_modules{status="RUNNING"}`:                                     "2",
+		`vxagent_commands_total{type="GET_STATUS"}`:                             "3",
+		`vxagent_command_errors_total{type="GET_STATUS"}`:                       "1",
+		`vxagent_command_duration_seconds_bucket{type="GET_STATUS",le="0.01"}`:  "0",
+		`vxagent_command_duration_seconds_bucket{type="GET_STATUS",le="0.025"}`: "1",
+		`vxagent_command_duration_seconds_bucket{type="GET_STATUS",le="2.5"}`:   "2",
+		`vxagent_command_duration_seconds_bucket{type="GET_STATUS",le="30"}`:    "2",
+		`vxagent_command_duration_seconds_bucket{type="GET_STATUS",le="+Inf"}`:  "3",
+		`vxagent_command_duration_seconds_count{type="GET_STATUS"}`:             "3",
+	}
+	for name, value := range expected {
+		if samples[name] != value {
+			t.Errorf("metric %s is %q instead of %q", name, samples[name], value)
+		}
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	metricsWriter{w: &buf}.value("metric", 1, "label", "a\"b\\c\nd")
+	if line := buf.String(); line != `metric{label="a\"b\\c\nd"} 1`+"\n" {
+		t.Fatalf("unexpected sample %q", line)
+	}
+}
+
+func TestHandleMetricsModulesStatus(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	for _, id := range []string{"module_a", "module_b"} {
+		if err := mm.registry.Add(id, newTestModuleConfig(id, "1.0.0"), &loader.ModuleState{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Limited module is counted by its extended status
+	mm.limits.limiters["module_b"] = &moduleLimiter{status: moduleStatusLimited, mutex: &sync.Mutex{}}
+
+	rec := httptest.NewRecorder()
+	mm.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	samples := getTestMetrics(t, rec.Body.String())
+	if samples[`vxagent_modules{status="LIMITED"}`] != "1" || samples[`vxagent_modules{status="UNKNOWN"}`] != "1" {
+		t.Fatalf("unexpected modules metrics %v", samples)
+	}
+}
+
+// testBlockedWriter is writer which blocks until it is released
+type testBlockedWriter struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *testBlockedWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.release
+	return len(p), nil
+}
+
+func TestMetricsWriteDoesNotBlockUpdates(t *testing.T) {
+	am := newMetrics()
+	am.observeCommand("START_MODULES", time.Millisecond, nil)
+	w := &testBlockedWriter{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(w.release)
+	go am.write(w, Health{}, nil)
+	<-w.started
+
+	done := make(chan struct{})
+	go func() {
+		am.addPacket("Data")
+		am.observeCommand("START_MODULES", time.Millisecond, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("metrics updating was blocked by slow reader")
+	}
+}
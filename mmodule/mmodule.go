@@ -1,231 +1,723 @@
-package mmodule
-
-import (
-	"errors"
-	"sync"
-	"time"
-
-	"github.com/sirupsen/logrus"
-	"github.com/vxcontrol/vxcommon/agent"
-	"github.com/vxcontrol/vxcommon/loader"
-	"github.com/vxcontrol/vxcommon/utils"
-	"github.com/vxcontrol/vxcommon/vxproto"
-)
-
-// MainModule is struct which contains full state for agent working
-type MainModule struct {
-	proto            vxproto.IVXProto
-	connectionString string
-	agentID          string
-	modules          map[string]*loader.ModuleConfig
-	loader           loader.ILoader
-	socket           vxproto.IModuleSocket
-	wgReceiver       sync.WaitGroup
-	hasStopped       bool
-	mutexResp        *sync.Mutex
-}
-
-// OnConnect is function that control hanshake on agent
-func (mm *MainModule) OnConnect(socket vxproto.IAgentSocket) (err error) {
-	pubInfo := socket.GetPublicInfo()
-	logrus.WithFields(logrus.Fields{
-		"module": "main",
-		"id":     pubInfo.ID,
-		"type":   pubInfo.Type.String(),
-		"src":    pubInfo.Src,
-		"dst":    pubInfo.Dst,
-	}).Info("vxagent: connect")
-	err = utils.DoHandshakeWithServerOnAgent(socket)
-	if err != nil {
-		logrus.WithError(err).Error("vxagent: connect error")
-	}
-
-	return
-}
-
-// DefaultRecvPacket is function that operate packets as default receiver
-func (mm *MainModule) DefaultRecvPacket(packet *vxproto.Packet) error {
-	logrus.WithFields(logrus.Fields{
-		"module": packet.Module,
-		"type":   packet.PType.String(),
-		"src":    packet.Src,
-		"dst":    packet.Dst,
-	}).Debug("vxagent: default receiver got new packet")
-
-	return nil
-}
-
-// HasAgentIDValid is function that validate AgentID and AngetType in whitelist
-func (mm *MainModule) HasAgentIDValid(agentID string, agentType vxproto.AgentType) bool {
-	// TODO: here need to implement a check function
-	return agentID != ""
-}
-
-// HasAgentInfoValid is function that validate Agent Information in Agent list
-func (mm *MainModule) HasAgentInfoValid(agentID string, info *agent.Information) bool {
-	return true
-}
-
-func (mm *MainModule) recvData(src string, data *vxproto.Data) error {
-	logrus.WithFields(logrus.Fields{
-		"module": "main",
-		"type":   "data",
-		"src":    src,
-		"len":    len(data.Data),
-	}).Debug("vxagent: received data")
-	err := mm.serveData(src, data)
-	logger := logrus.WithFields(logrus.Fields{
-		"module": "main",
-		"type":   "command",
-		"src":    src,
-	})
-	if err != nil {
-		logger.WithError(err).Error("vxagent: failed to exec command")
-	} else {
-		logger.Debug("vxagent: successful exec server command")
-	}
-
-	return nil
-}
-
-func (mm *MainModule) recvFile(src string, file *vxproto.File) error {
-	logrus.WithFields(logrus.Fields{
-		"module": "main",
-		"type":   "file",
-		"name":   file.Name,
-		"path":   file.Path,
-		"uniq":   file.Uniq,
-		"src":    src,
-	}).Debug("vxagent: received file")
-
-	return nil
-}
-
-func (mm *MainModule) recvText(src string, text *vxproto.Text) error {
-	logrus.WithFields(logrus.Fields{
-		"module": "main",
-		"type":   "text",
-		"name":   text.Name,
-		"len":    len(text.Data),
-		"src":    src,
-	}).Debug("vxagent: received text")
-
-	return nil
-}
-
-func (mm *MainModule) recvMsg(src string, msg *vxproto.Msg) error {
-	logrus.WithFields(logrus.Fields{
-		"module": "main",
-		"type":   "msg",
-		"msg":    msg.MType.String(),
-		"len":    len(msg.Data),
-		"src":    src,
-	}).Debug("vxagent: received message")
-
-	return nil
-}
-
-// New is function which constructed MainModule object
-func New(connectionString, agentID string) *MainModule {
-	return &MainModule{
-		connectionString: connectionString,
-		agentID:          agentID,
-		modules:          make(map[string]*loader.ModuleConfig),
-		loader:           loader.New(),
-		mutexResp:        &sync.Mutex{},
-	}
-}
-
-// Start is function which execute main logic of MainModule
-func (mm *MainModule) Start() error {
-	mm.hasStopped = false
-
-	mm.proto = vxproto.New(mm)
-	if mm.proto == nil {
-		return nil
-	}
-
-	mm.socket = mm.proto.NewModule("main", mm.agentID)
-	if mm.socket == nil {
-		return nil
-	}
-
-	if !mm.proto.AddModule(mm.socket) {
-		err := errors.New("failed register socket for main module")
-		logrus.WithError(err).Error("vxagent: add main module failed")
-		return err
-	}
-
-	// Run main handler of packets
-	mm.wgReceiver.Add(1)
-	go mm.recvPacket()
-	logrus.Debug("vxagent: main module was started")
-	defer logrus.Debug("vxagent: main module was stopped")
-
-	config := map[string]string{
-		"id":         mm.agentID,
-		"token":      "",
-		"connection": mm.connectionString,
-	}
-	for {
-		if mm.proto == nil {
-			break
-		}
-		err := mm.proto.Connect(config)
-		if mm.hasStopped {
-			break
-		}
-		logrus.WithError(err).Warn("vxagent: try reconnect")
-		time.Sleep(time.Second * time.Duration(5))
-	}
-	return nil
-}
-
-// Stop is function which stop main logic of MainModule
-func (mm *MainModule) Stop() error {
-	mm.hasStopped = true
-	logrus.Debug("vxagent: trying to stop main module")
-	defer logrus.Info("vxagent: stopping of main module has done")
-
-	if mm.proto == nil {
-		return errors.New("VXProto didn't initialized")
-	}
-	if mm.socket == nil {
-		return errors.New("module socket didn't initialized")
-	}
-
-	if !mm.proto.DelModule(mm.socket) {
-		return errors.New("failed delete module socket")
-	}
-
-	if err := mm.loader.StopAll(); err != nil {
-		return errors.New("modules didn't stop: " + err.Error())
-	}
-
-	for _, id := range mm.loader.List() {
-		if !mm.loader.Del(id) {
-			return errors.New("failed delete module from loader")
-		}
-	}
-
-	receiver := mm.socket.GetReceiver()
-	if receiver != nil {
-		receiver <- &vxproto.Packet{
-			PType: vxproto.PTControl,
-			Payload: &vxproto.ControlMessage{
-				MsgType: vxproto.StopModule,
-			},
-		}
-	}
-	mm.wgReceiver.Wait()
-
-	if err := mm.proto.Close(); err != nil {
-		return err
-	}
-
-	mm.modules = make(map[string]*loader.ModuleConfig)
-	mm.proto = nil
-	mm.socket = nil
-
-	return nil
-}
+package mmodule
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/loader"
+	"github.com/vxcontrol/vxcommon/utils"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+// MainModule is struct which contains full state for agent working
+type MainModule struct {
+	proto            vxproto.IVXProto
+	connectionString string
+	agentID          string
+	dataDir          string
+	store            *moduleStore
+	config           *Config
+	configLoader     func() (*Config, error)
+	restartHandler   func()
+	mutexConfig      *sync.RWMutex
+	limits           *limitsMonitor
+	policy           *policyWatcher
+	registry         *moduleRegistry
+	commands         *commandDispatcher
+	inbox            *fileInbox
+	messages         *serverMessages
+	outbox           *eventOutbox
+	outbound         *outboundSender
+	encodings        *peerFeatures
+	capabilities     *peerFeatures
+	heartbeat        *heartbeatState
+	status           *statusWatcher
+	socket           vxproto.IModuleSocket
+	connections      map[vxproto.IAgentSocket]struct{}
+	wgReceiver       sync.WaitGroup
+	receiver         receiverState
+	liveness         chan struct{}
+	http             *http.Server
+	control          *controlServer
+	metrics          *agentMetrics
+	ctx              context.Context
+	cancel           context.CancelFunc
+	done             chan struct{}
+	wgWorkers        sync.WaitGroup
+	mutexState       *sync.RWMutex
+	mutexLife        *sync.Mutex
+}
+
+// reconnectDelay is period of waiting before next connection attempt to server
+const reconnectDelay = 5 * time.Second
+
+// OnConnect is function that control hanshake on agent
+func (mm *MainModule) OnConnect(socket vxproto.IAgentSocket) (err error) {
+	pubInfo := socket.GetPublicInfo()
+	logrus.WithFields(logrus.Fields{
+		"module": "main",
+		"id":     pubInfo.ID,
+		"type":   pubInfo.Type.String(),
+		"src":    pubInfo.Src,
+		"dst":    pubInfo.Dst,
+	}).Info("vxagent: connect")
+	if err = mm.addConnection(socket); err != nil {
+		return
+	}
+	err = utils.DoHandshakeWithServerOnAgent(socket)
+	if err != nil {
+		logrus.WithError(err).Error("vxagent: connect error")
+		mm.metrics.addHandshakeFailure()
+	}
+	mm.receiver.setHandshake(err == nil)
+
+	return
+}
+
+// DefaultRecvPacket is function that operate packets as default receiver
+func (mm *MainModule) DefaultRecvPacket(packet *vxproto.Packet) error {
+	logrus.WithFields(logrus.Fields{
+		"module": packet.Module,
+		"type":   packet.PType.String(),
+		"src":    packet.Src,
+		"dst":    packet.Dst,
+	}).Debug("vxagent: default receiver got new packet")
+
+	return nil
+}
+
+// HasAgentIDValid is function that validate AgentID and AngetType in whitelist
+func (mm *MainModule) HasAgentIDValid(agentID string, agentType vxproto.AgentType) bool {
+	// TODO: here need to implement a check function
+	return agentID != ""
+}
+
+// HasAgentInfoValid is function that validate Agent Information in Agent list
+func (mm *MainModule) HasAgentInfoValid(agentID string, info *agent.Information) bool {
+	return true
+}
+
+func (mm *MainModule) recvData(src string, data *vxproto.Data) error {
+	logrus.WithFields(logrus.Fields{
+		"module": "main",
+		"type":   "data",
+		"src":    src,
+		"len":    len(data.Data),
+	}).Debug("vxagent: received data")
+
+	var message agent.Message
+	if err := proto.Unmarshal(data.Data, &message); err != nil {
+		err = newCommandError(errCodeBadRequest, "error unmarshal of message: "+err.Error())
+		mm.execData(newRequest(src, "", "UNKNOWN"), nil, err)
+		return nil
+	}
+
+	req := getRequest(src, &message)
+	mm.capabilities.set(src, &message)
+	if err := mm.decodeMessage(src, &message); err != nil {
+		mm.execData(req, nil, err)
+		return nil
+	}
+	if mm.recvHeartbeat(req, &message) {
+		return nil
+	}
+	run := func() {
+		mm.execData(req, &message, nil)
+	}
+	if !mm.commands.Dispatch(getMessageKeys(&message), run) {
+		req.logger.Warn("vxagent: server command was dropped because main module is stopping")
+	}
+
+	return nil
+}
+
+// execData is function which execute server command and report about its failure
+func (mm *MainModule) execData(req *request, message *agent.Message, err error) {
+	if err == nil {
+		err = mm.serveData(req, message)
+	}
+
+	logger := req.logger.WithField("type", "command")
+	if err != nil {
+		logger.WithError(err).Error("vxagent: failed to exec command")
+		mm.sendCommandError(req, err)
+	} else {
+		logger.Debug("vxagent: successful exec server command")
+	}
+}
+
+func (mm *MainModule) recvFile(src string, file *vxproto.File) error {
+	logrus.WithFields(logrus.Fields{
+		"module": "main",
+		"type":   "file",
+		"name":   file.Name,
+		"path":   file.Path,
+		"uniq":   file.Uniq,
+		"src":    src,
+	}).Debug("vxagent: received file")
+
+	// File is handled after its manifest because they share inbox key
+	run := func() {
+		mm.execFile(src, file)
+	}
+	if !mm.commands.Dispatch([]string{inboxKey}, run) {
+		logrus.WithField("module", "main").Warn("vxagent: server file was dropped because main module is stopping")
+	}
+
+	return nil
+}
+
+func (mm *MainModule) recvText(src string, text *vxproto.Text) error {
+	logrus.WithFields(logrus.Fields{
+		"module": "main",
+		"type":   "text",
+		"name":   text.Name,
+		"len":    len(text.Data),
+		"src":    src,
+	}).Debug("vxagent: received text")
+
+	return nil
+}
+
+func (mm *MainModule) recvMsg(src string, msg *vxproto.Msg) error {
+	logrus.WithFields(logrus.Fields{
+		"module": "main",
+		"type":   "msg",
+		"msg":    msg.MType.String(),
+		"len":    len(msg.Data),
+		"src":    src,
+	}).Debug("vxagent: received message")
+	mm.routeMsg(src, msg)
+
+	return nil
+}
+
+// New is function which constructed MainModule object
+func New(connectionString, agentID, dataDir string, config *Config) *MainModule {
+	store, err := newStore(dataDir)
+	if err != nil {
+		logrus.WithError(err).Error("vxagent: failed to initialize modules store")
+		return nil
+	}
+	if removed, err := store.GC(); err != nil {
+		logrus.WithError(err).Warn("vxagent: failed to collect garbage in the store")
+	} else if removed != 0 {
+		logrus.WithField("removed", removed).Info("vxagent: removed unused objects from the store")
+	}
+
+	if config == nil {
+		config = DefaultConfig()
+	}
+	metrics := newMetrics()
+	outbox, err := newOutbox(dataDir, config.Outbox, metrics)
+	if err != nil {
+		logrus.WithError(err).Error("vxagent: failed to initialize events outbox")
+		return nil
+	}
+	if events, _ := outbox.Stats(); events != 0 {
+		logrus.WithField("events", events).Info("vxagent: loaded module events from outbox")
+	}
+
+	mm := &MainModule{
+		connectionString: connectionString,
+		agentID:          agentID,
+		dataDir:          dataDir,
+		store:            store,
+		config:           config,
+		registry:         newRegistry(loader.New()),
+		commands:         newCommandDispatcher(config.Commands.Workers, config.Commands.QueueSize),
+		inbox:            newFileInbox(),
+		messages:         newServerMessages(),
+		outbox:           outbox,
+		outbound:         newOutboundSender(config.Outbound, metrics),
+		encodings:        newPeerFeatures(fieldMessageEncodings),
+		capabilities:     newPeerFeatures(fieldMessageCapabilities),
+		heartbeat:        newHeartbeatState(),
+		status:           newStatusWatcher(),
+		liveness:         make(chan struct{}),
+		metrics:          metrics,
+		ctx:              context.Background(),
+		mutexConfig:      &sync.RWMutex{},
+		connections:      make(map[vxproto.IAgentSocket]struct{}),
+		mutexState:       &sync.RWMutex{},
+		mutexLife:        &sync.Mutex{},
+	}
+	mm.limits = newLimitsMonitor(config.Limits, mm.stopLimitedModule, mm.broadcastStatusModules)
+	mm.policy = newPolicyWatcher(config.GetPolicyPath(dataDir),
+		time.Second*time.Duration(config.Policy.ReloadInterval), mm.enforcePolicy)
+
+	return mm
+}
+
+// GetConfig is function which return current local configuration of the agent
+func (mm *MainModule) GetConfig() *Config {
+	mm.mutexConfig.RLock()
+	defer mm.mutexConfig.RUnlock()
+
+	return mm.config
+}
+
+// getProto is function which return VXProto of running main module or nil
+func (mm *MainModule) getProto() vxproto.IVXProto {
+	mm.mutexState.RLock()
+	defer mm.mutexState.RUnlock()
+
+	return mm.proto
+}
+
+// getSocket is function which return socket of running main module or nil
+func (mm *MainModule) getSocket() vxproto.IModuleSocket {
+	mm.mutexState.RLock()
+	defer mm.mutexState.RUnlock()
+
+	return mm.socket
+}
+
+// getContext is function which return context of main module life
+func (mm *MainModule) getContext() context.Context {
+	mm.mutexState.RLock()
+	defer mm.mutexState.RUnlock()
+
+	return mm.ctx
+}
+
+// getAgentList is function which return list of connected servers or nil if main module isn't started
+func (mm *MainModule) getAgentList() map[string]*vxproto.AgentInfo {
+	if p := mm.getProto(); p != nil {
+		return p.GetAgentList()
+	}
+
+	return nil
+}
+
+// getCapableAgents is function which return connected servers which advertised the capability
+func (mm *MainModule) getCapableAgents(agents map[string]*vxproto.AgentInfo, capability string) []string {
+	var dsts []string
+	for dst := range agents {
+		if mm.capabilities.has(dst, capability) {
+			dsts = append(dsts, dst)
+		}
+	}
+
+	return dsts
+}
+
+// runWorker is function which run background worker of main module until stopping
+// Stop waits all workers, result is false if main module is stopping or isn't started
+func (mm *MainModule) runWorker(worker func(ctx context.Context)) bool {
+	mm.mutexState.RLock()
+	defer mm.mutexState.RUnlock()
+
+	ctx := mm.ctx
+	if mm.socket == nil || ctx.Err() != nil {
+		return false
+	}
+	mm.wgWorkers.Add(1)
+	go func() {
+		defer mm.wgWorkers.Done()
+		worker(ctx)
+	}()
+
+	return true
+}
+
+// setState is function which set VXProto and socket of main module under the state lock
+func (mm *MainModule) setState(p vxproto.IVXProto, socket vxproto.IModuleSocket) {
+	mm.mutexState.Lock()
+	defer mm.mutexState.Unlock()
+
+	mm.proto, mm.socket = p, socket
+}
+
+// addConnection is function which register socket of server connection to close it on stopping
+// VXProto closes sockets only with all its state so main module tracks its connections itself
+func (mm *MainModule) addConnection(socket vxproto.IAgentSocket) error {
+	mm.mutexState.Lock()
+	defer mm.mutexState.Unlock()
+
+	if err := mm.ctx.Err(); err != nil {
+		return errors.New("main module is stopping: " + err.Error())
+	}
+	mm.connections[socket] = struct{}{}
+
+	return nil
+}
+
+// closeConnections is function which close all registered sockets of server connections
+// so the Connect call of VXProto returns, result is amount of the sockets
+func (mm *MainModule) closeConnections() int {
+	mm.mutexState.Lock()
+	defer mm.mutexState.Unlock()
+
+	count := len(mm.connections)
+	for socket := range mm.connections {
+		// The socket may be closed already by VXProto after disconnection
+		socket.Close()
+		delete(mm.connections, socket)
+	}
+
+	return count
+}
+
+// SetConfigLoader is function which set callback to read configuration again on reload request
+func (mm *MainModule) SetConfigLoader(loader func() (*Config, error)) {
+	mm.mutexConfig.Lock()
+	defer mm.mutexConfig.Unlock()
+
+	mm.configLoader = loader
+}
+
+// ReloadConfig is function which read local configuration again and apply it to running agent
+// Result is list of changed sections which will be applied after agent restart only
+func (mm *MainModule) ReloadConfig() ([]string, error) {
+	mm.mutexConfig.RLock()
+	configLoader := mm.configLoader
+	mm.mutexConfig.RUnlock()
+	if configLoader == nil {
+		return nil, errors.New("configuration reloading isn't supported")
+	}
+
+	config, err := configLoader()
+	if err != nil {
+		return nil, errors.New("failed to reload configuration: " + err.Error())
+	}
+
+	mm.mutexConfig.Lock()
+	old := mm.config
+	mm.config = config
+	mm.mutexConfig.Unlock()
+
+	var restart []string
+	if old.HTTP != config.HTTP {
+		restart = append(restart, "http")
+	}
+	if old.Control != config.Control {
+		restart = append(restart, "control")
+	}
+	if old.Commands != config.Commands {
+		restart = append(restart, "commands")
+	}
+
+	mm.limits.SetConfig(config.Limits)
+	mm.outbox.SetConfig(config.Outbox)
+	mm.outbound.SetConfig(config.Outbound)
+	for _, entry := range mm.registry.Snapshot() {
+		mm.limits.SetLimits(entry.ID, entry.Config)
+	}
+	mm.policy.SetConfig(config.GetPolicyPath(mm.dataDir),
+		time.Second*time.Duration(config.Policy.ReloadInterval))
+
+	logger := logrus.WithField("module", "main")
+	if len(restart) != 0 {
+		logger = logger.WithField("restart_required", strings.Join(restart, ", "))
+	}
+	logger.Info("vxagent: configuration was reloaded")
+
+	return restart, nil
+}
+
+// Start is function which execute main logic of MainModule
+// It blocks in reconnection loop until the context will be canceled or Stop will be called
+// The ready channel is closed when main module socket is registered and packets receiver is running,
+// the result is error of initialization or fatal error which is happened after that
+func (mm *MainModule) Start(ctx context.Context, ready chan<- struct{}) error {
+	mm.mutexLife.Lock()
+	if mm.cancel != nil {
+		mm.mutexLife.Unlock()
+		return errors.New("main module already started")
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	mm.mutexState.Lock()
+	mm.ctx = runCtx
+	mm.mutexState.Unlock()
+	mm.cancel = cancel
+	mm.done = make(chan struct{})
+	defer close(mm.done)
+	mm.registry.Open()
+	mm.commands.Open()
+	mm.outbound.Open()
+
+	// fail is function which release initialized resources on starting error
+	var (
+		listener net.Listener
+		p        vxproto.IVXProto
+		socket   vxproto.IModuleSocket
+		added    bool
+	)
+	fail := func(err error) error {
+		if listener != nil {
+			listener.Close()
+		}
+		cancel()
+		mm.commands.Close()
+		mm.outbound.Close()
+		if added {
+			p.DelModule(socket)
+		}
+		if p != nil {
+			if errClose := p.Close(); errClose != nil {
+				logrus.WithError(errClose).Warn("vxagent: failed to close VXProto")
+			}
+		}
+		mm.setState(nil, nil)
+		mm.cancel = nil
+		mm.mutexLife.Unlock()
+		logrus.WithError(err).Error("vxagent: main module starting failed")
+		return err
+	}
+
+	var err error
+	if err = mm.countUpgradeAttempt(); err != nil {
+		return fail(err)
+	}
+	if listener, err = listenHTTP(mm.GetConfig().HTTP.Listen); err != nil {
+		return fail(err)
+	}
+
+	if p = vxproto.New(mm); p == nil {
+		return fail(errors.New("failed to initialize VXProto"))
+	}
+
+	if socket = p.NewModule("main", mm.agentID); socket == nil {
+		return fail(errors.New("failed to initialize main module socket"))
+	}
+
+	if !p.AddModule(socket) {
+		return fail(errors.New("failed register socket for main module"))
+	}
+	added = true
+
+	receiver := socket.GetReceiver()
+	if receiver == nil {
+		return fail(errors.New("failed to initialize packet receiver"))
+	}
+	mm.setState(p, socket)
+
+	// Run main handler of packets
+	fatal := make(chan error, 1)
+	mm.wgReceiver.Add(1)
+	mm.receiver.setRunning(true)
+	go func() {
+		defer mm.wgReceiver.Done()
+		defer mm.receiver.setRunning(false)
+		if err := mm.recvPacket(runCtx, receiver); err != nil {
+			fatal <- err
+		}
+	}()
+	mm.limits.Start()
+	mm.policy.Start()
+	mm.http = mm.serveHTTP(listener)
+	mm.control = mm.serveControl()
+	for _, worker := range []func(context.Context){
+		mm.watchUpgrade,
+		mm.replayOutbox,
+		mm.runHeartbeat,
+		mm.watchStatusModules,
+	} {
+		mm.runWorker(worker)
+	}
+	mm.mutexLife.Unlock()
+	if ready != nil {
+		close(ready)
+	}
+	logrus.Debug("vxagent: main module was started")
+	defer logrus.Debug("vxagent: main module was stopped")
+
+	config := map[string]string{
+		"id":         mm.agentID,
+		"token":      "",
+		"connection": mm.connectionString,
+	}
+	for {
+		// Connect doesn't support cancellation so the connection is closed on stopping
+		// and the loop waits its returning before VXProto will be closed by Stop,
+		// the late connection is rejected by OnConnect
+		errc := make(chan error, 1)
+		go func() {
+			errc <- p.Connect(config)
+		}()
+
+		select {
+		case err := <-errc:
+			mm.closeConnections()
+			if runCtx.Err() != nil {
+				return nil
+			}
+			mm.metrics.addReconnect()
+			logrus.WithError(err).Warn("vxagent: try reconnect")
+		case err := <-fatal:
+			cancel()
+			mm.closeConnections()
+			<-errc
+			return errors.New("packets receiver failed: " + err.Error())
+		case <-runCtx.Done():
+			mm.closeConnections()
+			<-errc
+			return nil
+		}
+
+		select {
+		case <-time.After(reconnectDelay):
+		case err := <-fatal:
+			cancel()
+			return errors.New("packets receiver failed: " + err.Error())
+		case <-runCtx.Done():
+			return nil
+		}
+	}
+}
+
+// stopComponent is function which run stop function of component and wait it until deadline
+// Result is flag that the component stopped in time and error from stop function
+func stopComponent(ctx context.Context, stop func() error) (bool, error) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- stop()
+	}()
+
+	select {
+	case err := <-errc:
+		return true, err
+	case <-ctx.Done():
+		select {
+		case err := <-errc:
+			return true, err
+		default:
+			return false, nil
+		}
+	}
+}
+
+// Stop is function which stop main logic of MainModule
+// The context deadline limits full time of stopping and components which didn't stop
+// in time are abandoned and reported in the result error
+func (mm *MainModule) Stop(ctx context.Context) error {
+	logrus.Debug("vxagent: trying to stop main module")
+	defer logrus.Info("vxagent: stopping of main module has done")
+
+	mm.mutexLife.Lock()
+	defer mm.mutexLife.Unlock()
+
+	if mm.cancel == nil {
+		return errors.New("main module didn't start")
+	}
+	// Abandoned components keep references to proto and socket after returning
+	p, socket := mm.getProto(), mm.getSocket()
+	if p == nil {
+		return errors.New("VXProto didn't initialized")
+	}
+	if socket == nil {
+		return errors.New("module socket didn't initialized")
+	}
+	// Workers are registered under the state lock so none of them is added after waiting
+	mm.mutexState.Lock()
+	mm.cancel()
+	mm.mutexState.Unlock()
+	var errs, timedOut []string
+	components := []struct {
+		name string
+		stop func() error
+	}{
+		{"connection", func() error {
+			<-mm.done
+			return nil
+		}},
+		{"workers", func() error {
+			mm.wgWorkers.Wait()
+			return nil
+		}},
+		{"socket", func() error {
+			if !p.DelModule(socket) {
+				return errors.New("failed delete module socket")
+			}
+			return nil
+		}},
+		{"commands", func() error {
+			if dropped := mm.commands.Close(); dropped != 0 {
+				logrus.WithField("dropped", dropped).Warn("vxagent: pending server commands were dropped")
+			}
+			return nil
+		}},
+		{"policy", func() error {
+			mm.policy.Stop()
+			return nil
+		}},
+		{"limits", func() error {
+			mm.limits.Stop()
+			return nil
+		}},
+		{"modules", func() error {
+			report, err := mm.registry.Close(ctx, mm.GetConfig().GetModuleStopTimeout())
+			logrus.WithFields(logrus.Fields{
+				"module":  "main",
+				"stopped": report.Stopped,
+				"forced":  report.Forced,
+			}).Info("vxagent: modules shutdown report")
+			if len(report.Forced) != 0 {
+				errForced := errors.New("modules were abandoned: " + strings.Join(report.Forced, ", "))
+				if err == nil {
+					err = errForced
+				} else {
+					err = errors.New(err.Error() + " | " + errForced.Error())
+				}
+			}
+			return err
+		}},
+		{"receiver", func() error {
+			mm.wgReceiver.Wait()
+			return nil
+		}},
+		{"outbound", func() error {
+			mm.outbound.Close()
+			return nil
+		}},
+		{"http", func() error {
+			if mm.http == nil {
+				return nil
+			}
+			return mm.http.Shutdown(ctx)
+		}},
+		{"control", func() error {
+			if mm.control == nil {
+				return nil
+			}
+			return mm.control.Close()
+		}},
+		{"proto", func() error {
+			return p.Close()
+		}},
+	}
+	for _, c := range components {
+		logger := logrus.WithField("component", c.name)
+		stopped, err := stopComponent(ctx, c.stop)
+		if !stopped {
+			logger.Warn("vxagent: component didn't stop in time")
+			timedOut = append(timedOut, c.name)
+		} else if err != nil {
+			logger.WithError(err).Error("vxagent: failed to stop component")
+			errs = append(errs, c.name+": "+err.Error())
+		}
+	}
+
+	mm.setState(nil, nil)
+	mm.cancel = nil
+	mm.http = nil
+	mm.control = nil
+
+	if len(timedOut) != 0 {
+		errs = append(errs, "components didn't stop in time: "+strings.Join(timedOut, ", "))
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, " | "))
+	}
+
+	return nil
+}
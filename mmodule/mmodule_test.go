@@ -0,0 +1,257 @@
+package mmodule
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/utils"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+func TestMainModuleStartStopRestart(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	// Nothing listens this port so the connection loop keeps reconnecting
+	mm.connectionString = "ws://127.0.0.1:1"
+
+	for i := 0; i < 2; i++ {
+		ready := make(chan struct{})
+		result := make(chan error, 1)
+		go func() {
+			result <- mm.Start(context.Background(), ready)
+		}()
+		select {
+		case <-ready:
+		case err := <-result:
+			t.Fatalf("main module wasn't started: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("main module wasn't started in time")
+		}
+		if err := mm.Start(context.Background(), nil); err == nil {
+			t.Fatal("main module was started twice")
+		}
+
+		// Readers of connection state run concurrently with stopping
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				mm.broadcastStatusModules()
+				mm.getControlConnection()
+				mm.sendReport("", []byte("{}"))
+				mm.getContext().Err()
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := mm.Stop(ctx)
+		cancel()
+		close(stop)
+		wg.Wait()
+		if err != nil {
+			t.Fatalf("failed to stop main module: %v", err)
+		}
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatalf("main module finished with error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("main module didn't return after stopping")
+		}
+		if mm.getProto() != nil || mm.getSocket() != nil {
+			t.Fatal("connection state wasn't released")
+		}
+	}
+
+	if err := mm.Stop(context.Background()); err == nil {
+		t.Fatal("stopped main module was stopped again")
+	}
+}
+
+// newTestSilentServer is function which create server accepting websocket connections
+// without answering to handshake of the agent
+func newTestSilentServer() (string, func()) {
+	var (
+		conns []net.Conn
+		mutex sync.Mutex
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		mutex.Lock()
+		conns = append(conns, conn)
+		mutex.Unlock()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+		rw.Flush()
+		io.Copy(ioutil.Discard, bufio.NewReader(conn))
+	}))
+
+	return "ws://" + strings.TrimPrefix(server.URL, "http://"), func() {
+		mutex.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mutex.Unlock()
+		server.Close()
+	}
+}
+
+func TestMainModuleStopClosesConnection(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	url, closeServer := newTestSilentServer()
+	defer closeServer()
+	mm.connectionString = url
+
+	ready := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- mm.Start(context.Background(), ready)
+	}()
+	<-ready
+	waitCondition(t, 5*time.Second, "agent didn't connect to server", func() bool {
+		mm.mutexState.RLock()
+		defer mm.mutexState.RUnlock()
+		return len(mm.connections) == 1
+	})
+
+	// Handshake waits server answer without timeout so the connection should be closed by stopping
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mm.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop main module: %v", err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("main module finished with error: %v", err)
+		}
+	default:
+		t.Fatal("main module didn't return after stopping")
+	}
+}
+
+// testServer is main module of server side which accepts agents connections with handshake
+type testServer struct {
+	connects int
+	mutex    sync.Mutex
+}
+
+func (s *testServer) OnConnect(socket vxproto.IAgentSocket) error {
+	if err := utils.DoHandshakeWithAgentOnServer(socket); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connects++
+	return nil
+}
+
+func (s *testServer) getConnects() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.connects
+}
+
+func (s *testServer) DefaultRecvPacket(packet *vxproto.Packet) error                   { return nil }
+func (s *testServer) HasAgentIDValid(agentID string, agentType vxproto.AgentType) bool { return true }
+func (s *testServer) HasAgentInfoValid(agentID string, info *agent.Information) bool   { return true }
+
+// newTestServer is function which run VXProto server on free local port
+func newTestServer(t *testing.T) (*testServer, string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server := &testServer{}
+	p := vxproto.New(server)
+	go p.Listen(map[string]string{"listen": "ws://" + addr})
+	waitCondition(t, 5*time.Second, "test server wasn't started", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+
+	return server, "ws://" + addr, func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.Close()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func TestMainModuleReconnect(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	server, url, closeServer := newTestServer(t)
+	defer closeServer()
+	mm.connectionString = url
+
+	ready := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- mm.Start(context.Background(), ready)
+	}()
+	<-ready
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := mm.Stop(ctx); err != nil {
+			t.Errorf("failed to stop main module: %v", err)
+		}
+	}()
+	waitCondition(t, 5*time.Second, "agent didn't connect to server", func() bool {
+		return len(mm.getAgentList()) == 1 && mm.receiver.isReady()
+	})
+
+	p, socket := mm.getProto(), mm.getSocket()
+	if err := mm.reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	waitCondition(t, reconnectDelay+10*time.Second, "agent didn't reconnect to server", func() bool {
+		return server.getConnects() == 2 && len(mm.getAgentList()) == 1
+	})
+	// Only connection to server was dropped, VXProto and main module socket are the same
+	if mm.getProto() != p || mm.getSocket() != socket {
+		t.Fatal("VXProto was recreated on reconnection")
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("main module finished on reconnection: %v", err)
+	default:
+	}
+}
@@ -1,415 +1,786 @@
-package mmodule
-
-import (
-	"errors"
-
-	"github.com/golang/protobuf/proto"
-	"github.com/sirupsen/logrus"
-	"github.com/vxcontrol/vxcommon/agent"
-	"github.com/vxcontrol/vxcommon/loader"
-	"github.com/vxcontrol/vxcommon/utils"
-	"github.com/vxcontrol/vxcommon/vxproto"
-)
-
-// responseAgent is function which send response to server
-func (mm *MainModule) getStatusModules() *agent.ModuleStatusList {
-	var modulesList agent.ModuleStatusList
-	for _, id := range mm.loader.List() {
-		ms := mm.loader.Get(id)
-		if ms == nil {
-			continue
-		}
-
-		mc, ok := mm.modules[id]
-		if !ok {
-			continue
-		}
-
-		var osList []*agent.Config_OS
-		for osType, archList := range mc.OS {
-			osList = append(osList, &agent.Config_OS{
-				Type: utils.GetRef(osType),
-				Arch: archList,
-			})
-		}
-		config := &agent.Config{
-			Os:         osList,
-			AgentId:    utils.GetRef(mc.AgentID),
-			Name:       utils.GetRef(mc.Name),
-			Version:    utils.GetRef(mc.Version),
-			Events:     mc.Events,
-			LastUpdate: utils.GetRef(mc.LastUpdate),
-		}
-
-		iconfig := &agent.ConfigItem{
-			ConfigSchema:       utils.GetRef(mc.GetConfigSchema()),
-			DefaultConfig:      utils.GetRef(mc.GetDefaultConfig()),
-			CurrentConfig:      utils.GetRef(mc.GetCurrentConfig()),
-			EventDataSchema:    utils.GetRef(mc.GetEventDataSchema()),
-			EventConfigSchema:  utils.GetRef(mc.GetEventConfigSchema()),
-			DefaultEventConfig: utils.GetRef(mc.GetDefaultEventConfig()),
-			CurrentEventConfig: utils.GetRef(mc.GetCurrentEventConfig()),
-		}
-
-		moduleStatus := &agent.ModuleStatus{
-			Name:       utils.GetRef(mc.Name),
-			Config:     config,
-			ConfigItem: iconfig,
-			Status:     ms.GetStatus().Enum(),
-		}
-		modulesList.List = append(modulesList.List, moduleStatus)
-	}
-
-	return &modulesList
-}
-
-func (mm *MainModule) getModuleConfig(m *agent.Module) *loader.ModuleConfig {
-	mci := &loader.ModuleConfigItem{
-		ConfigSchema:       m.GetConfigItem().GetConfigSchema(),
-		CurrentConfig:      m.GetConfigItem().GetCurrentConfig(),
-		DefaultConfig:      m.GetConfigItem().GetDefaultConfig(),
-		EventDataSchema:    m.GetConfigItem().GetEventDataSchema(),
-		EventConfigSchema:  m.GetConfigItem().GetEventConfigSchema(),
-		DefaultEventConfig: m.GetConfigItem().GetDefaultEventConfig(),
-		CurrentEventConfig: m.GetConfigItem().GetCurrentEventConfig(),
-	}
-
-	osMap := make(map[string][]string)
-	for _, os := range m.GetConfig().GetOs() {
-		osMap[os.GetType()] = os.GetArch()
-	}
-	mc := &loader.ModuleConfig{
-		OS:          osMap,
-		AgentID:     m.GetConfig().GetAgentId(),
-		Name:        m.GetConfig().GetName(),
-		Version:     m.GetConfig().GetVersion(),
-		Events:      m.GetConfig().GetEvents(),
-		LastUpdate:  m.GetConfig().GetLastUpdate(),
-		IConfigItem: mci,
-	}
-
-	return mc
-}
-
-func (mm *MainModule) getModuleItem(m *agent.Module) *loader.ModuleItem {
-	mi := loader.NewItem()
-
-	mf := make(map[string][]byte)
-	for _, f := range m.GetFiles() {
-		mf[f.GetPath()] = f.GetData()
-	}
-	mi.SetFiles(mf)
-
-	ma := make(map[string][]string)
-	for _, a := range m.GetArgs() {
-		ma[a.GetKey()] = a.GetValue()
-	}
-	mi.SetArgs(ma)
-
-	return mi
-}
-
-// responseAgent is function which send response to server
-func (mm *MainModule) responseAgent(dst string, msgType agent.Message_Type, payload []byte) error {
-	mm.mutexResp.Lock()
-	defer mm.mutexResp.Unlock()
-
-	if mm.socket == nil {
-		return errors.New("module Socket didn't initialize")
-	}
-
-	messageData, err := proto.Marshal(&agent.Message{
-		Type:    msgType.Enum(),
-		Payload: payload,
-	})
-	if err != nil {
-		return errors.New("error marshal request packet: " + err.Error())
-	}
-
-	data := &vxproto.Data{
-		Data: messageData,
-	}
-	if err = mm.socket.SendDataTo(dst, data); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (mm *MainModule) sendInformation(dst string) error {
-	infoMessageData, err := proto.Marshal(utils.GetAgentInformation())
-	if err != nil {
-		return err
-	}
-
-	return mm.responseAgent(dst, agent.Message_INFORMATION_RESULT, infoMessageData)
-}
-
-func (mm *MainModule) sendStatusModules(dst string) error {
-	statusModulesData, err := proto.Marshal(mm.getStatusModules())
-	if err != nil {
-		return err
-	}
-
-	return mm.responseAgent(dst, agent.Message_STATUS_MODULES_RESULT, statusModulesData)
-}
-
-func (mm *MainModule) serveStartModules(dst string, data []byte) (err error) {
-	defer func() {
-		if errSend := mm.sendStatusModules(dst); errSend != nil {
-			if err == nil {
-				err = errSend
-			} else {
-				err = errors.New(err.Error() + " | " + errSend.Error())
-			}
-		}
-	}()
-
-	var moduleList agent.ModuleList
-	if err = proto.Unmarshal(data, &moduleList); err != nil {
-		err = errors.New("error unmarshal of modules information: " + err.Error())
-		return
-	}
-
-	for _, m := range moduleList.GetList() {
-		var s *loader.ModuleState
-		id := m.GetName()
-		mc := mm.getModuleConfig(m)
-		mi := mm.getModuleItem(m)
-		s, err = loader.NewState(mc, mi, mm.proto)
-		if err != nil {
-			return
-		}
-
-		if mm.loader.Get(id) != nil {
-			err = errors.New("module " + id + " already exists")
-			return
-		}
-
-		if !mm.loader.Add(id, s) {
-			err = errors.New("failed add module " + id + " to loader")
-			return
-		}
-
-		if err = mm.loader.Start(id); err != nil {
-			return
-		}
-
-		mm.modules[id] = mc
-	}
-
-	return
-}
-
-func (mm *MainModule) serveStopModules(dst string, data []byte) (err error) {
-	defer func() {
-		if errSend := mm.sendStatusModules(dst); errSend != nil {
-			if err == nil {
-				err = errSend
-			} else {
-				err = errors.New(err.Error() + " | " + errSend.Error())
-			}
-		}
-	}()
-
-	var moduleList agent.ModuleList
-	if err = proto.Unmarshal(data, &moduleList); err != nil {
-		err = errors.New("error unmarshal of modules information: " + err.Error())
-		return
-	}
-
-	for _, m := range moduleList.GetList() {
-		id := m.GetName()
-		if mm.loader.Get(id) == nil {
-			err = errors.New("module " + id + " not found")
-			return
-		}
-
-		if err = mm.loader.Stop(id); err != nil {
-			return
-		}
-
-		if !mm.loader.Del(id) {
-			err = errors.New("failed delete module " + id + " from loader")
-			return
-		}
-
-		delete(mm.modules, id)
-	}
-
-	return
-}
-
-func (mm *MainModule) serveUpdateModules(dst string, data []byte) (err error) {
-	defer func() {
-		if errSend := mm.sendStatusModules(dst); errSend != nil {
-			if err == nil {
-				err = errSend
-			} else {
-				err = errors.New(err.Error() + " | " + errSend.Error())
-			}
-		}
-	}()
-
-	var moduleList agent.ModuleList
-	if err = proto.Unmarshal(data, &moduleList); err != nil {
-		err = errors.New("error unmarshal of modules information: " + err.Error())
-		return
-	}
-
-	for _, m := range moduleList.GetList() {
-		id := m.GetName()
-		if mm.loader.Get(id) == nil {
-			err = errors.New("module " + id + " not found")
-			return
-		}
-
-		if err = mm.loader.Stop(id); err != nil {
-			return
-		}
-
-		if !mm.loader.Del(id) {
-			err = errors.New("failed delete module " + id + " from loader")
-			return
-		}
-
-		var s *loader.ModuleState
-		mc := mm.getModuleConfig(m)
-		mi := mm.getModuleItem(m)
-		s, err = loader.NewState(mc, mi, mm.proto)
-		if err != nil {
-			return
-		}
-
-		if !mm.loader.Add(id, s) {
-			err = errors.New("failed add module " + id + " to loader")
-			return
-		}
-
-		if err = mm.loader.Start(id); err != nil {
-			return
-		}
-
-		mm.modules[id] = mc
-	}
-
-	return
-}
-
-func (mm *MainModule) serveUpdateConfigModules(dst string, data []byte) (err error) {
-	defer func() {
-		if errSend := mm.sendStatusModules(dst); errSend != nil {
-			if err == nil {
-				err = errSend
-			} else {
-				err = errors.New(err.Error() + " | " + errSend.Error())
-			}
-		}
-	}()
-
-	var moduleList agent.ModuleList
-	if err = proto.Unmarshal(data, &moduleList); err != nil {
-		err = errors.New("error unmarshal of modules information: " + err.Error())
-		return
-	}
-
-	for _, m := range moduleList.GetList() {
-		id := m.GetName()
-		mc := mm.getModuleConfig(m)
-		ms := mm.loader.Get(id)
-		if ms == nil {
-			err = errors.New("module " + id + " not found")
-			return
-		}
-
-		if romc, ok := mm.modules[id]; ok {
-			omc := romc.IConfigItem.(*loader.ModuleConfigItem)
-			omc.ConfigSchema = mc.GetConfigSchema()
-			omc.DefaultConfig = mc.GetDefaultConfig()
-			omc.CurrentConfig = mc.GetCurrentConfig()
-			omc.EventDataSchema = mc.GetEventDataSchema()
-			omc.EventConfigSchema = mc.GetEventConfigSchema()
-			omc.DefaultEventConfig = mc.GetDefaultEventConfig()
-			omc.CurrentEventConfig = mc.GetCurrentEventConfig()
-		}
-
-		mm.modules[id] = mc
-		ms.GetModule().ControlMsg("update_config", mc.GetCurrentConfig())
-	}
-
-	return
-}
-
-func (mm *MainModule) serveData(src string, data *vxproto.Data) error {
-	var message agent.Message
-	if err := proto.Unmarshal(data.Data, &message); err != nil {
-		return err
-	}
-
-	switch message.GetType() {
-	case agent.Message_GET_INFORMATION:
-		return mm.sendInformation(src)
-	case agent.Message_GET_STATUS_MODULES:
-		return mm.sendStatusModules(src)
-	case agent.Message_START_MODULES:
-		return mm.serveStartModules(src, message.Payload)
-	case agent.Message_STOP_MODULES:
-		return mm.serveStopModules(src, message.Payload)
-	case agent.Message_UPDATE_MODULES:
-		return mm.serveUpdateModules(src, message.Payload)
-	case agent.Message_UPDATE_CONFIG_MODULES:
-		return mm.serveUpdateConfigModules(src, message.Payload)
-	default:
-		return errors.New("received unknown message type")
-	}
-}
-
-func (mm *MainModule) recvPacket() error {
-	defer mm.wgReceiver.Done()
-
-	receiver := mm.socket.GetReceiver()
-	if receiver == nil {
-		logrus.Error("vxagent: failed to initialize packet receiver")
-		return errors.New("failed to initialize packet receiver")
-	}
-	getAgentEntry := func(agentInfo *vxproto.AgentInfo) *logrus.Entry {
-		return logrus.WithFields(logrus.Fields{
-			"id":   agentInfo.ID,
-			"type": agentInfo.Type.String(),
-			"ip":   agentInfo.IP,
-			"src":  agentInfo.Src,
-			"dst":  agentInfo.Dst,
-		})
-	}
-	for {
-		packet := <-receiver
-		if packet == nil {
-			logrus.Error("vxagent: failed receive packet")
-			return errors.New("failed receive packet")
-		}
-		switch packet.PType {
-		case vxproto.PTData:
-			mm.recvData(packet.Src, packet.GetData())
-		case vxproto.PTFile:
-			mm.recvFile(packet.Src, packet.GetFile())
-		case vxproto.PTText:
-			mm.recvText(packet.Src, packet.GetText())
-		case vxproto.PTMsg:
-			mm.recvMsg(packet.Src, packet.GetMsg())
-		case vxproto.PTControl:
-			msg := packet.GetControlMsg()
-			switch msg.MsgType {
-			case vxproto.AgentConnected:
-				getAgentEntry(msg.AgentInfo).Info("vxagent: agent connected")
-			case vxproto.AgentDisconnected:
-				getAgentEntry(msg.AgentInfo).Info("vxagent: agent disconnected")
-			case vxproto.StopModule:
-				logrus.Info("vxagent: got signal to stop main module")
-				return nil
-			}
-		default:
-			logrus.Error("vxagent: got packet has unexpected packet type")
-			return errors.New("unexpected packet type")
-		}
-	}
-}
+package mmodule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/loader"
+	"github.com/vxcontrol/vxcommon/utils"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+// responseAgent is function which send response to server
+func (mm *MainModule) getStatusModules() *agent.ModuleStatusList {
+	var modulesList agent.ModuleStatusList
+	for _, entry := range mm.registry.Snapshot() {
+		id, mc := entry.ID, entry.Config
+		var osList []*agent.Config_OS
+		for osType, archList := range mc.OS {
+			osList = append(osList, &agent.Config_OS{
+				Type: utils.GetRef(osType),
+				Arch: archList,
+			})
+		}
+		config := &agent.Config{
+			Os:         osList,
+			AgentId:    utils.GetRef(mc.AgentID),
+			Name:       utils.GetRef(mc.Name),
+			Version:    utils.GetRef(mc.Version),
+			Events:     mc.Events,
+			LastUpdate: utils.GetRef(mc.LastUpdate),
+		}
+
+		iconfig := &agent.ConfigItem{
+			ConfigSchema:       utils.GetRef(mc.GetConfigSchema()),
+			DefaultConfig:      utils.GetRef(mc.GetDefaultConfig()),
+			CurrentConfig:      utils.GetRef(mc.GetCurrentConfig()),
+			EventDataSchema:    utils.GetRef(mc.GetEventDataSchema()),
+			EventConfigSchema:  utils.GetRef(mc.GetEventConfigSchema()),
+			DefaultEventConfig: utils.GetRef(mc.GetDefaultEventConfig()),
+			CurrentEventConfig: utils.GetRef(mc.GetCurrentEventConfig()),
+		}
+
+		moduleStatus := &agent.ModuleStatus{
+			Name:       utils.GetRef(mc.Name),
+			Config:     config,
+			ConfigItem: iconfig,
+			Status:     entry.Status.Enum(),
+		}
+		if status, reason, usage := mm.limits.GetStatus(id); usage != nil {
+			if status != agent.ModuleStatus_UNKNOWN {
+				moduleStatus.XXX_unrecognized = appendUnknownString(
+					moduleStatus.XXX_unrecognized, fieldModuleStatusExtended, getModuleStatusName(status))
+				moduleStatus.XXX_unrecognized = appendUnknownString(
+					moduleStatus.XXX_unrecognized, fieldModuleStatusReason, reason)
+			}
+			if data, err := json.Marshal(usage); err == nil {
+				moduleStatus.XXX_unrecognized = appendUnknownString(
+					moduleStatus.XXX_unrecognized, fieldModuleStatusUsage, string(data))
+			}
+		}
+		modulesList.List = append(modulesList.List, moduleStatus)
+	}
+
+	return &modulesList
+}
+
+func (mm *MainModule) getModuleConfig(m *agent.Module) *loader.ModuleConfig {
+	mci := newModuleConfigItem(loader.ModuleConfigItem{
+		ConfigSchema:       m.GetConfigItem().GetConfigSchema(),
+		CurrentConfig:      m.GetConfigItem().GetCurrentConfig(),
+		DefaultConfig:      m.GetConfigItem().GetDefaultConfig(),
+		EventDataSchema:    m.GetConfigItem().GetEventDataSchema(),
+		EventConfigSchema:  m.GetConfigItem().GetEventConfigSchema(),
+		DefaultEventConfig: m.GetConfigItem().GetDefaultEventConfig(),
+		CurrentEventConfig: m.GetConfigItem().GetCurrentEventConfig(),
+	})
+
+	osMap := make(map[string][]string)
+	for _, os := range m.GetConfig().GetOs() {
+		osMap[os.GetType()] = os.GetArch()
+	}
+	mc := &loader.ModuleConfig{
+		OS:          osMap,
+		AgentID:     m.GetConfig().GetAgentId(),
+		Name:        m.GetConfig().GetName(),
+		Version:     m.GetConfig().GetVersion(),
+		Events:      m.GetConfig().GetEvents(),
+		LastUpdate:  m.GetConfig().GetLastUpdate(),
+		IConfigItem: mci,
+	}
+
+	return mc
+}
+
+func (mm *MainModule) getModuleItem(m *agent.Module) (*loader.ModuleItem, error) {
+	mi := loader.NewItem()
+
+	mf := make(map[string][]byte)
+	for _, f := range m.GetFiles() {
+		mf[f.GetPath()] = f.GetData()
+	}
+	// Server may omit files for module version which was already cached
+	if len(mf) == 0 {
+		var err error
+		name, version := m.GetName(), m.GetConfig().GetVersion()
+		if mf, err = mm.store.GetModule(name, version); err != nil {
+			return nil, errors.New("failed to load module files from the store: " + err.Error())
+		}
+	} else {
+		if err := mm.store.AddModule(m.GetName(), m.GetConfig().GetVersion(), mf); err != nil {
+			return nil, errors.New("failed to save module files to the store: " + err.Error())
+		}
+		mm.collectStoreGarbage(logrus.WithField("name", m.GetName()))
+	}
+	mi.SetFiles(mf)
+
+	// Force flag is interpreted by the agent only and isn't passed to the module
+	args := getModuleArgs(m)
+	delete(args, moduleForceArg)
+	mi.SetArgs(args)
+
+	return mi, nil
+}
+
+// releaseModuleFiles is function which drop module version from the store and collect garbage
+func (mm *MainModule) releaseModuleFiles(req *request, mc *loader.ModuleConfig) {
+	logger := req.logger.WithFields(logrus.Fields{
+		"name":    mc.Name,
+		"version": mc.Version,
+	})
+	if err := mm.store.DelModule(mc.Name, mc.Version); err != nil {
+		logger.WithError(err).Warn("vxagent: failed to release module files in the store")
+		return
+	}
+	mm.collectStoreGarbage(logger)
+}
+
+// collectStoreGarbage is function which remove objects of released module versions from the store
+func (mm *MainModule) collectStoreGarbage(logger *logrus.Entry) {
+	if removed, err := mm.store.GC(); err != nil {
+		logger.WithError(err).Warn("vxagent: failed to collect garbage in the store")
+	} else if removed != 0 {
+		logger.WithField("removed", removed).Debug("vxagent: removed unused objects from the store")
+	}
+}
+
+// responseAgent is function which send response to server with correlation ID of the request
+// Modules status is sent with lower priority than other responses
+func (mm *MainModule) responseAgent(req *request, msgType agent.Message_Type, payload []byte) error {
+	socket := mm.getSocket()
+	if socket == nil {
+		return errors.New("module Socket didn't initialize")
+	}
+
+	message := req.newMessage(msgType, payload)
+	message.XXX_unrecognized = appendUnknownString(message.XXX_unrecognized,
+		fieldMessageCapabilities, strings.Join(supportedCapabilities, ","))
+	mm.encodeMessage(req.src, message)
+	messageData, err := proto.Marshal(message)
+	if err != nil {
+		return errors.New("error marshal request packet: " + err.Error())
+	}
+
+	data := &vxproto.Data{
+		Data: messageData,
+	}
+	class := outboundControl
+	if msgType == agent.Message_STATUS_MODULES_RESULT || msgType == messageStatusModulesChanged {
+		class = outboundStatus
+	}
+	err = mm.outbound.Send(class, len(messageData), func() error {
+		return socket.SendDataTo(req.src, data)
+	})
+	if err != nil {
+		return err
+	}
+	mm.metrics.addSentBytes(vxproto.PTData.String(), len(messageData))
+
+	return nil
+}
+
+func (mm *MainModule) sendInformation(req *request) error {
+	infoMessageData, err := proto.Marshal(utils.GetAgentInformation())
+	if err != nil {
+		return err
+	}
+
+	return mm.responseAgent(req, agent.Message_INFORMATION_RESULT, infoMessageData)
+}
+
+func (mm *MainModule) sendStatusModules(req *request) error {
+	list := mm.getStatusModules()
+	statusModulesData, err := proto.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	if err = mm.responseAgent(req, agent.Message_STATUS_MODULES_RESULT, statusModulesData); err != nil {
+		return err
+	}
+	mm.status.seen(req.src, list)
+
+	return nil
+}
+
+// broadcastStatusModules is function which send modules status to all connected servers
+func (mm *MainModule) broadcastStatusModules() {
+	for dst := range mm.getAgentList() {
+		if err := mm.sendStatusModules(newRequest(dst, "", "")); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"module": "main",
+				"dst":    dst,
+			}).Warn("vxagent: failed to send modules status")
+		}
+	}
+}
+
+// stopLimitedModule is function which stop module after limits violation
+// and report the reason to all connected servers
+// The module leaves in the loader to report its status to the server
+func (mm *MainModule) stopLimitedModule(id, reason string) error {
+	mc := mm.registry.GetConfig(id)
+	if mc == nil {
+		return errors.New("module " + id + " not found")
+	}
+	if err := mm.registry.Stop(id); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&moduleReport{
+		Type:   reportModuleLimited,
+		Module: policyModule{Name: mc.Name, Version: mc.Version},
+		Reason: reason,
+	})
+	if err != nil {
+		return nil
+	}
+	if err = mm.sendReport("", data); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"module": "main",
+			"name":   id,
+			"reason": reason,
+		}).WithError(err).Warn("vxagent: failed to send limited module report")
+	}
+
+	return nil
+}
+
+// stopModule is function which stop module and remove it from the registry
+// Result is config of removed module
+func (mm *MainModule) stopModule(id string) (*loader.ModuleConfig, error) {
+	if ms, _ := mm.registry.Get(id); ms == nil {
+		return nil, newCommandError(errCodeNotFound, "module "+id+" not found")
+	}
+
+	mm.limits.Detach(id)
+	if err := mm.registry.Stop(id); err != nil {
+		return nil, err
+	}
+
+	return mm.registry.Del(id)
+}
+
+// startModule is function which add module state to the registry and run it
+func (mm *MainModule) startModule(id string, mc *loader.ModuleConfig, s *loader.ModuleState) error {
+	if err := mm.registry.Add(id, mc, s); err != nil {
+		return err
+	}
+
+	if err := mm.limits.Attach(id, mc, s); err != nil {
+		if _, errDel := mm.registry.Del(id); errDel != nil {
+			logrus.WithFields(logrus.Fields{
+				"module": "main",
+				"name":   id,
+			}).WithError(errDel).Error("vxagent: failed to remove module which wasn't attached to limits monitor")
+			return errors.New(err.Error() + ", rollback failed: " + errDel.Error())
+		}
+		return err
+	}
+
+	if err := mm.registry.Start(id); err != nil {
+		return err
+	}
+	if err := mm.store.SetVersion(mc.Name, mc.Version); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"module":  "main",
+			"name":    mc.Name,
+			"version": mc.Version,
+		}).WithError(err).Warn("vxagent: failed to store accepted module version")
+	}
+
+	return nil
+}
+
+// sendModuleReport is function which report to server about module rejected by agent
+func (mm *MainModule) sendModuleReport(req *request, rtype string, pm policyModule, reason error) {
+	logger := req.logger.WithFields(logrus.Fields{
+		"report":    rtype,
+		"name":      pm.Name,
+		"version":   pm.Version,
+		"publisher": pm.Publisher,
+	})
+	logger.WithError(reason).Warn("vxagent: module was rejected")
+
+	data, err := json.Marshal(&moduleReport{
+		Type:      rtype,
+		Command:   req.command,
+		RequestID: req.id,
+		Module:    pm,
+		Reason:    reason.Error(),
+	})
+	if err != nil {
+		return
+	}
+
+	if err = mm.sendReport(req.src, data); err != nil {
+		logger.WithError(err).Error("vxagent: failed to send module report")
+	}
+}
+
+// sendCommandError is function which report to server about failed command
+// so the server gets definite answer for each request
+func (mm *MainModule) sendCommandError(req *request, reason error) {
+	cerr := getCommandError(reason)
+	logger := req.logger.WithFields(logrus.Fields{
+		"report": reportCommandError,
+		"code":   cerr.Code,
+	})
+
+	data, err := json.Marshal(&commandReport{
+		Type:      reportCommandError,
+		Command:   req.command,
+		RequestID: req.id,
+		Code:      cerr.Code,
+		Message:   cerr.Message,
+		Modules:   cerr.Modules,
+	})
+	if err != nil {
+		return
+	}
+
+	if err = mm.sendReport(req.src, data); err != nil {
+		logger.WithError(err).Error("vxagent: failed to send command error")
+	}
+}
+
+// sendReport is function which send report as Msg packet of ERROR type
+// Empty dst means that the report will be sent to all connected servers
+func (mm *MainModule) sendReport(dst string, data []byte) error {
+	socket := mm.getSocket()
+	if socket == nil {
+		return errors.New("module Socket didn't initialize")
+	}
+
+	var dsts []string
+	if dst != "" {
+		dsts = append(dsts, dst)
+	} else {
+		for dst := range mm.getAgentList() {
+			dsts = append(dsts, dst)
+		}
+	}
+
+	var errs []string
+	for _, dst := range dsts {
+		msg := &vxproto.Msg{
+			Data:  data,
+			MType: vxproto.MTError,
+		}
+		err := mm.outbound.Send(outboundControl, len(data), func() error {
+			return socket.SendMsgTo(dst, msg)
+		})
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		mm.metrics.addSentBytes(vxproto.PTMsg.String(), len(data))
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, " | "))
+	}
+
+	return nil
+}
+
+// enforcePolicy is function which stop running modules that are denied by new policy
+func (mm *MainModule) enforcePolicy(policy *Policy) {
+	req := newRequest("", "", "POLICY_RELOAD")
+	var changed bool
+	for _, entry := range mm.registry.Snapshot() {
+		id, mc, ms := entry.ID, entry.Config, entry.State
+		if entry.Status != agent.ModuleStatus_RUNNING {
+			continue
+		}
+
+		item := ms.GetItem()
+		pm := newPolicyModule(mc.Name, mc.Version, item.GetArgs(), getFilesManifest(item.GetFiles()))
+		if reason := policy.Check(pm); reason != nil {
+			mm.sendModuleReport(req, reportPolicyViolation, pm, reason)
+			if err := mm.registry.Stop(id); err != nil {
+				logrus.WithError(err).WithField("name", id).Error("vxagent: failed to stop denied module")
+			}
+			changed = true
+		}
+	}
+
+	if changed {
+		mm.broadcastStatusModules()
+	}
+}
+
+// checkPolicy is function which filter modules list by local policy and report violations
+func (mm *MainModule) checkPolicy(req *request, list []*agent.Module) ([]*agent.Module, error) {
+	var denied []string
+	var details []moduleError
+	var allowed []*agent.Module
+	for _, m := range list {
+		pm := mm.getPolicyModule(m)
+		if reason := mm.policy.Check(pm); reason != nil {
+			mm.sendModuleReport(req, reportPolicyViolation, pm, reason)
+			denied = append(denied, pm.Name)
+			details = append(details, moduleError{
+				Name:    pm.Name,
+				Code:    errCodePolicyDenied,
+				Message: reason.Error(),
+			})
+			continue
+		}
+		allowed = append(allowed, m)
+	}
+
+	if len(denied) != 0 {
+		return allowed, &commandError{
+			Code:    errCodePolicyDenied,
+			Message: "modules denied by local policy: " + strings.Join(denied, ", "),
+			Modules: details,
+		}
+	}
+
+	return allowed, nil
+}
+
+// checkVersion is function which check new module version by local minimal version
+// and current or last accepted version to prevent downgrade without force flag
+func (mm *MainModule) checkVersion(m *agent.Module) error {
+	id, version := m.GetName(), m.GetConfig().GetVersion()
+	if min, ok := mm.GetConfig().Versions.Min[id]; ok {
+		if c, err := compareVersions(version, min); err != nil {
+			return newCommandError(errCodeBadRequest, "failed to check minimal version: "+err.Error())
+		} else if c < 0 {
+			return newCommandError(errCodePolicyDenied, "version "+version+" is less than minimal allowed "+min)
+		}
+	}
+
+	if hasModuleForceFlag(m) {
+		return nil
+	}
+	// Last accepted version is kept by the store when module was stopped or agent was restarted
+	current := []string{mm.store.GetVersion(id)}
+	if mc := mm.registry.GetConfig(id); mc != nil {
+		current = append(current, mc.Version)
+	}
+	for _, cv := range current {
+		if _, err := parseVersion(cv); err != nil {
+			// Current version can't be compared so it doesn't protect from downgrade
+			continue
+		}
+		if c, err := compareVersions(version, cv); err != nil {
+			return newCommandError(errCodeBadRequest, "failed to compare with current version: "+err.Error())
+		} else if c < 0 {
+			return newCommandError(errCodeConflict, "downgrade from "+cv+" to "+version+" requires force flag")
+		}
+	}
+
+	return nil
+}
+
+// hasModuleForceFlag is function which check that server forced module loading
+func hasModuleForceFlag(m *agent.Module) bool {
+	for _, a := range m.GetArgs() {
+		if a.GetKey() == moduleForceArg {
+			for _, v := range a.GetValue() {
+				if v == "true" {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// checkVersions is function which filter modules list by versions restrictions and report rejections
+func (mm *MainModule) checkVersions(req *request, list []*agent.Module) ([]*agent.Module, error) {
+	var rejected []string
+	var details []moduleError
+	var allowed []*agent.Module
+	for _, m := range list {
+		if reason := mm.checkVersion(m); reason != nil {
+			pm := mm.getPolicyModule(m)
+			mm.sendModuleReport(req, reportVersionRejected, pm, reason)
+			rejected = append(rejected, pm.Name)
+			details = append(details, moduleError{
+				Name:    pm.Name,
+				Code:    getCommandError(reason).Code,
+				Message: reason.Error(),
+			})
+			continue
+		}
+		allowed = append(allowed, m)
+	}
+
+	if len(rejected) != 0 {
+		return allowed, &commandError{
+			Code:    details[0].Code,
+			Message: "modules versions rejected: " + strings.Join(rejected, ", "),
+			Modules: details,
+		}
+	}
+
+	return allowed, nil
+}
+
+func (mm *MainModule) serveStartModules(req *request, data []byte) (err error) {
+	defer func() {
+		if errSend := mm.sendStatusModules(req); errSend != nil {
+			err = joinErrors(err, errSend)
+		}
+	}()
+
+	var moduleList agent.ModuleList
+	if err = proto.Unmarshal(data, &moduleList); err != nil {
+		err = newCommandError(errCodeBadRequest, "error unmarshal of modules information: "+err.Error())
+		return
+	}
+
+	list, errPolicy := mm.checkPolicy(req, moduleList.GetList())
+	list, errVersion := mm.checkVersions(req, list)
+	defer func() {
+		err = joinErrors(err, errPolicy, errVersion)
+	}()
+
+	for _, m := range list {
+		if err = mm.getContext().Err(); err != nil {
+			err = newCommandError(errCodeConflict, "main module is stopping: "+err.Error())
+			return
+		}
+		var s *loader.ModuleState
+		var mi *loader.ModuleItem
+		id := m.GetName()
+		if ms, _ := mm.registry.Get(id); ms != nil {
+			err = wrapModuleError(id, newCommandError(errCodeConflict, "module "+id+" already exists"))
+			return
+		}
+
+		mc := mm.getModuleConfig(m)
+		if mi, err = mm.getModuleItem(m); err != nil {
+			err = wrapModuleError(id, err)
+			return
+		}
+		s, err = loader.NewState(mc, mi, mm.getModulesProto())
+		if err != nil {
+			err = wrapModuleError(id, err)
+			return
+		}
+
+		if err = mm.startModule(id, mc, s); err != nil {
+			err = wrapModuleError(id, err)
+			return
+		}
+	}
+
+	return
+}
+
+func (mm *MainModule) serveStopModules(req *request, data []byte) (err error) {
+	defer func() {
+		if errSend := mm.sendStatusModules(req); errSend != nil {
+			err = joinErrors(err, errSend)
+		}
+	}()
+
+	var moduleList agent.ModuleList
+	if err = proto.Unmarshal(data, &moduleList); err != nil {
+		err = newCommandError(errCodeBadRequest, "error unmarshal of modules information: "+err.Error())
+		return
+	}
+
+	for _, m := range moduleList.GetList() {
+		var mc *loader.ModuleConfig
+		id := m.GetName()
+		if mc, err = mm.stopModule(id); err != nil {
+			err = wrapModuleError(id, err)
+			return
+		}
+
+		if mc != nil {
+			mm.releaseModuleFiles(req, mc)
+		}
+	}
+
+	return
+}
+
+func (mm *MainModule) serveUpdateModules(req *request, data []byte) (err error) {
+	defer func() {
+		if errSend := mm.sendStatusModules(req); errSend != nil {
+			err = joinErrors(err, errSend)
+		}
+	}()
+
+	var moduleList agent.ModuleList
+	if err = proto.Unmarshal(data, &moduleList); err != nil {
+		err = newCommandError(errCodeBadRequest, "error unmarshal of modules information: "+err.Error())
+		return
+	}
+
+	list, errPolicy := mm.checkPolicy(req, moduleList.GetList())
+	list, errVersion := mm.checkVersions(req, list)
+	defer func() {
+		err = joinErrors(err, errPolicy, errVersion)
+	}()
+
+	for _, m := range list {
+		if err = mm.getContext().Err(); err != nil {
+			err = newCommandError(errCodeConflict, "main module is stopping: "+err.Error())
+			return
+		}
+		var s *loader.ModuleState
+		var mi *loader.ModuleItem
+		var omc *loader.ModuleConfig
+		id := m.GetName()
+		if omc, err = mm.stopModule(id); err != nil {
+			err = wrapModuleError(id, err)
+			return
+		}
+
+		mc := mm.getModuleConfig(m)
+		if mi, err = mm.getModuleItem(m); err != nil {
+			err = wrapModuleError(id, err)
+			return
+		}
+		if omc != nil && omc.Version != mc.Version {
+			mm.releaseModuleFiles(req, omc)
+		}
+		s, err = loader.NewState(mc, mi, mm.getModulesProto())
+		if err != nil {
+			err = wrapModuleError(id, err)
+			return
+		}
+
+		if err = mm.startModule(id, mc, s); err != nil {
+			err = wrapModuleError(id, err)
+			return
+		}
+	}
+
+	return
+}
+
+func (mm *MainModule) serveUpdateConfigModules(req *request, data []byte) (err error) {
+	defer func() {
+		if errSend := mm.sendStatusModules(req); errSend != nil {
+			err = joinErrors(err, errSend)
+		}
+	}()
+
+	var moduleList agent.ModuleList
+	if err = proto.Unmarshal(data, &moduleList); err != nil {
+		err = newCommandError(errCodeBadRequest, "error unmarshal of modules information: "+err.Error())
+		return
+	}
+
+	for _, m := range moduleList.GetList() {
+		id := m.GetName()
+		var ms *loader.ModuleState
+		mc := mm.getModuleConfig(m)
+		if ms, err = mm.registry.UpdateConfig(id, mc); err != nil {
+			err = wrapModuleError(id, err)
+			return
+		}
+
+		mm.limits.SetLimits(id, mc)
+		ms.GetModule().ControlMsg("update_config", mc.GetCurrentConfig())
+	}
+
+	return
+}
+
+func (mm *MainModule) serveData(req *request, message *agent.Message) (err error) {
+	defer func(start time.Time) {
+		mm.metrics.observeCommand(req.command, time.Since(start), err)
+	}(time.Now())
+
+	switch message.GetType() {
+	case agent.Message_GET_INFORMATION:
+		return mm.sendInformation(req)
+	case agent.Message_GET_STATUS_MODULES:
+		return mm.sendStatusModules(req)
+	case agent.Message_START_MODULES:
+		return mm.serveStartModules(req, message.Payload)
+	case agent.Message_STOP_MODULES:
+		return mm.serveStopModules(req, message.Payload)
+	case agent.Message_UPDATE_MODULES:
+		return mm.serveUpdateModules(req, message.Payload)
+	case agent.Message_UPDATE_CONFIG_MODULES:
+		return mm.serveUpdateConfigModules(req, message.Payload)
+	case messageAgentUpgrade:
+		return mm.serveAgentUpgrade(req, message.Payload)
+	case messageFileManifest:
+		return mm.serveFileManifest(req, message.Payload)
+	case messageScriptRun:
+		return mm.serveScript(req, message.Payload)
+	case messageOutboundLimits:
+		return mm.serveOutboundLimits(req, message.Payload)
+	default:
+		return newCommandError(errCodeBadRequest, "received unknown message type "+req.command)
+	}
+}
+
+func (mm *MainModule) recvPacket(ctx context.Context, receiver chan *vxproto.Packet) error {
+	getAgentEntry := func(agentInfo *vxproto.AgentInfo) *logrus.Entry {
+		return logrus.WithFields(logrus.Fields{
+			"id":   agentInfo.ID,
+			"type": agentInfo.Type.String(),
+			"ip":   agentInfo.IP,
+			"src":  agentInfo.Src,
+			"dst":  agentInfo.Dst,
+		})
+	}
+	for {
+		var packet *vxproto.Packet
+		select {
+		case packet = <-receiver:
+		case <-mm.liveness:
+			continue
+		case <-ctx.Done():
+			logrus.Info("vxagent: got signal to stop main module")
+			return nil
+		}
+		if packet == nil {
+			logrus.Error("vxagent: failed receive packet")
+			return errors.New("failed receive packet")
+		}
+		mm.receiver.setBusy(true)
+		mm.metrics.addPacket(packet.PType.String())
+		switch packet.PType {
+		case vxproto.PTData:
+			mm.recvData(packet.Src, packet.GetData())
+		case vxproto.PTFile:
+			mm.recvFile(packet.Src, packet.GetFile())
+		case vxproto.PTText:
+			mm.recvText(packet.Src, packet.GetText())
+		case vxproto.PTMsg:
+			mm.recvMsg(packet.Src, packet.GetMsg())
+		case vxproto.PTControl:
+			msg := packet.GetControlMsg()
+			switch msg.MsgType {
+			case vxproto.AgentConnected:
+				mm.receiver.setAgent(msg.AgentInfo.Dst, true)
+				mm.heartbeat.reset()
+				mm.outbox.notify()
+				getAgentEntry(msg.AgentInfo).Info("vxagent: agent connected")
+			case vxproto.AgentDisconnected:
+				mm.receiver.setAgent(msg.AgentInfo.Dst, false)
+				mm.encodings.del(msg.AgentInfo.Dst)
+				mm.capabilities.del(msg.AgentInfo.Dst)
+				mm.status.forget(msg.AgentInfo.Dst)
+				getAgentEntry(msg.AgentInfo).Info("vxagent: agent disconnected")
+			case vxproto.StopModule:
+				logrus.Info("vxagent: got signal to stop main module")
+				return nil
+			}
+		default:
+			logrus.Error("vxagent: got packet has unexpected packet type")
+			return errors.New("unexpected packet type")
+		}
+		mm.receiver.setBusy(false)
+	}
+}
@@ -0,0 +1,274 @@
+package mmodule
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/loader"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+// testSocket is socket of main module which keeps packets sent to server
+// Other methods of the socket aren't used by commands handlers
+type testSocket struct {
+	vxproto.IModuleSocket
+	messages []*agent.Message
+	reports  []map[string]interface{}
+	dsts     []string
+	mutex    sync.Mutex
+}
+
+func (s *testSocket) SendDataTo(dst string, data *vxproto.Data) error {
+	var message agent.Message
+	if err := proto.Unmarshal(data.Data, &message); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messages = append(s.messages, &message)
+	s.dsts = append(s.dsts, dst)
+	return nil
+}
+
+func (s *testSocket) SendMsgTo(dst string, msg *vxproto.Msg) error {
+	var report map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &report); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reports = append(s.reports, report)
+	s.dsts = append(s.dsts, dst)
+	return nil
+}
+
+// getReports is function which return sent reports of the type
+func (s *testSocket) getReports(rtype string) []map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var reports []map[string]interface{}
+	for _, report := range s.reports {
+		if report["type"] == rtype {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// getMessages is function which return sent messages of the type
+func (s *testSocket) getMessages(mtype agent.Message_Type) []*agent.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var messages []*agent.Message
+	for _, message := range s.messages {
+		if message.GetType() == mtype {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// newTestConnectedModule is function which create main module with socket of test server
+// commands are executed by dispatcher as in running main module
+func newTestConnectedModule(t *testing.T) (*MainModule, *testSocket, func()) {
+	mm, cleanup := newTestMainModule(t)
+	socket := &testSocket{}
+	mm.setState(nil, socket)
+	mm.commands.Open()
+	mm.outbound.Open()
+
+	return mm, socket, func() {
+		mm.commands.Close()
+		mm.outbound.Close()
+		mm.setState(nil, nil)
+		cleanup()
+	}
+}
+
+// sendTestCommand is function which pass server command to main module
+func sendTestCommand(t *testing.T, mm *MainModule, message *agent.Message) {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm.recvData("server", &vxproto.Data{Data: data})
+}
+
+// newTestModuleList is function which create payload of modules command
+func newTestModuleList(t *testing.T, modules ...*agent.Module) []byte {
+	for _, m := range modules {
+		m.Config.AgentId = proto.String("test")
+		m.Config.Name = m.Name
+		m.Config.LastUpdate = proto.String("")
+	}
+	data, err := proto.Marshal(&agent.ModuleList{List: modules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCommandErrorReports(t *testing.T) {
+	mm, socket, cleanup := newTestConnectedModule(t)
+	defer cleanup()
+	if err := mm.registry.Add("m1", newTestModuleConfig("m1", "2.0.0"), &loader.ModuleState{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		message *agent.Message
+		command string
+		code    string
+		modules map[string]string
+	}{
+		{
+			name:    "unknown type",
+			message: &agent.Message{Type: agent.Message_Type(200).Enum()},
+			command: "200",
+			code:    errCodeBadRequest,
+		},
+		{
+			name:    "broken payload",
+			message: &agent.Message{Type: agent.Message_START_MODULES.Enum(), Payload: []byte{0xff}},
+			command: "START_MODULES",
+			code:    errCodeBadRequest,
+		},
+		{
+			name: "unknown module",
+			message: &agent.Message{
+				Type:    agent.Message_STOP_MODULES.Enum(),
+				Payload: newTestModuleList(t, newTestAgentModule("m2", "1.0.0", nil)),
+			},
+			command: "STOP_MODULES",
+			code:    errCodeNotFound,
+			modules: map[string]string{"m2": errCodeNotFound},
+		},
+		{
+			name: "module downgrade",
+			message: &agent.Message{
+				Type:    agent.Message_START_MODULES.Enum(),
+				Payload: newTestModuleList(t, newTestAgentModule("m1", "1.0.0", nil)),
+			},
+			command: "START_MODULES",
+			code:    errCodeConflict,
+			modules: map[string]string{"m1": errCodeConflict},
+		},
+	}
+	for i, tt := range tests {
+		sendTestCommand(t, mm, tt.message)
+		waitCondition(t, 5*time.Second, tt.name+": command error wasn't sent", func() bool {
+			return len(socket.getReports(reportCommandError)) == i+1
+		})
+
+		report := socket.getReports(reportCommandError)[i]
+		if report["command"] != tt.command || report["code"] != tt.code || report["message"] == "" {
+			t.Errorf("%s: unexpected report %v", tt.name, report)
+		}
+		modules, _ := report["modules"].([]interface{})
+		if len(modules) != len(tt.modules) {
+			t.Errorf("%s: unexpected modules details %v", tt.name, modules)
+		}
+		for _, m := range modules {
+			details := m.(map[string]interface{})
+			if name, _ := details["name"].(string); details["code"] != tt.modules[name] {
+				t.Errorf("%s: unexpected module details %v", tt.name, details)
+			}
+		}
+	}
+
+	// Modules commands answer by modules status even if they failed
+	if statuses := socket.getMessages(agent.Message_STATUS_MODULES_RESULT); len(statuses) != 3 {
+		t.Fatalf("unexpected amount of status responses %d", len(statuses))
+	}
+	if reports := socket.getReports(reportVersionRejected); len(reports) != 1 {
+		t.Fatalf("unexpected version reports %v", reports)
+	}
+	for _, dst := range socket.dsts {
+		if dst != "server" {
+			t.Fatalf("response was sent to %q instead of request source", dst)
+		}
+	}
+
+	// Unparsed message hasn't request type
+	mm.recvData("server", &vxproto.Data{Data: []byte{0xff}})
+	waitCondition(t, 5*time.Second, "command error wasn't sent", func() bool {
+		return len(socket.getReports(reportCommandError)) == len(tests)+1
+	})
+	if report := socket.getReports(reportCommandError)[len(tests)]; report["command"] != "UNKNOWN" ||
+		report["code"] != errCodeBadRequest {
+		t.Fatalf("unexpected report %v", report)
+	}
+}
+
+func TestCommandSuccessWithoutError(t *testing.T) {
+	mm, socket, cleanup := newTestConnectedModule(t)
+	defer cleanup()
+
+	sendTestCommand(t, mm, &agent.Message{Type: agent.Message_GET_INFORMATION.Enum()})
+	waitCondition(t, 5*time.Second, "information wasn't sent", func() bool {
+		return len(socket.getMessages(agent.Message_INFORMATION_RESULT)) == 1
+	})
+	mm.commands.Close()
+	if reports := socket.getReports(reportCommandError); len(reports) != 0 {
+		t.Fatalf("successful command was reported as failed: %v", reports)
+	}
+}
+
+// newTestRequestMessage is function which create server command with correlation ID
+func newTestRequestMessage(mtype agent.Message_Type, id string, payload []byte) *agent.Message {
+	return newRequest("", id, "").newMessage(mtype, payload)
+}
+
+func TestRequestIDEcho(t *testing.T) {
+	mm, socket, cleanup := newTestConnectedModule(t)
+	defer cleanup()
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	if err := mm.registry.Add("m1", newTestModuleConfig("m1", "2.0.0"), &loader.ModuleState{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commands are executed in parallel so their responses are distinguished by correlation ID
+	sendTestCommand(t, mm, newTestRequestMessage(agent.Message_GET_STATUS_MODULES, "req-1", nil))
+	sendTestCommand(t, mm, newTestRequestMessage(agent.Message_START_MODULES, "req-2",
+		newTestModuleList(t, newTestAgentModule("m1", "1.0.0", nil))))
+	sendTestCommand(t, mm, &agent.Message{Type: agent.Message_GET_STATUS_MODULES.Enum()})
+	waitCondition(t, 5*time.Second, "responses weren't sent", func() bool {
+		return len(socket.getMessages(agent.Message_STATUS_MODULES_RESULT)) == 3 &&
+			len(socket.getReports(reportCommandError)) == 1
+	})
+
+	ids := make(map[string]int)
+	for _, message := range socket.getMessages(agent.Message_STATUS_MODULES_RESULT) {
+		id, _ := getUnknownString(message.XXX_unrecognized, fieldMessageRequestID)
+		ids[id]++
+	}
+	if ids["req-1"] != 1 || ids["req-2"] != 1 || ids[""] != 1 {
+		t.Fatalf("unexpected correlation IDs of responses %v", ids)
+	}
+	for _, rtype := range []string{reportCommandError, reportVersionRejected} {
+		if reports := socket.getReports(rtype); len(reports) != 1 || reports[0]["request_id"] != "req-2" {
+			t.Fatalf("report %s hasn't correlation ID: %v", rtype, reports)
+		}
+	}
+
+	var logged bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.ErrorLevel && entry.Message == "vxagent: failed to exec command" {
+			if entry.Data["request_id"] != "req-2" || entry.Data["command"] != "START_MODULES" {
+				t.Fatalf("log entry of failed command hasn't correlation ID: %v", entry.Data)
+			}
+			logged = true
+		}
+	}
+	if !logged {
+		t.Fatal("failed command wasn't logged")
+	}
+}
@@ -0,0 +1,382 @@
+package mmodule
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// outboundClass is priority class of traffic from agent to server, lower value has higher priority
+type outboundClass int
+
+const (
+	// outboundControl is class of responses to server commands and reports
+	outboundControl outboundClass = iota
+	// outboundStatus is class of modules status which is sent on request or on changes
+	outboundStatus
+	// outboundEvents is class of packets which are produced by modules
+	outboundEvents
+	// outboundClasses is amount of traffic classes
+	outboundClasses
+)
+
+// outboundClassNames is list of traffic classes names in priority order
+var outboundClassNames = [outboundClasses]string{"control", "status", "events"}
+
+// errOutboundClosed is error of packet sending after outbound sender was closed
+var errOutboundClosed = errors.New("outbound sender is closed")
+
+// tokenBucket is rate limiter which allows bursts up to bucket size
+// Zero rate means that the bucket is unlimited, tokens can go below zero to pass
+// single request which is bigger than bucket size when the bucket is full
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// set is function which change rate and size of bucket, the bucket is refilled
+func (b *tokenBucket) set(rate, burst float64) {
+	if burst < 1 {
+		burst = 1
+	}
+	b.rate, b.burst, b.tokens, b.last = rate, burst, burst, time.Now()
+}
+
+// refill is function which add tokens which were accumulated since last call
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate == 0 {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// wait is function which return time until n tokens will be available
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill(now)
+	if n > b.burst {
+		n = b.burst
+	}
+	if b.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take is function which consume n tokens from bucket
+func (b *tokenBucket) take(n float64) {
+	if b.rate != 0 {
+		b.tokens -= n
+	}
+}
+
+// outboundPacket is struct which contains packet waiting for sending in queue of its class
+// Result channel is nil for packets which were posted without waiting of result
+type outboundPacket struct {
+	size   int
+	send   func() error
+	result chan error
+}
+
+// outboundSender is struct which sends packets to server by priority of their classes
+// Higher class is sent first if its limits allow it, otherwise lower classes use the link
+type outboundSender struct {
+	queues  [outboundClasses][]*outboundPacket
+	packets [outboundClasses]tokenBucket
+	bytes   [outboundClasses]tokenBucket
+	local   OutboundConfig
+	server  OutboundConfig
+	running bool
+	metrics *agentMetrics
+	wake    chan struct{}
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	mutex   *sync.Mutex
+}
+
+// getLimit is function which merge local and server limit value, the stricter one is used
+func getLimit(local, server float64) float64 {
+	if local == 0 || (server != 0 && server < local) {
+		return server
+	}
+	return local
+}
+
+// getOutboundLimits is function which merge local and server limits of traffic class
+func getOutboundLimits(local, server OutboundLimits) OutboundLimits {
+	return OutboundLimits{
+		Rate:     getLimit(local.Rate, server.Rate),
+		Burst:    int(getLimit(float64(local.Burst), float64(server.Burst))),
+		ByteRate: int64(getLimit(float64(local.ByteRate), float64(server.ByteRate))),
+	}
+}
+
+// newOutboundSender is function which constructed outboundSender object
+func newOutboundSender(config OutboundConfig, metrics *agentMetrics) *outboundSender {
+	s := &outboundSender{
+		local:   config,
+		metrics: metrics,
+		wake:    make(chan struct{}, 1),
+		mutex:   &sync.Mutex{},
+	}
+	s.applyI()
+
+	return s
+}
+
+// applyI is internal function which set effective limits to token buckets
+func (s *outboundSender) applyI() {
+	for class, limits := range s.getLimitsI().list() {
+		burst := float64(limits.Burst)
+		if burst == 0 {
+			burst = limits.Rate
+		}
+		s.packets[class].set(limits.Rate, burst)
+		s.bytes[class].set(float64(limits.ByteRate), float64(limits.ByteRate))
+	}
+}
+
+// getLimitsI is internal function which return effective limits of all classes
+func (s *outboundSender) getLimitsI() OutboundConfig {
+	return OutboundConfig{
+		Control: getOutboundLimits(s.local.Control, s.server.Control),
+		Status:  getOutboundLimits(s.local.Status, s.server.Status),
+		Events:  getOutboundLimits(s.local.Events, s.server.Events),
+		// queue size isn't changed by server
+		QueueSize: s.local.QueueSize,
+	}
+}
+
+// GetLimits is function which return effective limits of all classes
+func (s *outboundSender) GetLimits() OutboundConfig {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.getLimitsI()
+}
+
+// SetConfig is function which update local limits of traffic classes
+func (s *outboundSender) SetConfig(config OutboundConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.local = config
+	s.applyI()
+	s.notify()
+}
+
+// SetServerLimits is function which update limits of traffic classes which were received from server
+// The limits can only tighten local ones, empty limits reset the server restrictions
+func (s *outboundSender) SetServerLimits(config OutboundConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.server = config
+	s.applyI()
+	s.notify()
+}
+
+// Stats is function which return amount of packets waiting in queue of every class
+func (s *outboundSender) Stats() map[string]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := make(map[string]int)
+	for class, queue := range s.queues {
+		stats[outboundClassNames[class]] = len(queue)
+	}
+
+	return stats
+}
+
+// notify is function which wake up sending loop
+func (s *outboundSender) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Open is function which start sending loop
+func (s *outboundSender) Open() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running {
+		return
+	}
+	s.running = true
+	s.quit = make(chan struct{})
+	s.wg.Add(1)
+	go s.run(s.quit)
+}
+
+// Close is function which stop sending loop and reject packets waiting in queues
+func (s *outboundSender) Close() {
+	s.mutex.Lock()
+	if !s.running {
+		s.mutex.Unlock()
+		return
+	}
+	s.running = false
+	close(s.quit)
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for class, queue := range s.queues {
+		for _, p := range queue {
+			if p.result != nil {
+				p.result <- errOutboundClosed
+			} else {
+				s.metrics.addOutboundDropped(outboundClassNames[class])
+			}
+		}
+		s.queues[class] = nil
+	}
+}
+
+// push is function which put packet to the end of queue of its class
+func (s *outboundSender) push(class outboundClass, p *outboundPacket) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return errOutboundClosed
+	}
+	if p.result == nil && len(s.queues[class]) >= s.local.QueueSize {
+		s.metrics.addOutboundDropped(outboundClassNames[class])
+		return errors.New("outbound queue of " + outboundClassNames[class] + " is full")
+	}
+	s.queues[class] = append(s.queues[class], p)
+	s.notify()
+
+	return nil
+}
+
+// Send is function which put packet into queue of its class and wait result of sending
+// Size is amount of bytes which are accounted by byte rate limit of the class
+func (s *outboundSender) Send(class outboundClass, size int, send func() error) error {
+	p := &outboundPacket{
+		size:   size,
+		send:   send,
+		result: make(chan error, 1),
+	}
+	if err := s.push(class, p); err != nil {
+		return err
+	}
+
+	return <-p.result
+}
+
+// Post is function which put packet into queue of its class without waiting result of sending
+// Result is error when the queue is full or the sender is closed
+func (s *outboundSender) Post(class outboundClass, size int, send func() error) error {
+	return s.push(class, &outboundPacket{
+		size: size,
+		send: send,
+	})
+}
+
+// next is function which take first packet of the highest class which limits allow to send it
+// Result is packet and class or time to wait for tokens if all queues are limited, -1 if queues are empty
+func (s *outboundSender) next() (*outboundPacket, outboundClass, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(-1)
+	for class := outboundClass(0); class < outboundClasses; class++ {
+		if len(s.queues[class]) == 0 {
+			continue
+		}
+		p := s.queues[class][0]
+		d := s.packets[class].wait(1, now)
+		if bd := s.bytes[class].wait(float64(p.size), now); bd > d {
+			d = bd
+		}
+		if d == 0 {
+			s.queues[class] = s.queues[class][1:]
+			s.packets[class].take(1)
+			s.bytes[class].take(float64(p.size))
+			return p, class, 0
+		}
+		if wait < 0 || d < wait {
+			wait = d
+		}
+	}
+
+	return nil, 0, wait
+}
+
+// run is function which send packets from queues until quit channel will be closed
+func (s *outboundSender) run(quit chan struct{}) {
+	defer s.wg.Done()
+
+	for {
+		p, class, wait := s.next()
+		if p != nil {
+			err := p.send()
+			if p.result != nil {
+				p.result <- err
+			} else if err != nil {
+				logrus.WithError(err).WithField("class", outboundClassNames[class]).
+					Debug("vxagent: failed to send packet to server")
+			}
+			s.metrics.addOutboundPacket(outboundClassNames[class], p.size)
+			continue
+		}
+
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-timer:
+		case <-s.wake:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// list is function which return limits of classes in priority order
+func (c OutboundConfig) list() [outboundClasses]OutboundLimits {
+	return [outboundClasses]OutboundLimits{c.Control, c.Status, c.Events}
+}
+
+// serveOutboundLimits is function which apply limits of outbound traffic from server
+// Result is effective limits which are merged with local configuration
+func (mm *MainModule) serveOutboundLimits(req *request, data []byte) error {
+	var config OutboundConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return newCommandError(errCodeBadRequest, "error unmarshal of outbound limits: "+err.Error())
+	}
+	if err := config.validate(); err != nil {
+		return newCommandError(errCodeBadRequest, "invalid outbound limits: "+err.Error())
+	}
+	mm.outbound.SetServerLimits(config)
+
+	limits := mm.outbound.GetLimits()
+	req.logger.WithField("limits", limits).Info("vxagent: outbound limits were received from server")
+	payload, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+
+	return mm.responseAgent(req, messageOutboundLimitsResult, payload)
+}
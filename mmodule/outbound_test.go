@@ -0,0 +1,95 @@
+package mmodule
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboundPriority(t *testing.T) {
+	s := newOutboundSender(DefaultConfig().Outbound, newMetrics())
+	s.Open()
+	defer s.Close()
+
+	var mutex sync.Mutex
+	var order []string
+	record := func(name string) func() error {
+		return func() error {
+			mutex.Lock()
+			order = append(order, name)
+			mutex.Unlock()
+			return nil
+		}
+	}
+
+	// the first packet holds sending loop until all other packets are queued
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s.Post(outboundEvents, 0, func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	s.Post(outboundEvents, 0, record("events"))
+	var wg sync.WaitGroup
+	for _, class := range []outboundClass{outboundStatus, outboundControl} {
+		class := class
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Send(class, 0, record(outboundClassNames[class]))
+		}()
+	}
+	for {
+		if stats := s.Stats(); stats["control"] == 1 && stats["status"] == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	for {
+		if stats := s.Stats(); stats["events"] == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(order) < 2 || order[0] != "control" || order[1] != "status" {
+		t.Fatalf("packets were sent out of priority order: %v", order)
+	}
+}
+
+func TestOutboundRateLimit(t *testing.T) {
+	config := DefaultConfig().Outbound
+	config.Events = OutboundLimits{Rate: 50, Burst: 1}
+	s := newOutboundSender(config, newMetrics())
+	s.Open()
+	defer s.Close()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := s.Send(outboundEvents, 10, func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Fatalf("5 events were sent in %s with rate 50 per second", elapsed)
+	}
+
+	start = time.Now()
+	if err := s.Send(outboundControl, 10, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("unlimited control packet was delayed for %s", elapsed)
+	}
+
+	s.SetServerLimits(OutboundConfig{Events: OutboundLimits{Rate: 100}})
+	if limits := s.GetLimits(); limits.Events.Rate != 50 {
+		t.Fatalf("server limits relaxed local events rate to %v", limits.Events.Rate)
+	}
+}
@@ -0,0 +1,571 @@
+package mmodule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+const (
+	// outboxDirName is name of directory for module events into data directory
+	outboxDirName = "outbox"
+	// outboxEventExt is extension of file which contains one module event
+	outboxEventExt = ".json"
+	// outboxReplayPeriod is period of checking outbox for events which should be replayed
+	outboxReplayPeriod = time.Second
+	// outboxModuleMaxLen is maximum length of module name which is stored into event file name
+	outboxModuleMaxLen = 128
+)
+
+const (
+	// OutboxDropOldest is overflow policy which removes the oldest events to store new one
+	OutboxDropOldest = "drop_oldest"
+	// OutboxDropNewest is overflow policy which rejects new events while outbox is full
+	OutboxDropNewest = "drop_newest"
+)
+
+// outboxEvent is struct which contains packet of module produced while agent was disconnected
+type outboxEvent struct {
+	Module string `json:"module"`
+	Type   string `json:"type"`
+	Data   []byte `json:"data"`
+	Name   string `json:"name,omitempty"`
+	MType  int32  `json:"mtype,omitempty"`
+}
+
+// outboxEntry is struct which describes event file into outbox directory
+type outboxEntry struct {
+	seq    uint64
+	module string
+	size   int64
+	time   time.Time
+}
+
+// eventOutbox is disk-backed queue of module events which are waiting for connection to server
+// Each event is stored into own file which is named by sequence number and module name,
+// so the order of events is restored after agent restart without reading their content
+type eventOutbox struct {
+	path    string
+	config  OutboxConfig
+	entries []outboxEntry
+	counts  map[string]int
+	size    int64
+	seq     uint64
+	sockets map[string]vxproto.IModuleSocket
+	metrics *agentMetrics
+	wake    chan struct{}
+	mutex   *sync.Mutex
+}
+
+// checkOutboxModule is function which check that module name can be used into event file name
+func checkOutboxModule(module string) error {
+	if module == "" || module == "." || module == ".." || len(module) > outboxModuleMaxLen {
+		return errors.New("invalid module name for outbox")
+	}
+	for _, c := range module {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_-.", c)) {
+			return errors.New("module name contains character which isn't allowed into outbox")
+		}
+	}
+
+	return nil
+}
+
+// getOutboxFileName is function which return name of event file
+func getOutboxFileName(seq uint64, module string) string {
+	return fmt.Sprintf("%020d-%s%s", seq, module, outboxEventExt)
+}
+
+// parseOutboxFileName is function which return sequence number and module name of event file
+func parseOutboxFileName(name string) (uint64, string, bool) {
+	if !strings.HasSuffix(name, outboxEventExt) {
+		return 0, "", false
+	}
+	parts := strings.SplitN(strings.TrimSuffix(name, outboxEventExt), "-", 2)
+	if len(parts) != 2 || checkOutboxModule(parts[1]) != nil {
+		return 0, "", false
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return seq, parts[1], true
+}
+
+// newOutbox is function which constructed eventOutbox object and load events from the data directory
+func newOutbox(dataDir string, config OutboxConfig, metrics *agentMetrics) (*eventOutbox, error) {
+	ob := &eventOutbox{
+		path:    filepath.Join(dataDir, outboxDirName),
+		config:  config,
+		counts:  make(map[string]int),
+		sockets: make(map[string]vxproto.IModuleSocket),
+		metrics: metrics,
+		wake:    make(chan struct{}, 1),
+		mutex:   &sync.Mutex{},
+	}
+
+	if err := os.MkdirAll(ob.path, 0700); err != nil {
+		return nil, errors.New("failed to create outbox directory: " + err.Error())
+	}
+	files, err := ioutil.ReadDir(ob.path)
+	if err != nil {
+		return nil, errors.New("failed to read outbox directory: " + err.Error())
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		seq, module, ok := parseOutboxFileName(file.Name())
+		if !ok {
+			logrus.WithField("file", file.Name()).Warn("vxagent: unknown file into outbox directory")
+			continue
+		}
+		ob.entries = append(ob.entries, outboxEntry{
+			seq:    seq,
+			module: module,
+			size:   file.Size(),
+			time:   file.ModTime(),
+		})
+		ob.counts[module]++
+		ob.size += file.Size()
+		if seq > ob.seq {
+			ob.seq = seq
+		}
+	}
+	sort.Slice(ob.entries, func(i, j int) bool {
+		return ob.entries[i].seq < ob.entries[j].seq
+	})
+
+	return ob, nil
+}
+
+// SetConfig is function which update limits and overflow policy of outbox
+func (ob *eventOutbox) SetConfig(config OutboxConfig) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.config = config
+}
+
+// Stats is function which return amount and total size of events into outbox
+func (ob *eventOutbox) Stats() (int, int64) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	return len(ob.entries), ob.size
+}
+
+// setSocket is function which store socket of module to replay its events
+func (ob *eventOutbox) setSocket(module string, socket vxproto.IModuleSocket) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.sockets[module] = socket
+}
+
+// delSocket is function which forget socket of module after its deletion
+// Events of the module stay into outbox until the module is loaded again or they expire
+func (ob *eventOutbox) delSocket(module string, socket vxproto.IModuleSocket) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if ob.sockets[module] == socket {
+		delete(ob.sockets, module)
+	}
+}
+
+// getSocket is function which return socket of module to replay its events
+func (ob *eventOutbox) getSocket(module string) vxproto.IModuleSocket {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	return ob.sockets[module]
+}
+
+// notify is function which wake up replaying of events
+func (ob *eventOutbox) notify() {
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+}
+
+// removeI is internal function which delete event file with index i
+func (ob *eventOutbox) removeI(i int) {
+	entry := ob.entries[i]
+	if err := os.Remove(filepath.Join(ob.path, getOutboxFileName(entry.seq, entry.module))); err != nil &&
+		!os.IsNotExist(err) {
+		logrus.WithError(err).Warn("vxagent: failed to remove event from outbox")
+	}
+	ob.size -= entry.size
+	if ob.counts[entry.module]--; ob.counts[entry.module] <= 0 {
+		delete(ob.counts, entry.module)
+	}
+	ob.entries = append(ob.entries[:i], ob.entries[i+1:]...)
+}
+
+// expireI is internal function which delete events older than max age
+func (ob *eventOutbox) expireI() {
+	maxAge := time.Second * time.Duration(ob.config.MaxAge)
+	for i := 0; i < len(ob.entries); {
+		if time.Since(ob.entries[i].time) <= maxAge {
+			i++
+			continue
+		}
+		ob.removeI(i)
+		ob.metrics.addOutboxEvent("dropped")
+	}
+}
+
+// Push is function which store event of module into the end of outbox
+// Result is error when the event can't be stored because of overflow policy or disk failure
+func (ob *eventOutbox) Push(event *outboxEvent) error {
+	if err := checkOutboxModule(event.Module); err != nil {
+		ob.metrics.addOutboxEvent("dropped")
+		return err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.expireI()
+	size := int64(len(data))
+	if size > ob.config.MaxSize {
+		ob.metrics.addOutboxEvent("dropped")
+		return errors.New("event is bigger than outbox size")
+	}
+	for ob.size+size > ob.config.MaxSize && len(ob.entries) != 0 {
+		if ob.config.Overflow == OutboxDropNewest {
+			ob.metrics.addOutboxEvent("dropped")
+			return errors.New("outbox is full")
+		}
+		ob.removeI(0)
+		ob.metrics.addOutboxEvent("dropped")
+	}
+
+	seq := ob.seq + 1
+	path := filepath.Join(ob.path, getOutboxFileName(seq, event.Module))
+	if err = writeFileAtomic(path, data, 0600); err != nil {
+		ob.metrics.addOutboxEvent("dropped")
+		return errors.New("failed to store event into outbox: " + err.Error())
+	}
+	ob.seq = seq
+	ob.size += size
+	ob.counts[event.Module]++
+	ob.entries = append(ob.entries, outboxEntry{
+		seq:    seq,
+		module: event.Module,
+		size:   size,
+		time:   time.Now(),
+	})
+	ob.metrics.addOutboxEvent("buffered")
+
+	return nil
+}
+
+// hold is function which decide that event of module should be stored into outbox instead of sending
+// Events are held while agent is disconnected and while earlier events of the module are not replayed yet,
+// so events of other modules aren't delayed by module which isn't loaded after restart
+func (ob *eventOutbox) hold(module string, connected bool) bool {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if ob.config.Disabled {
+		return false
+	}
+
+	return !connected || ob.counts[module] != 0
+}
+
+// next is function which return the oldest event of module which has socket to replay it
+func (ob *eventOutbox) next() (*outboxEntry, vxproto.IModuleSocket, bool) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.expireI()
+	for _, entry := range ob.entries {
+		if socket, ok := ob.sockets[entry.module]; ok {
+			return &entry, socket, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// done is function which remove replayed event from outbox
+func (ob *eventOutbox) done(seq uint64) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	for i := range ob.entries {
+		if ob.entries[i].seq == seq {
+			ob.removeI(i)
+			return
+		}
+	}
+}
+
+// read is function which load content of event from outbox
+func (ob *eventOutbox) read(entry *outboxEntry) (*outboxEvent, error) {
+	data, err := ioutil.ReadFile(filepath.Join(ob.path, getOutboxFileName(entry.seq, entry.module)))
+	if err != nil {
+		return nil, err
+	}
+	var event outboxEvent
+	if err = json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// sendOutboxEvent is function which send replayed event through module socket to destination
+func sendOutboxEvent(socket vxproto.IModuleSocket, dst string, event *outboxEvent) error {
+	switch event.Type {
+	case vxproto.PTData.String():
+		return socket.SendDataTo(dst, &vxproto.Data{Data: event.Data})
+	case vxproto.PTFile.String():
+		return socket.SendFileTo(dst, &vxproto.File{Data: event.Data, Name: event.Name})
+	case vxproto.PTText.String():
+		return socket.SendTextTo(dst, &vxproto.Text{Data: event.Data, Name: event.Name})
+	case vxproto.PTMsg.String():
+		return socket.SendMsgTo(dst, &vxproto.Msg{Data: event.Data, MType: vxproto.MsgType(event.MType)})
+	default:
+		return errors.New("unknown type of event " + event.Type)
+	}
+}
+
+// replayOutbox is function which send events from outbox to server in order after reconnect and handshake
+// Events of modules which aren't loaded yet stay into outbox until their modules start or events expire
+// Servers which already got the event aren't sent it again when sending to other server failed
+func (mm *MainModule) replayOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxReplayPeriod)
+	defer ticker.Stop()
+
+	var (
+		deliveredSeq uint64
+		delivered    = make(map[string]struct{})
+	)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-mm.outbox.wake:
+		case <-ctx.Done():
+			return
+		}
+
+		for ctx.Err() == nil && mm.receiver.isReady() {
+			entry, socket, ok := mm.outbox.next()
+			if !ok {
+				break
+			}
+			logger := logrus.WithFields(logrus.Fields{
+				"module": entry.module,
+				"seq":    entry.seq,
+			})
+			event, err := mm.outbox.read(entry)
+			if err != nil {
+				logger.WithError(err).Warn("vxagent: failed to read event from outbox, it will be dropped")
+				mm.outbox.done(entry.seq)
+				mm.metrics.addOutboxEvent("dropped")
+				continue
+			}
+			if entry.seq != deliveredSeq {
+				deliveredSeq, delivered = entry.seq, make(map[string]struct{})
+			}
+			for dst := range mm.getAgentList() {
+				if _, ok := delivered[dst]; ok {
+					continue
+				}
+				err = mm.outbound.Send(outboundEvents, len(event.Data), func() error {
+					return sendOutboxEvent(socket, dst, event)
+				})
+				if err != nil {
+					break
+				}
+				delivered[dst] = struct{}{}
+			}
+			if err != nil || len(delivered) == 0 {
+				logger.WithError(err).Debug("vxagent: failed to replay event from outbox")
+				break
+			}
+			mm.outbox.done(entry.seq)
+			mm.metrics.addOutboxEvent("replayed")
+		}
+	}
+}
+
+// outboxProto is wrapper of VXProto which gives modules sockets with events buffering
+type outboxProto struct {
+	vxproto.IVXProto
+	outbox   *eventOutbox
+	outbound *outboundSender
+	ready    func() bool
+}
+
+// outboxSocket is wrapper of module socket which stores events into outbox while agent is disconnected
+// and passes other events to server through outbound sender with events priority
+type outboxSocket struct {
+	vxproto.IModuleSocket
+	outbox   *eventOutbox
+	outbound *outboundSender
+	ready    func() bool
+}
+
+// getModulesProto is function which return VXProto for modules loading
+func (mm *MainModule) getModulesProto() vxproto.IVXProto {
+	return &outboxProto{
+		IVXProto: mm.getProto(),
+		outbox:   mm.outbox,
+		outbound: mm.outbound,
+		ready:    mm.receiver.isReady,
+	}
+}
+
+// getOriginSocket is function which return module socket created by VXProto
+func getOriginSocket(socket vxproto.IModuleSocket) vxproto.IModuleSocket {
+	if s, ok := socket.(*outboxSocket); ok {
+		return s.IModuleSocket
+	}
+
+	return socket
+}
+
+// NewModule is function which create module socket and wrap it to buffer events
+func (p *outboxProto) NewModule(name, agentID string) vxproto.IModuleSocket {
+	socket := p.IVXProto.NewModule(name, agentID)
+	if socket == nil {
+		return nil
+	}
+	p.outbox.setSocket(name, socket)
+
+	return &outboxSocket{
+		IModuleSocket: socket,
+		outbox:        p.outbox,
+		outbound:      p.outbound,
+		ready:         p.ready,
+	}
+}
+
+// AddModule is function which register origin module socket into VXProto
+func (p *outboxProto) AddModule(socket vxproto.IModuleSocket) bool {
+	if !p.IVXProto.AddModule(getOriginSocket(socket)) {
+		return false
+	}
+	p.outbox.notify()
+
+	return true
+}
+
+// DelModule is function which delete origin module socket from VXProto and outbox
+func (p *outboxProto) DelModule(socket vxproto.IModuleSocket) bool {
+	origin := getOriginSocket(socket)
+	p.outbox.delSocket(origin.GetName(), origin)
+
+	return p.IVXProto.DelModule(origin)
+}
+
+// send is function which pass event through outbound queue and wait result, IMC packets are delivered immediately
+// Event which failed because connection was lost is stored into outbox to replay it after reconnect
+func (s *outboxSocket) send(dst string, event *outboxEvent, send func() error) error {
+	if s.HasIMCTokenFormat(dst) {
+		return send()
+	}
+
+	err := s.outbound.Send(outboundEvents, len(event.Data), send)
+	if err == nil || (err != errOutboundClosed && s.ready()) {
+		return err
+	}
+	event.Module = s.GetName()
+	if errPush := s.outbox.Push(event); errPush != nil {
+		return errors.New(err.Error() + ", failed to store event into outbox: " + errPush.Error())
+	}
+
+	return nil
+}
+
+// push is function which store event into outbox if it should be held
+// Result is flag that the event was handled by outbox and error of storing
+func (s *outboxSocket) push(dst string, event *outboxEvent) (bool, error) {
+	if s.HasIMCTokenFormat(dst) || !s.outbox.hold(s.GetName(), s.ready()) {
+		return false, nil
+	}
+	event.Module = s.GetName()
+
+	return true, s.outbox.Push(event)
+}
+
+// SendDataTo is function which send data to server or store it into outbox
+func (s *outboxSocket) SendDataTo(dst string, data *vxproto.Data) error {
+	event := &outboxEvent{Type: vxproto.PTData.String(), Data: data.Data}
+	if held, err := s.push(dst, event); held {
+		return err
+	}
+
+	return s.send(dst, event, func() error {
+		return s.IModuleSocket.SendDataTo(dst, data)
+	})
+}
+
+// SendFileTo is function which send file to server or store it into outbox
+// Files from file system are sent as is because their content can be changed until replaying
+func (s *outboxSocket) SendFileTo(dst string, file *vxproto.File) error {
+	send := func() error {
+		return s.IModuleSocket.SendFileTo(dst, file)
+	}
+	if len(file.Data) == 0 {
+		if s.HasIMCTokenFormat(dst) {
+			return send()
+		}
+		return s.outbound.Send(outboundEvents, 0, send)
+	}
+
+	event := &outboxEvent{Type: vxproto.PTFile.String(), Data: file.Data, Name: file.Name}
+	if held, err := s.push(dst, event); held {
+		return err
+	}
+
+	return s.send(dst, event, send)
+}
+
+// SendTextTo is function which send text to server or store it into outbox
+func (s *outboxSocket) SendTextTo(dst string, text *vxproto.Text) error {
+	event := &outboxEvent{Type: vxproto.PTText.String(), Data: text.Data, Name: text.Name}
+	if held, err := s.push(dst, event); held {
+		return err
+	}
+
+	return s.send(dst, event, func() error {
+		return s.IModuleSocket.SendTextTo(dst, text)
+	})
+}
+
+// SendMsgTo is function which send message to server or store it into outbox
+func (s *outboxSocket) SendMsgTo(dst string, msg *vxproto.Msg) error {
+	event := &outboxEvent{Type: vxproto.PTMsg.String(), Data: msg.Data, MType: int32(msg.MType)}
+	if held, err := s.push(dst, event); held {
+		return err
+	}
+
+	return s.send(dst, event, func() error {
+		return s.IModuleSocket.SendMsgTo(dst, msg)
+	})
+}
@@ -0,0 +1,291 @@
+package mmodule
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+func newTestOutbox(t *testing.T, dataDir string, overflow string) *eventOutbox {
+	config := DefaultConfig().Outbox
+	config.MaxSize = 1024
+	config.Overflow = overflow
+	ob, err := newOutbox(dataDir, config, newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ob
+}
+
+func TestOutboxOverflowAndRestart(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "vxagent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	ob := newTestOutbox(t, dataDir, OutboxDropOldest)
+	data := make([]byte, 200)
+	for i := 0; i < 10; i++ {
+		if err = ob.Push(&outboxEvent{Module: "module_a", Type: "Data", Data: data}); err != nil {
+			t.Fatalf("failed to push event %d: %s", i, err)
+		}
+	}
+	events, size := ob.Stats()
+	if size > 1024 || events == 0 || events == 10 {
+		t.Fatalf("unexpected outbox state after overflow: %d events, %d bytes", events, size)
+	}
+	if ob.entries[len(ob.entries)-1].seq != 10 {
+		t.Fatalf("the newest event was dropped instead of the oldest one")
+	}
+
+	ob = newTestOutbox(t, dataDir, OutboxDropNewest)
+	if n, _ := ob.Stats(); n != events {
+		t.Fatalf("outbox loaded %d events instead of %d", n, events)
+	}
+	first := ob.entries[0].seq
+	if err = ob.Push(&outboxEvent{Module: "module_a", Type: "Data", Data: data}); err == nil {
+		t.Fatal("full outbox accepted new event with drop_newest policy")
+	}
+	if ob.entries[0].seq != first {
+		t.Fatal("the oldest event was dropped with drop_newest policy")
+	}
+
+	ob.setSocket("module_a", nil)
+	for prev := uint64(0); ; {
+		entry, _, ok := ob.next()
+		if !ok {
+			break
+		}
+		if entry.seq <= prev {
+			t.Fatalf("events are replayed out of order: %d after %d", entry.seq, prev)
+		}
+		if _, err = ob.read(entry); err != nil {
+			t.Fatal(err)
+		}
+		prev = entry.seq
+		ob.done(entry.seq)
+	}
+	if n, size := ob.Stats(); n != 0 || size != 0 {
+		t.Fatalf("outbox isn't empty after replaying: %d events, %d bytes", n, size)
+	}
+}
+
+func TestOutboxHoldPerModule(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "vxagent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	ob := newTestOutbox(t, dataDir, OutboxDropOldest)
+	if !ob.hold("module_b", false) {
+		t.Fatal("event wasn't held while agent is disconnected")
+	}
+	if err = ob.Push(&outboxEvent{Module: "module_a", Type: "Data", Data: []byte("event")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events of module which isn't loaded after restart don't delay events of other modules
+	ob = newTestOutbox(t, dataDir, OutboxDropOldest)
+	if !ob.hold("module_a", true) {
+		t.Fatal("event was sent before earlier events of the same module")
+	}
+	if ob.hold("module_b", true) {
+		t.Fatal("event was held because of events of other module")
+	}
+
+	entry, _, ok := ob.next()
+	if ok {
+		t.Fatal("event of module without socket was replayed")
+	}
+	ob.setSocket("module_a", nil)
+	if entry, _, ok = ob.next(); !ok {
+		t.Fatal("event of loaded module wasn't replayed")
+	}
+	ob.done(entry.seq)
+	if ob.hold("module_a", true) {
+		t.Fatal("event was held after replaying of module events")
+	}
+}
+
+func TestOutboxModuleName(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "vxagent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	ob := newTestOutbox(t, dataDir, OutboxDropOldest)
+	for _, module := range []string{"", "..", "../../module", "dir/module", "dir\\module", "module:stream"} {
+		if err = ob.Push(&outboxEvent{Module: module, Type: "Data", Data: []byte("event")}); err == nil {
+			t.Errorf("event of module %q was stored", module)
+		}
+	}
+	if err = ob.Push(&outboxEvent{Module: "module-a.v2", Type: "Data", Data: []byte("event")}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dataDir, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Dir(files[0]) != ob.path {
+		t.Fatalf("unexpected files of events %v", files)
+	}
+	ob = newTestOutbox(t, dataDir, OutboxDropOldest)
+	if len(ob.entries) != 1 || ob.entries[0].module != "module-a.v2" {
+		t.Fatalf("event wasn't loaded after restart: %+v", ob.entries)
+	}
+}
+
+// testModuleSocket is module socket which is created by testModulesProto
+type testModuleSocket struct {
+	vxproto.IModuleSocket
+	name string
+}
+
+func (s *testModuleSocket) GetName() string { return s.name }
+
+// testModulesProto is VXProto which registers modules sockets only
+type testModulesProto struct {
+	vxproto.IVXProto
+}
+
+func (p *testModulesProto) NewModule(name, agentID string) vxproto.IModuleSocket {
+	return &testModuleSocket{name: name}
+}
+func (p *testModulesProto) AddModule(socket vxproto.IModuleSocket) bool { return true }
+func (p *testModulesProto) DelModule(socket vxproto.IModuleSocket) bool { return true }
+
+func TestOutboxProtoDelModule(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "vxagent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	ob := newTestOutbox(t, dataDir, OutboxDropOldest)
+	p := &outboxProto{IVXProto: &testModulesProto{}, outbox: ob}
+
+	old := p.NewModule("module_a", "test")
+	socket := p.NewModule("module_a", "test")
+	// Deletion of previous module instance doesn't forget socket of new one
+	p.DelModule(old)
+	if ob.getSocket("module_a") != getOriginSocket(socket) {
+		t.Fatal("socket of loaded module was forgotten")
+	}
+	p.DelModule(socket)
+	if ob.getSocket("module_a") != nil {
+		t.Fatal("socket of deleted module is kept by outbox")
+	}
+}
+
+// testEventSocket is module socket which fails sending to destination configured amount of times
+type testEventSocket struct {
+	vxproto.IModuleSocket
+	fails map[string]int
+	sent  map[string]int
+	mutex sync.Mutex
+}
+
+func (s *testEventSocket) GetName() string                   { return "module_a" }
+func (s *testEventSocket) HasIMCTokenFormat(dst string) bool { return false }
+
+func (s *testEventSocket) SendDataTo(dst string, data *vxproto.Data) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fails[dst] != 0 {
+		s.fails[dst]--
+		return errors.New("connection to " + dst + " was lost")
+	}
+	s.sent[dst]++
+	return nil
+}
+
+func (s *testEventSocket) getSent(dst string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sent[dst]
+}
+
+func TestOutboxSocketConnectionLost(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	mm.outbound.Open()
+	defer mm.outbound.Close()
+
+	origin := &testEventSocket{fails: map[string]int{"server": 2}, sent: make(map[string]int)}
+	ready := func() bool { return true }
+	socket := &outboxSocket{
+		IModuleSocket: origin,
+		outbox:        mm.outbox,
+		outbound:      mm.outbound,
+		ready:         func() bool { return ready() },
+	}
+
+	// Error of connected agent is returned to module
+	if err := socket.SendDataTo("server", &vxproto.Data{Data: []byte("event")}); err == nil {
+		t.Fatal("error of sending wasn't returned to module")
+	}
+	if n, _ := mm.outbox.Stats(); n != 0 {
+		t.Fatalf("failed event of connected agent was stored into outbox: %d", n)
+	}
+
+	// Connection is lost after the event was put into queue
+	ready = func() bool {
+		ready = func() bool { return false }
+		return true
+	}
+	if err := socket.SendDataTo("server", &vxproto.Data{Data: []byte("event")}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mm.outbox.Stats(); n != 1 {
+		t.Fatalf("event which failed after disconnection wasn't stored into outbox: %d", n)
+	}
+
+	// Events which are waiting on closing of outbound sender are stored too
+	mm.outbound.Close()
+	ready = func() bool { return true }
+	if err := socket.SendDataTo("server", &vxproto.Data{Data: []byte("event")}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mm.outbox.Stats(); n != 2 {
+		t.Fatalf("event of closed outbound sender wasn't stored into outbox: %d", n)
+	}
+}
+
+func TestReplayOutboxPerServer(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	mm.outbound.Open()
+	defer mm.outbound.Close()
+	mm.setState(&testAgentsProto{agents: map[string]*vxproto.AgentInfo{"a": {}, "b": {}}}, nil)
+	mm.receiver.setAgent("a", true)
+	mm.receiver.setHandshake(true)
+
+	socket := &testEventSocket{fails: map[string]int{"b": 1}, sent: make(map[string]int)}
+	if err := mm.outbox.Push(&outboxEvent{Module: "module_a", Type: "Data", Data: []byte("event")}); err != nil {
+		t.Fatal(err)
+	}
+	mm.outbox.setSocket("module_a", socket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mm.replayOutbox(ctx)
+	mm.outbox.notify()
+	waitCondition(t, 5*time.Second, "event wasn't replayed", func() bool {
+		n, _ := mm.outbox.Stats()
+		return n == 0
+	})
+	if socket.getSent("a") != 1 || socket.getSent("b") != 1 {
+		t.Fatalf("event was replayed %d and %d times", socket.getSent("a"), socket.getSent("b"))
+	}
+}
@@ -0,0 +1,436 @@
+package mmodule
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+// PolicyRule is struct which describes modules matched by the rule
+// Empty field matches any value and not empty field supports shell patterns
+// Publisher is taken from module arguments so it's advisory only
+// until the publisher key is pinned in publishers section of the policy
+type PolicyRule struct {
+	Name      string `json:"name,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Publisher string `json:"publisher,omitempty"`
+}
+
+// Policy is struct which contains local rules of modules execution
+// Deny rules have priority, if allow list isn't empty then module should match one of them
+// Publishers maps publisher name to base64 encoded ed25519 public key, if it isn't empty
+// then every module should declare one of these publishers and be signed by its key
+type Policy struct {
+	Allow      []PolicyRule      `json:"allow,omitempty"`
+	Deny       []PolicyRule      `json:"deny,omitempty"`
+	Publishers map[string]string `json:"publishers,omitempty"`
+	// denyAll is set when policy file exists but it can't be trusted
+	denyAll string
+	keys    map[string]ed25519.PublicKey
+}
+
+// policyModule is struct which contains module attributes for policy check
+// Digest is hex SHA-256 of module name, version and files manifest which is signed by publisher
+type policyModule struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Publisher string `json:"publisher,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+	signature []byte
+}
+
+// matchPolicyValue is function which match value by pattern of rule field
+func matchPolicyValue(pattern, value string) bool {
+	if pattern == "" || pattern == value {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// match is function which check that module matched by this rule
+func (r PolicyRule) match(m policyModule) bool {
+	return matchPolicyValue(r.Name, m.Name) &&
+		matchPolicyValue(r.Version, m.Version) &&
+		matchPolicyValue(r.Publisher, m.Publisher)
+}
+
+// String is function which return human readable representation of the rule
+func (r PolicyRule) String() string {
+	get := func(v string) string {
+		if v == "" {
+			return "*"
+		}
+		return v
+	}
+	return fmt.Sprintf("name=%s version=%s publisher=%s", get(r.Name), get(r.Version), get(r.Publisher))
+}
+
+// Check is function which return error with reason if module is denied by policy
+func (p *Policy) Check(m policyModule) error {
+	if p == nil {
+		return nil
+	}
+	if p.denyAll != "" {
+		return errors.New("all modules are denied: " + p.denyAll)
+	}
+	if err := p.checkPublisher(m); err != nil {
+		return err
+	}
+
+	for _, r := range p.Deny {
+		if r.match(m) {
+			return errors.New("module is denied by rule " + r.String())
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, r := range p.Allow {
+		if r.match(m) {
+			return nil
+		}
+	}
+
+	return errors.New("module isn't matched by any allow rule")
+}
+
+// checkPublisher is function which verify signature of module by pinned publisher key
+// Publisher is advisory if policy doesn't pin any keys, otherwise unsigned modules are rejected
+func (p *Policy) checkPublisher(m policyModule) error {
+	if len(p.keys) == 0 {
+		return nil
+	}
+	if m.Publisher == "" {
+		return errors.New("module doesn't declare publisher but the policy pins publishers keys")
+	}
+
+	key, ok := p.keys[m.Publisher]
+	if !ok {
+		return errors.New("publisher " + m.Publisher + " isn't pinned by the policy")
+	}
+	if len(m.signature) != ed25519.SignatureSize || !ed25519.Verify(key, []byte(m.Digest), m.signature) {
+		return errors.New("module signature of publisher " + m.Publisher + " is invalid")
+	}
+
+	return nil
+}
+
+// String is function which return human readable summary of the policy
+func (p *Policy) String() string {
+	if p == nil {
+		return "modules policy: not defined, all modules are allowed"
+	}
+	if p.denyAll != "" {
+		return "modules policy: all modules are denied (" + p.denyAll + ")"
+	}
+
+	lines := []string{fmt.Sprintf("modules policy: %d allow and %d deny rules", len(p.Allow), len(p.Deny))}
+	for _, r := range p.Allow {
+		lines = append(lines, "  allow "+r.String())
+	}
+	for _, r := range p.Deny {
+		lines = append(lines, "  deny "+r.String())
+	}
+	var publishers []string
+	for publisher := range p.keys {
+		publishers = append(publishers, publisher)
+	}
+	sort.Strings(publishers)
+	for _, publisher := range publishers {
+		lines = append(lines, "  pinned publisher "+publisher)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// LoadPolicy is function which read modules policy from JSON file
+// Result is nil policy without error if the file doesn't exist,
+// untrusted or invalid file leads to policy which denies all modules
+func LoadPolicy(policyPath string) (*Policy, error) {
+	if policyPath == "" {
+		return nil, nil
+	}
+
+	info, err := os.Stat(policyPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		err = errors.New("failed to get policy file info: " + err.Error())
+		return &Policy{denyAll: err.Error()}, err
+	}
+
+	if err = checkPolicyOwner(policyPath, info); err != nil {
+		err = errors.New("policy file can't be trusted: " + err.Error())
+		return &Policy{denyAll: err.Error()}, err
+	}
+
+	data, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		err = errors.New("failed to read policy file: " + err.Error())
+		return &Policy{denyAll: err.Error()}, err
+	}
+
+	var policy Policy
+	if err = json.Unmarshal(data, &policy); err != nil {
+		err = errors.New("failed to parse policy file: " + err.Error())
+		return &Policy{denyAll: err.Error()}, err
+	}
+	for _, r := range append(append([]PolicyRule{}, policy.Allow...), policy.Deny...) {
+		for _, pattern := range []string{r.Name, r.Version, r.Publisher} {
+			if _, err = path.Match(pattern, ""); err != nil {
+				err = errors.New("invalid pattern into policy rule " + r.String() + ": " + err.Error())
+				return &Policy{denyAll: err.Error()}, err
+			}
+		}
+	}
+	policy.keys = make(map[string]ed25519.PublicKey)
+	for publisher, value := range policy.Publishers {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			err = errors.New("invalid ed25519 public key of publisher " + publisher)
+			return &Policy{denyAll: err.Error()}, err
+		}
+		policy.keys[publisher] = ed25519.PublicKey(key)
+	}
+
+	return &policy, nil
+}
+
+// policyWatcher is struct which keeps current policy and reloads it after file changing
+type policyWatcher struct {
+	path     string
+	interval time.Duration
+	policy   *Policy
+	modTime  time.Time
+	size     int64
+	exists   bool
+	mutex    *sync.RWMutex
+	wg       sync.WaitGroup
+	quit     chan struct{}
+	onReload func(*Policy)
+}
+
+// newPolicyWatcher is function which constructed policyWatcher object and load policy
+// onReload callback is called after each policy changing
+func newPolicyWatcher(path string, interval time.Duration, onReload func(*Policy)) *policyWatcher {
+	pw := &policyWatcher{
+		path:     path,
+		interval: interval,
+		mutex:    &sync.RWMutex{},
+		onReload: onReload,
+	}
+	pw.load()
+
+	return pw
+}
+
+// load is internal function which read policy file and store its version
+func (pw *policyWatcher) load() {
+	pw.mutex.RLock()
+	policyPath := pw.path
+	pw.mutex.RUnlock()
+
+	policy, err := LoadPolicy(policyPath)
+	logger := logrus.WithFields(logrus.Fields{
+		"module": "main",
+		"path":   policyPath,
+	})
+	if err != nil {
+		logger.WithError(err).Error("vxagent: failed to load modules policy, all modules will be denied")
+	} else if policy != nil {
+		logger.Info("vxagent: modules policy was loaded")
+	}
+
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	pw.policy = policy
+	pw.exists = false
+	if info, err := os.Stat(policyPath); err == nil {
+		pw.exists = true
+		pw.modTime = info.ModTime()
+		pw.size = info.Size()
+	}
+}
+
+// hasChanged is internal function which check that policy file was changed since last loading
+func (pw *policyWatcher) hasChanged() bool {
+	pw.mutex.RLock()
+	defer pw.mutex.RUnlock()
+
+	info, err := os.Stat(pw.path)
+	if err != nil {
+		return pw.exists
+	}
+
+	return !pw.exists || !info.ModTime().Equal(pw.modTime) || info.Size() != pw.size
+}
+
+// Get is function which return current policy
+func (pw *policyWatcher) Get() *Policy {
+	pw.mutex.RLock()
+	defer pw.mutex.RUnlock()
+
+	return pw.policy
+}
+
+// Check is function which check module by current policy
+func (pw *policyWatcher) Check(m policyModule) error {
+	return pw.Get().Check(m)
+}
+
+// Reload is function which read policy file again and notify about it
+func (pw *policyWatcher) Reload() {
+	pw.load()
+	if pw.onReload != nil {
+		pw.onReload(pw.Get())
+	}
+}
+
+// SetConfig is function which change policy file path and checking interval
+// The policy is read again and watching loop is restarted if it is running
+func (pw *policyWatcher) SetConfig(path string, interval time.Duration) {
+	pw.mutex.Lock()
+	restart := pw.quit != nil && (pw.path != path || pw.interval != interval)
+	pw.path = path
+	pw.interval = interval
+	pw.mutex.Unlock()
+
+	if restart {
+		pw.Stop()
+		pw.Start()
+	}
+	pw.Reload()
+}
+
+// Start is function which run background watching of policy file
+func (pw *policyWatcher) Start() {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	if pw.quit != nil || pw.path == "" {
+		return
+	}
+	pw.quit = make(chan struct{})
+
+	pw.wg.Add(1)
+	go func(quit chan struct{}, interval time.Duration) {
+		defer pw.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if pw.hasChanged() {
+					pw.Reload()
+				}
+			case <-quit:
+				return
+			}
+		}
+	}(pw.quit, pw.interval)
+}
+
+// Stop is function which stop background watching of policy file
+func (pw *policyWatcher) Stop() {
+	pw.mutex.Lock()
+	if pw.quit == nil {
+		pw.mutex.Unlock()
+		return
+	}
+	close(pw.quit)
+	pw.quit = nil
+	pw.mutex.Unlock()
+
+	pw.wg.Wait()
+}
+
+// getModuleDigest is function which return hex SHA-256 digest of module version and its files
+// Manifest maps file path to SHA-256 hash of its content like manifests of the store
+func getModuleDigest(name, version string, manifest map[string]string) string {
+	paths := make([]string, 0, len(manifest))
+	for file := range manifest {
+		paths = append(paths, file)
+	}
+	sort.Strings(paths)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", getStoreModuleKey(name, version))
+	for _, file := range paths {
+		fmt.Fprintf(hash, "%s:%s\n", file, manifest[file])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// getFilesManifest is function which return manifest of module files
+func getFilesManifest(files map[string][]byte) map[string]string {
+	manifest := make(map[string]string)
+	for file, data := range files {
+		manifest[file] = getStoreHash(data)
+	}
+
+	return manifest
+}
+
+// newPolicyModule is function which collect module attributes for policy check
+func newPolicyModule(name, version string, args map[string][]string, manifest map[string]string) policyModule {
+	pm := policyModule{
+		Name:    name,
+		Version: version,
+		Digest:  getModuleDigest(name, version, manifest),
+	}
+	if publisher := args[policyPublisherArg]; len(publisher) != 0 {
+		pm.Publisher = publisher[0]
+	}
+	if signature := args[policySignatureArg]; len(signature) != 0 {
+		pm.signature, _ = base64.StdEncoding.DecodeString(signature[0])
+	}
+
+	return pm
+}
+
+// getModuleArgs is function which return module arguments as map
+func getModuleArgs(m *agent.Module) map[string][]string {
+	args := make(map[string][]string)
+	for _, a := range m.GetArgs() {
+		args[a.GetKey()] = a.GetValue()
+	}
+
+	return args
+}
+
+// getPolicyModule is function which collect module attributes for policy check
+// Files which were omitted by server are taken from the store manifest
+func (mm *MainModule) getPolicyModule(m *agent.Module) policyModule {
+	name, version := m.GetName(), m.GetConfig().GetVersion()
+	var manifest map[string]string
+	if len(m.GetFiles()) != 0 {
+		files := make(map[string][]byte)
+		for _, f := range m.GetFiles() {
+			files[f.GetPath()] = f.GetData()
+		}
+		manifest = getFilesManifest(files)
+	} else {
+		manifest, _ = mm.store.GetManifest(name, version)
+	}
+
+	return newPolicyModule(name, version, getModuleArgs(m), manifest)
+}
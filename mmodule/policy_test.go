@@ -0,0 +1,167 @@
+package mmodule
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	policy := &Policy{
+		Allow: []PolicyRule{
+			{Name: "module_*", Publisher: "vxcontrol"},
+			{Name: "legacy", Version: "1.*"},
+		},
+		Deny: []PolicyRule{
+			{Name: "module_bad"},
+			{Name: "module_a", Version: "0.*"},
+		},
+	}
+
+	tests := []struct {
+		module  policyModule
+		allowed bool
+	}{
+		{policyModule{Name: "module_a", Version: "1.0.0", Publisher: "vxcontrol"}, true},
+		{policyModule{Name: "module_a", Version: "0.9.0", Publisher: "vxcontrol"}, false},
+		{policyModule{Name: "module_a", Version: "1.0.0", Publisher: "other"}, false},
+		{policyModule{Name: "module_a", Version: "1.0.0"}, false},
+		{policyModule{Name: "module_bad", Version: "1.0.0", Publisher: "vxcontrol"}, false},
+		{policyModule{Name: "legacy", Version: "1.2.0"}, true},
+		{policyModule{Name: "legacy", Version: "2.0.0"}, false},
+		{policyModule{Name: "other", Version: "1.0.0", Publisher: "vxcontrol"}, false},
+	}
+	for _, tt := range tests {
+		if err := policy.Check(tt.module); (err == nil) != tt.allowed {
+			t.Errorf("module %+v: allowed %v, got error %v", tt.module, tt.allowed, err)
+		}
+	}
+
+	var empty *Policy
+	if err := empty.Check(policyModule{Name: "module_a"}); err != nil {
+		t.Errorf("undefined policy denied module: %v", err)
+	}
+	if err := (&Policy{denyAll: "untrusted"}).Check(policyModule{Name: "module_a"}); err == nil {
+		t.Error("untrusted policy allowed module")
+	}
+}
+
+func writeTestPolicy(t *testing.T, dir string, policy interface{}, perm os.FileMode) string {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, defaultPolicyFileName)
+	if err = ioutil.WriteFile(path, data, perm); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPolicyPublisherSignature(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() != 0 {
+		t.Skip("policy file should be owned by root")
+	}
+	dir, err := ioutil.TempDir("", "vxagent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestPolicy(t, dir, map[string]interface{}{
+		"allow":      []PolicyRule{{Publisher: "vxcontrol"}},
+		"publishers": map[string]string{"vxcontrol": base64.StdEncoding.EncodeToString(public)},
+	}, 0600)
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := getFilesManifest(map[string][]byte{"main.lua": []byte("return 'ok'")})
+	sign := func(name, version string) []string {
+		digest := getModuleDigest(name, version, manifest)
+		return []string{base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(digest)))}
+	}
+
+	tests := []struct {
+		name    string
+		args    map[string][]string
+		allowed bool
+	}{
+		{"signed", map[string][]string{"publisher": {"vxcontrol"}, "signature": sign("module_a", "1.0.0")}, true},
+		{"unsigned", map[string][]string{"publisher": {"vxcontrol"}}, false},
+		{"other module signature", map[string][]string{"publisher": {"vxcontrol"}, "signature": sign("module_b", "1.0.0")}, false},
+		{"other version signature", map[string][]string{"publisher": {"vxcontrol"}, "signature": sign("module_a", "0.1.0")}, false},
+		{"unknown publisher", map[string][]string{"publisher": {"other"}, "signature": sign("module_a", "1.0.0")}, false},
+		{"without publisher", map[string][]string{}, false},
+	}
+	for _, tt := range tests {
+		pm := newPolicyModule("module_a", "1.0.0", tt.args, manifest)
+		if err := policy.Check(pm); (err == nil) != tt.allowed {
+			t.Errorf("%s: allowed %v, got error %v", tt.name, tt.allowed, err)
+		}
+	}
+
+	// Module can't skip signature check by omitting publisher even if rules don't mention it
+	pinned := &Policy{keys: policy.keys}
+	if err := pinned.Check(newPolicyModule("module_a", "1.0.0", map[string][]string{}, manifest)); err == nil ||
+		!strings.Contains(err.Error(), "doesn't declare publisher") {
+		t.Errorf("module without publisher was allowed: %v", err)
+	}
+	if err := pinned.Check(newPolicyModule("module_a", "1.0.0", tests[0].args, manifest)); err != nil {
+		t.Errorf("signed module was rejected: %v", err)
+	}
+
+	// Signature is bound to files content
+	pm := newPolicyModule("module_a", "1.0.0", tests[0].args,
+		getFilesManifest(map[string][]byte{"main.lua": []byte("return 'evil'")}))
+	if err := policy.Check(pm); err == nil {
+		t.Error("signature was accepted for modified files")
+	}
+}
+
+func TestLoadPolicyUntrusted(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() != 0 {
+		t.Skip("policy file should be owned by root")
+	}
+	dir, err := ioutil.TempDir("", "vxagent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		policy interface{}
+		perm   os.FileMode
+	}{
+		{"writable by others", &Policy{}, 0666},
+		{"invalid pattern", &Policy{Allow: []PolicyRule{{Name: "["}}}, 0600},
+		{"invalid publisher key", map[string]interface{}{"publishers": map[string]string{"vxcontrol": "AAAA"}}, 0600},
+		{"invalid json", "policy", 0600},
+	}
+	for _, tt := range tests {
+		policy, err := LoadPolicy(writeTestPolicy(t, dir, tt.policy, tt.perm))
+		if err == nil || policy.Check(policyModule{Name: "module_a"}) == nil {
+			t.Errorf("%s: untrusted policy allowed module", tt.name)
+		}
+	}
+
+	if policy, err := LoadPolicy(filepath.Join(dir, "absent.json")); policy != nil || err != nil {
+		t.Errorf("absent policy file should not restrict modules: %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package mmodule
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// checkPolicyOwner is function which check that policy file owned by root and isn't writable by others
+func checkPolicyOwner(path string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("failed to get owner of the file")
+	}
+	if stat.Uid != 0 {
+		return errors.New("the file isn't owned by root")
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return errors.New("the file is writable by group or others")
+	}
+
+	return nil
+}
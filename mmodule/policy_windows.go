@@ -0,0 +1,85 @@
+//go:build windows
+// +build windows
+
+package mmodule
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// policyAccessAllowedACE is type of access control entry which grants access
+	policyAccessAllowedACE = 0
+	// policyFileWriteData is access right to write data to the file
+	policyFileWriteData = 0x00000002
+	// policyWriteMask is access mask which allows to change the file content or its security
+	policyWriteMask = policyFileWriteData | windows.FILE_APPEND_DATA | windows.WRITE_DAC |
+		windows.WRITE_OWNER | windows.DELETE | windows.GENERIC_WRITE | windows.GENERIC_ALL
+)
+
+// policyACLHeader and policyACEHeader are layouts of ACL and ACCESS_ALLOWED_ACE structures
+type policyACLHeader struct {
+	AclRevision byte
+	Sbz1        byte
+	AclSize     uint16
+	AceCount    uint16
+	Sbz2        uint16
+}
+
+type policyACEHeader struct {
+	AceType  byte
+	AceFlags byte
+	AceSize  uint16
+	Mask     uint32
+	SidStart uint32
+}
+
+var procGetAce = windows.NewLazySystemDLL("advapi32.dll").NewProc("GetAce")
+
+// isPolicyTrustedSid is function which check that SID is system account or administrators group
+func isPolicyTrustedSid(sid *windows.SID) bool {
+	return sid.IsWellKnown(windows.WinLocalSystemSid) || sid.IsWellKnown(windows.WinBuiltinAdministratorsSid)
+}
+
+// checkPolicyOwner is function which check that policy file owned by system or administrators
+// and its DACL doesn't allow writing to other accounts
+func checkPolicyOwner(path string, info os.FileInfo) error {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT,
+		windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return errors.New("failed to get security info of the file: " + err.Error())
+	}
+
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return errors.New("failed to get owner of the file: " + err.Error())
+	}
+	if !isPolicyTrustedSid(owner) {
+		return errors.New("the file isn't owned by system or administrators")
+	}
+
+	dacl, _, err := sd.DACL()
+	if err != nil || dacl == nil {
+		return errors.New("the file doesn't have access control list")
+	}
+	header := (*policyACLHeader)(unsafe.Pointer(dacl))
+	for i := 0; i < int(header.AceCount); i++ {
+		var ace *policyACEHeader
+		if r, _, err := procGetAce.Call(uintptr(unsafe.Pointer(dacl)), uintptr(i),
+			uintptr(unsafe.Pointer(&ace))); r == 0 {
+			return errors.New("failed to read access control entry: " + err.Error())
+		}
+		if ace.AceType != policyAccessAllowedACE || ace.Mask&policyWriteMask == 0 {
+			continue
+		}
+		if sid := (*windows.SID)(unsafe.Pointer(&ace.SidStart)); !isPolicyTrustedSid(sid) {
+			return errors.New("the file is writable by untrusted accounts")
+		}
+	}
+
+	return nil
+}
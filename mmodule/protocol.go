@@ -0,0 +1,322 @@
+package mmodule
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+// The agent extends vxcommon protocol in backward compatible way:
+// new enum values are used only for agents and servers which know them
+// and new fields are stored as unknown fields of existing messages,
+// so old servers skip it on unmarshal.
+//
+// Extended fields of Message message:
+// --------------------------------
+// 101 - request_id (string) is correlation ID of request which is echoed on all responses
+// 102 - encodings (string) is comma separated list of payload encodings which sender is able to decode
+// 103 - encoding (string) is encoding of payload, it's set only for compressed payload
+// 104 - capabilities (string) is comma separated list of extended features which sender supports:
+//       heartbeat - AGENT_PING and AGENT_PONG messages
+//       status_push - STATUS_MODULES_CHANGED message
+// --------------------------------
+//
+// Extended fields of ModuleStatus message:
+// --------------------------------
+// 101 - reason (string) is description why module has extended status
+// 102 - usage (string) is JSON encoded resources usage of module
+// 103 - extended_status (string) is name of extended status (THROTTLED or LIMITED),
+//       standard status field always keeps status of module state in the loader
+// 104 - removed (string) is "true" when module was removed from the agent,
+//       it's set only into STATUS_MODULES_CHANGED, so server should forget the module
+// --------------------------------
+//
+// Reports which are sent as Msg packets (ERROR type) with JSON payload:
+// --------------------------------
+// Agent   -(policy_violation)-> Server
+// Agent   -(version_rejected)-> Server
+// Agent   -(module_limited)-> Server
+// Agent   -(command_error)-> Server
+// --------------------------------
+//
+// Extended types of Message (payload is JSON encoded):
+// --------------------------------
+// Server  -(AGENT_UPGRADE: 101)-> Agent
+// Agent   -(AGENT_UPGRADE_RESULT: 102)-> Server
+// Server  -(FILE_MANIFEST: 103)-> Agent
+// Agent   -(FILE_RESULT: 104)-> Server
+// Server  -(SCRIPT_RUN: 105)-> Agent
+// Agent   -(SCRIPT_RESULT: 106)-> Server
+// Server  -(OUTBOUND_LIMITS: 107)-> Agent
+// Agent   -(OUTBOUND_LIMITS_RESULT: 108)-> Server
+// Agent   <-(AGENT_PING: 109)-> Server
+// Agent   <-(AGENT_PONG: 110)-> Server
+// Agent sends AGENT_PING only to servers which advertised heartbeat capability
+// Agent   -(STATUS_MODULES_CHANGED: 111)-> Server (payload is ModuleStatusList)
+// Agent sends STATUS_MODULES_CHANGED only to servers which advertised status_push capability
+// --------------------------------
+
+// Module arguments which are interpreted by the agent
+const (
+	// policyPublisherArg is name of module argument which contains module publisher
+	policyPublisherArg = "publisher"
+	// policySignatureArg is name of module argument which contains base64 encoded
+	// ed25519 signature of module digest by the publisher key
+	policySignatureArg = "signature"
+	// moduleForceArg is name of module argument which allows module downgrade ("true")
+	moduleForceArg = "force"
+)
+
+// Extended status values of module
+// They are used only inside the agent and sent to server by extended_status field
+const (
+	// moduleStatusThrottled means that module is running but it exceeded own limits
+	moduleStatusThrottled agent.ModuleStatus_Status = 101
+	// moduleStatusLimited means that module was stopped by agent after limits violation
+	moduleStatusLimited agent.ModuleStatus_Status = 102
+)
+
+// getModuleStatusName is function which return name of module status including extended ones
+func getModuleStatusName(status agent.ModuleStatus_Status) string {
+	switch status {
+	case moduleStatusThrottled:
+		return "THROTTLED"
+	case moduleStatusLimited:
+		return "LIMITED"
+	default:
+		return status.String()
+	}
+}
+
+// Extended types of Message
+const (
+	// messageAgentUpgrade is request to replace agent binary by new version
+	messageAgentUpgrade agent.Message_Type = 101
+	// messageAgentUpgradeResult is report about stage of agent binary replacing
+	messageAgentUpgradeResult agent.Message_Type = 102
+	// messageFileManifest is announcement of file which server is going to push to the inbox
+	messageFileManifest agent.Message_Type = 103
+	// messageFileResult is acknowledgement about file received by agent
+	messageFileResult agent.Message_Type = 104
+	// messageScriptRun is request to run ad-hoc lua script in sandboxed state
+	messageScriptRun agent.Message_Type = 105
+	// messageScriptResult is report about ad-hoc lua script execution
+	messageScriptResult agent.Message_Type = 106
+	// messageOutboundLimits is request to restrict rate of traffic from agent to server
+	messageOutboundLimits agent.Message_Type = 107
+	// messageOutboundLimitsResult is report about effective limits of traffic to server
+	messageOutboundLimitsResult agent.Message_Type = 108
+	// messageAgentPing is heartbeat request which is sent by agent or server
+	messageAgentPing agent.Message_Type = 109
+	// messageAgentPong is answer to heartbeat request with payload of the request
+	messageAgentPong agent.Message_Type = 110
+	// messageStatusModulesChanged is unsolicited status of modules which changed it since last report
+	messageStatusModulesChanged agent.Message_Type = 111
+)
+
+// getMessageTypeName is function which return name of message type including extended ones
+func getMessageTypeName(mtype agent.Message_Type) string {
+	switch mtype {
+	case messageAgentUpgrade:
+		return "AGENT_UPGRADE"
+	case messageAgentUpgradeResult:
+		return "AGENT_UPGRADE_RESULT"
+	case messageFileManifest:
+		return "FILE_MANIFEST"
+	case messageFileResult:
+		return "FILE_RESULT"
+	case messageScriptRun:
+		return "SCRIPT_RUN"
+	case messageScriptResult:
+		return "SCRIPT_RESULT"
+	case messageOutboundLimits:
+		return "OUTBOUND_LIMITS"
+	case messageOutboundLimitsResult:
+		return "OUTBOUND_LIMITS_RESULT"
+	case messageAgentPing:
+		return "AGENT_PING"
+	case messageAgentPong:
+		return "AGENT_PONG"
+	case messageStatusModulesChanged:
+		return "STATUS_MODULES_CHANGED"
+	default:
+		return mtype.String()
+	}
+}
+
+// getMessageKeys is function which return dispatcher keys of resources which are affected by the message
+// Keys are names of modules or inbox key, result is empty for read-only queries and messages which can't be parsed
+func getMessageKeys(message *agent.Message) []string {
+	switch message.GetType() {
+	case agent.Message_START_MODULES, agent.Message_STOP_MODULES,
+		agent.Message_UPDATE_MODULES, agent.Message_UPDATE_CONFIG_MODULES:
+	case messageFileManifest:
+		return []string{inboxKey}
+	default:
+		return nil
+	}
+
+	var moduleList agent.ModuleList
+	if err := proto.Unmarshal(message.Payload, &moduleList); err != nil {
+		return nil
+	}
+	var names []string
+	for _, m := range moduleList.GetList() {
+		names = append(names, m.GetName())
+	}
+
+	return names
+}
+
+// Extended field numbers of Message message
+const (
+	fieldMessageRequestID    = 101
+	fieldMessageEncodings    = 102
+	fieldMessageEncoding     = 103
+	fieldMessageCapabilities = 104
+)
+
+// Capabilities of extended features which are advertised by agent and server
+const (
+	// capabilityHeartbeat means that the peer answers AGENT_PING by AGENT_PONG
+	capabilityHeartbeat = "heartbeat"
+	// capabilityStatusPush means that the peer handles STATUS_MODULES_CHANGED
+	capabilityStatusPush = "status_push"
+)
+
+// supportedCapabilities is list of extended features which the agent supports
+var supportedCapabilities = []string{capabilityHeartbeat, capabilityStatusPush}
+
+// peerFeatures is struct which keeps list of extended field values advertised by connected servers
+// Server advertises the list in every message, so it's known after the first command
+// on the connection and it's forgotten when the connection is closed
+type peerFeatures struct {
+	field uint64
+	list  map[string][]string
+	mutex *sync.Mutex
+}
+
+// newPeerFeatures is function which constructed peerFeatures object for the extended field
+func newPeerFeatures(field uint64) *peerFeatures {
+	return &peerFeatures{
+		field: field,
+		list:  make(map[string][]string),
+		mutex: &sync.Mutex{},
+	}
+}
+
+// set is function which store values which are advertised by server into the message
+func (pf *peerFeatures) set(src string, message *agent.Message) {
+	value, ok := getUnknownString(message.XXX_unrecognized, pf.field)
+	if !ok {
+		return
+	}
+
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	pf.list[src] = strings.Split(value, ",")
+}
+
+// del is function which forget values of disconnected server
+func (pf *peerFeatures) del(src string) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	delete(pf.list, src)
+}
+
+// has is function which check that server advertised the value
+func (pf *peerFeatures) has(src, value string) bool {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	for _, v := range pf.list[src] {
+		if strings.TrimSpace(v) == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Extended field numbers of ModuleStatus message
+const (
+	fieldModuleStatusReason   = 101
+	fieldModuleStatusUsage    = 102
+	fieldModuleStatusExtended = 103
+	fieldModuleStatusRemoved  = 104
+)
+
+// Types of reports which are sent as Msg packets
+const (
+	reportPolicyViolation = "policy_violation"
+	reportVersionRejected = "version_rejected"
+	reportModuleLimited   = "module_limited"
+	reportCommandError    = "command_error"
+)
+
+// moduleReport is struct of report about module which was rejected by agent
+type moduleReport struct {
+	Type      string       `json:"type"`
+	Command   string       `json:"command"`
+	RequestID string       `json:"request_id,omitempty"`
+	Module    policyModule `json:"module"`
+	Reason    string       `json:"reason"`
+}
+
+// commandReport is struct of report about command which was failed by agent
+// Command is name of request type, it's UNKNOWN if the request can't be parsed
+type commandReport struct {
+	Type      string        `json:"type"`
+	Command   string        `json:"command"`
+	RequestID string        `json:"request_id,omitempty"`
+	Code      string        `json:"code"`
+	Message   string        `json:"message"`
+	Modules   []moduleError `json:"modules,omitempty"`
+}
+
+// appendUnknownString is function which encode string field to raw protobuf bytes
+func appendUnknownString(raw []byte, field uint64, value string) []byte {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeVarint(field<<3 | proto.WireBytes)
+	buf.EncodeStringBytes(value)
+
+	return append(raw, buf.Bytes()...)
+}
+
+// getUnknownString is function which decode string field from raw protobuf bytes
+// Result is last value of this field and flag that the field was found
+func getUnknownString(raw []byte, field uint64) (string, bool) {
+	var value string
+	var found bool
+	buf := proto.NewBuffer(raw)
+	for {
+		key, err := buf.DecodeVarint()
+		if err != nil {
+			break
+		}
+		switch key & 7 {
+		case proto.WireVarint:
+			_, err = buf.DecodeVarint()
+		case proto.WireFixed64:
+			_, err = buf.DecodeFixed64()
+		case proto.WireFixed32:
+			_, err = buf.DecodeFixed32()
+		case proto.WireBytes:
+			var data []byte
+			if data, err = buf.DecodeRawBytes(true); err == nil && key>>3 == field {
+				value, found = string(data), true
+			}
+		default:
+			return value, found
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	return value, found
+}
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package mmodule
+
+// raceEnabled is flag that tests are built with race detector
+const raceEnabled = true
@@ -0,0 +1,531 @@
+package mmodule
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/loader"
+)
+
+// moduleEntry is struct which contains consistent snapshot of one registered module
+type moduleEntry struct {
+	ID     string
+	Config *loader.ModuleConfig
+	State  *loader.ModuleState
+	Status agent.ModuleStatus_Status
+}
+
+// shutdownReport is struct which contains result of modules stopping on registry closing
+type shutdownReport struct {
+	// Stopped is list of modules which stopped and released in time
+	Stopped []string
+	// Forced is list of modules which were abandoned after stop deadline
+	Forced []string
+}
+
+// moduleConfigItem is thread safe config item of module
+// Lua state binds methods of the item on creation, so the item is updated in place
+type moduleConfigItem struct {
+	item  loader.ModuleConfigItem
+	mutex *sync.RWMutex
+}
+
+// newModuleConfigItem is function which constructed moduleConfigItem object
+func newModuleConfigItem(item loader.ModuleConfigItem) *moduleConfigItem {
+	return &moduleConfigItem{
+		item:  item,
+		mutex: &sync.RWMutex{},
+	}
+}
+
+// get is internal function which return copy of config item
+func (mci *moduleConfigItem) get() loader.ModuleConfigItem {
+	mci.mutex.RLock()
+	defer mci.mutex.RUnlock()
+
+	return mci.item
+}
+
+// set is internal function which replace config item by new one
+func (mci *moduleConfigItem) set(item loader.ModuleConfigItem) {
+	mci.mutex.Lock()
+	defer mci.mutex.Unlock()
+
+	mci.item = item
+}
+
+// GetConfigSchema is function which return schema module config
+func (mci *moduleConfigItem) GetConfigSchema() string {
+	return mci.get().ConfigSchema
+}
+
+// GetDefaultConfig is function which return default module config
+func (mci *moduleConfigItem) GetDefaultConfig() string {
+	return mci.get().DefaultConfig
+}
+
+// GetCurrentConfig is function which return current module config
+func (mci *moduleConfigItem) GetCurrentConfig() string {
+	return mci.get().CurrentConfig
+}
+
+// SetCurrentConfig is function which store current module config from lua state
+func (mci *moduleConfigItem) SetCurrentConfig(config string) bool {
+	mci.mutex.Lock()
+	defer mci.mutex.Unlock()
+
+	mci.item.CurrentConfig = config
+	return true
+}
+
+// GetEventDataSchema is function which return schema of events data
+func (mci *moduleConfigItem) GetEventDataSchema() string {
+	return mci.get().EventDataSchema
+}
+
+// GetEventConfigSchema is function which return schema of events config
+func (mci *moduleConfigItem) GetEventConfigSchema() string {
+	return mci.get().EventConfigSchema
+}
+
+// GetDefaultEventConfig is function which return default events config
+func (mci *moduleConfigItem) GetDefaultEventConfig() string {
+	return mci.get().DefaultEventConfig
+}
+
+// GetCurrentEventConfig is function which return current events config
+func (mci *moduleConfigItem) GetCurrentEventConfig() string {
+	return mci.get().CurrentEventConfig
+}
+
+// getConfigItem is function which return copy of config item values
+func getConfigItem(ci loader.IConfigItem) loader.ModuleConfigItem {
+	if mci, ok := ci.(*moduleConfigItem); ok {
+		return mci.get()
+	}
+
+	return loader.ModuleConfigItem{
+		ConfigSchema:       ci.GetConfigSchema(),
+		DefaultConfig:      ci.GetDefaultConfig(),
+		CurrentConfig:      ci.GetCurrentConfig(),
+		EventDataSchema:    ci.GetEventDataSchema(),
+		EventConfigSchema:  ci.GetEventConfigSchema(),
+		DefaultEventConfig: ci.GetDefaultEventConfig(),
+		CurrentEventConfig: ci.GetCurrentEventConfig(),
+	}
+}
+
+// copyModuleConfig is function which return copy of module config
+// with config item values which don't change after it
+func copyModuleConfig(mc *loader.ModuleConfig) *loader.ModuleConfig {
+	cmc := *mc
+	mci := getConfigItem(mc.IConfigItem)
+	cmc.IConfigItem = &mci
+
+	return &cmc
+}
+
+// moduleRegistry is struct which keeps loader states and modules configs in sync
+// All membership changes are applied to both of them under one lock,
+// so readers never see module state without config and vice versa
+// Module start and stop are executed without the lock, the module is marked
+// as busy during it and other commands for the module are rejected
+// Modules abandoned on closing are kept into loader until their stopping is done
+type moduleRegistry struct {
+	loader    loader.ILoader
+	configs   map[string]*loader.ModuleConfig
+	busy      map[string]chan struct{}
+	abandoned map[string]struct{}
+	closed    bool
+	mutex     *sync.RWMutex
+}
+
+// newRegistry is function which constructed moduleRegistry object over the loader
+func newRegistry(l loader.ILoader) *moduleRegistry {
+	return &moduleRegistry{
+		loader:    l,
+		configs:   make(map[string]*loader.ModuleConfig),
+		busy:      make(map[string]chan struct{}),
+		abandoned: make(map[string]struct{}),
+		mutex:     &sync.RWMutex{},
+	}
+}
+
+// get is internal function which return module state if it has registered config
+// Abandoned modules are kept into loader without config and they are hidden here
+func (r *moduleRegistry) get(id string) *loader.ModuleState {
+	if _, ok := r.configs[id]; !ok {
+		return nil
+	}
+
+	return r.loader.Get(id)
+}
+
+// acquire is internal function which mark registered module as busy
+// Result is module state which can be started or stopped without the lock
+func (r *moduleRegistry) acquire(id string) (*loader.ModuleState, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ms := r.get(id)
+	if ms == nil {
+		return nil, newCommandError(errCodeNotFound, "module "+id+" not found")
+	}
+	if _, ok := r.busy[id]; ok {
+		return nil, newCommandError(errCodeConflict, "module "+id+" is busy by other command")
+	}
+	r.busy[id] = make(chan struct{})
+
+	return ms, nil
+}
+
+// release is internal function which mark module as free after acquire
+func (r *moduleRegistry) release(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if done, ok := r.busy[id]; ok {
+		close(done)
+		delete(r.busy, id)
+	}
+}
+
+// Add is function which register module state and its config
+func (r *moduleRegistry) Add(id string, mc *loader.ModuleConfig, ms *loader.ModuleState) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return errors.New("modules registry is closed")
+	}
+	if _, ok := r.abandoned[id]; ok {
+		return newCommandError(errCodeConflict, "module "+id+" was abandoned on stopping and it isn't released yet")
+	}
+	if _, ok := r.configs[id]; ok || r.loader.Get(id) != nil {
+		return newCommandError(errCodeConflict, "module "+id+" already exists")
+	}
+	if !r.loader.Add(id, ms) {
+		return errors.New("failed add module " + id + " to loader")
+	}
+	r.configs[id] = mc
+
+	return nil
+}
+
+// Del is function which release module state and unregister it with its config
+// Loader can't close module which wasn't started, so loaded module is stopped before
+// Result is config of deleted module
+func (r *moduleRegistry) Del(id string) (*loader.ModuleConfig, error) {
+	ms, err := r.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	defer r.release(id)
+
+	if ms.GetStatus() == agent.ModuleStatus_LOADED {
+		if err := ms.Stop(); err != nil {
+			return nil, errors.New("failed stop loaded module " + id + ": " + err.Error())
+		}
+	}
+	if !r.loader.Del(id) {
+		return nil, errors.New("failed delete module " + id + " from loader")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	mc := r.configs[id]
+	delete(r.configs, id)
+
+	return mc, nil
+}
+
+// Get is function which return module state and config by module id
+func (r *moduleRegistry) Get(id string) (*loader.ModuleState, *loader.ModuleConfig) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	ms := r.get(id)
+	if ms == nil {
+		return nil, nil
+	}
+
+	return ms, r.configs[id]
+}
+
+// GetConfig is function which return module config by module id
+func (r *moduleRegistry) GetConfig(id string) *loader.ModuleConfig {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.configs[id]
+}
+
+// UpdateConfig is function which apply config item of new module config to current one
+// Lua state keeps reference to the current config item, so it is changed in place
+func (r *moduleRegistry) UpdateConfig(id string, mc *loader.ModuleConfig) (*loader.ModuleState, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ms := r.get(id)
+	if ms == nil {
+		return nil, newCommandError(errCodeNotFound, "module "+id+" not found")
+	}
+
+	if rmc, ok := r.configs[id]; ok {
+		if omc, ok := rmc.IConfigItem.(*moduleConfigItem); ok {
+			omc.set(getConfigItem(mc.IConfigItem))
+			mc.IConfigItem = omc
+		}
+	}
+	r.configs[id] = mc
+
+	return ms, nil
+}
+
+// Start is function which run registered module
+func (r *moduleRegistry) Start(id string) error {
+	ms, err := r.acquire(id)
+	if err != nil {
+		return err
+	}
+	defer r.release(id)
+
+	return ms.Start()
+}
+
+// hasStopRequired is function which check that module should be stopped before release
+// Module could be stopped before by limits or policy so it doesn't need to stop again
+func hasStopRequired(ms *loader.ModuleState) bool {
+	switch ms.GetStatus() {
+	case agent.ModuleStatus_LOADED, agent.ModuleStatus_RUNNING:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop is function which stop registered module if it is loaded or running
+// Module state is stopped directly because loader keeps its lock while module is stopping
+// and one hung module would block all other ones
+func (r *moduleRegistry) Stop(id string) error {
+	ms, err := r.acquire(id)
+	if err != nil {
+		return err
+	}
+	defer r.release(id)
+
+	if !hasStopRequired(ms) {
+		return nil
+	}
+
+	return ms.Stop()
+}
+
+// List is function which return sorted list of registered modules id
+func (r *moduleRegistry) List() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	list := make([]string, 0, len(r.configs))
+	for _, id := range r.loader.List() {
+		if _, ok := r.configs[id]; ok {
+			list = append(list, id)
+		}
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// Snapshot is function which return consistent list of registered modules
+// Only modules which have both state and config are included,
+// configs are copied so they can be read after registry changing
+func (r *moduleRegistry) Snapshot() []moduleEntry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	list := r.loader.List()
+	sort.Strings(list)
+	entries := make([]moduleEntry, 0, len(list))
+	for _, id := range list {
+		ms := r.loader.Get(id)
+		mc, ok := r.configs[id]
+		if ms == nil || !ok {
+			continue
+		}
+		entries = append(entries, moduleEntry{
+			ID:     id,
+			Config: copyModuleConfig(mc),
+			State:  ms,
+			Status: ms.GetStatus(),
+		})
+	}
+
+	return entries
+}
+
+// Open is function which allow modules registration after registry closing
+func (r *moduleRegistry) Open() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = false
+}
+
+// stopState is function which run stopping of module state in background
+// Result channel gets error of stopping when the module is stopped
+// Module state is stopped directly because loader keeps its lock while module is stopping
+// and one hung module would block all other ones
+func stopState(ms *loader.ModuleState) <-chan error {
+	errc := make(chan error, 1)
+	if !hasStopRequired(ms) {
+		errc <- nil
+		return errc
+	}
+
+	go func() {
+		errc <- ms.Stop()
+	}()
+
+	return errc
+}
+
+// acquireWait is internal function which mark module as busy and wait other command if needed
+// Result is nil state without error if module was removed while waiting
+func (r *moduleRegistry) acquireWait(ctx context.Context, id string) (*loader.ModuleState, error) {
+	for {
+		r.mutex.Lock()
+		ms := r.get(id)
+		if ms == nil {
+			delete(r.configs, id)
+			r.mutex.Unlock()
+			return nil, nil
+		}
+		done, ok := r.busy[id]
+		if !ok {
+			r.busy[id] = make(chan struct{})
+			r.mutex.Unlock()
+			return ms, nil
+		}
+		r.mutex.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close is function which stop and release all registered modules
+// and deny registration of new ones until the registry will be opened
+// Each module has own stop timeout limited by the context deadline,
+// modules which didn't stop in time are abandoned and listed as forced into the report
+func (r *moduleRegistry) Close(ctx context.Context, timeout time.Duration) (*shutdownReport, error) {
+	r.mutex.Lock()
+	r.closed = true
+	ids := make([]string, 0, len(r.configs))
+	for id := range r.configs {
+		ids = append(ids, id)
+	}
+	r.mutex.Unlock()
+	sort.Strings(ids)
+
+	var errs []string
+	report := &shutdownReport{}
+	for _, id := range ids {
+		stopCtx, cancel := context.WithTimeout(ctx, timeout)
+		ms, err := r.acquireWait(stopCtx, id)
+		if err == nil && ms == nil {
+			// The module was removed by other command
+			cancel()
+			continue
+		}
+		if err != nil {
+			// Other command didn't release the module in time
+			cancel()
+			report.Forced = append(report.Forced, id)
+			r.abandon(id, nil)
+			continue
+		}
+
+		errc := stopState(ms)
+		select {
+		case err = <-errc:
+		case <-stopCtx.Done():
+			cancel()
+			report.Forced = append(report.Forced, id)
+			r.abandon(id, errc)
+			continue
+		}
+		cancel()
+
+		if err != nil {
+			errs = append(errs, "module "+id+" didn't stop: "+err.Error())
+		}
+		if !r.loader.Del(id) {
+			errs = append(errs, "failed delete module "+id+" from loader")
+		}
+		report.Stopped = append(report.Stopped, id)
+		r.mutex.Lock()
+		delete(r.configs, id)
+		r.mutex.Unlock()
+		r.release(id)
+	}
+
+	if len(errs) != 0 {
+		return report, errors.New(strings.Join(errs, " | "))
+	}
+
+	return report, nil
+}
+
+// abandon is internal function which unregister config of module which didn't stop in time
+// and release its state from loader in background when the module will be stopped
+// Nil stopping channel means that the module is busy by other command and it should be stopped after that
+func (r *moduleRegistry) abandon(id string, errc <-chan error) {
+	r.mutex.Lock()
+	delete(r.configs, id)
+	r.abandoned[id] = struct{}{}
+	done := r.busy[id]
+	r.mutex.Unlock()
+
+	go func() {
+		logger := logrus.WithFields(logrus.Fields{
+			"module": "main",
+			"id":     id,
+		})
+		if errc == nil {
+			if done != nil {
+				<-done
+			}
+			// Module config is deleted so other commands can't acquire it anymore
+			r.mutex.Lock()
+			r.busy[id] = make(chan struct{})
+			r.mutex.Unlock()
+			if ms := r.loader.Get(id); ms != nil {
+				errc = stopState(ms)
+			}
+		}
+		if errc != nil {
+			if err := <-errc; err != nil {
+				logger.WithError(err).Warn("vxagent: abandoned module stopped with error")
+			}
+		}
+		if !r.loader.Del(id) {
+			logger.Warn("vxagent: failed delete abandoned module from loader")
+		}
+
+		r.mutex.Lock()
+		delete(r.abandoned, id)
+		r.mutex.Unlock()
+		r.release(id)
+		logger.Info("vxagent: abandoned module was released")
+	}()
+}
@@ -0,0 +1,405 @@
+package mmodule
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vxcontrol/luar"
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/loader"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+// fakeLoader is loader implementation without lua states for registry testing
+type fakeLoader struct {
+	states map[string]*loader.ModuleState
+	mutex  sync.Mutex
+}
+
+func newFakeLoader() *fakeLoader {
+	return &fakeLoader{states: make(map[string]*loader.ModuleState)}
+}
+
+func (l *fakeLoader) Add(id string, ms *loader.ModuleState) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.states[id]; ok {
+		return false
+	}
+	l.states[id] = ms
+	return true
+}
+
+func (l *fakeLoader) Del(id string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.states[id]; !ok {
+		return false
+	}
+	delete(l.states, id)
+	return true
+}
+
+func (l *fakeLoader) Get(id string) *loader.ModuleState {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.states[id]
+}
+
+func (l *fakeLoader) List() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var list []string
+	for id := range l.states {
+		list = append(list, id)
+	}
+	return list
+}
+
+func (l *fakeLoader) Start(id string) error { return nil }
+func (l *fakeLoader) StartAll() error       { return nil }
+func (l *fakeLoader) Stop(id string) error  { return nil }
+func (l *fakeLoader) StopAll() error        { return nil }
+
+func newTestModuleConfig(id, version string) *loader.ModuleConfig {
+	return &loader.ModuleConfig{
+		Name:    id,
+		Version: version,
+		IConfigItem: newModuleConfigItem(loader.ModuleConfigItem{
+			CurrentConfig: "{}",
+		}),
+	}
+}
+
+func newTestMainModule(t *testing.T) (*MainModule, func()) {
+	dataDir, err := ioutil.TempDir("", "vxagent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mm := New("ws://localhost:8080", "test", dataDir, nil)
+	if mm == nil {
+		os.RemoveAll(dataDir)
+		t.Fatal("failed to create main module")
+	}
+	mm.registry = newRegistry(newFakeLoader())
+
+	return mm, func() { os.RemoveAll(dataDir) }
+}
+
+func TestRegistrySnapshotConsistency(t *testing.T) {
+	r := newRegistry(newFakeLoader())
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := fmt.Sprintf("module_%d_%d", w, i%10)
+				if err := r.Add(id, newTestModuleConfig(id, "1.0.0"), &loader.ModuleState{}); err == nil {
+					r.UpdateConfig(id, newTestModuleConfig(id, "1.0.1"))
+					r.Stop(id)
+					r.Del(id)
+				}
+			}
+		}(w)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			for _, entry := range r.Snapshot() {
+				if entry.Config == nil || entry.State == nil || entry.Config.Name != entry.ID {
+					t.Errorf("inconsistent registry entry %s", entry.ID)
+				}
+				if entry.Config.GetCurrentConfig() == "" {
+					t.Errorf("registry entry %s has empty config", entry.ID)
+				}
+			}
+		}
+	}()
+	wg.Wait()
+
+	if list := r.List(); len(list) != 0 {
+		t.Errorf("registry should be empty, got %v", list)
+	}
+}
+
+func TestRegistryCloseRejectsNewModules(t *testing.T) {
+	r := newRegistry(newFakeLoader())
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id := fmt.Sprintf("module_%d_%d", w, i)
+				r.Add(id, newTestModuleConfig(id, "1.0.0"), &loader.ModuleState{})
+			}
+		}(w)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := r.Close(context.Background(), time.Second); err != nil {
+			t.Errorf("failed to close registry: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	// Modules added before closing were released by Close
+	if _, err := r.Close(context.Background(), time.Second); err != nil {
+		t.Fatalf("failed to close registry: %v", err)
+	}
+	if list := r.List(); len(list) != 0 {
+		t.Errorf("registry should be empty after closing, got %v", list)
+	}
+	if err := r.Add("module", newTestModuleConfig("module", "1.0.0"), &loader.ModuleState{}); err == nil {
+		t.Error("closed registry should reject new modules")
+	}
+
+	r.Open()
+	if err := r.Add("module", newTestModuleConfig("module", "1.0.0"), &loader.ModuleState{}); err != nil {
+		t.Errorf("opened registry should accept new modules: %v", err)
+	}
+}
+
+func TestMainModuleConcurrentCommandsAndShutdown(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	var list agent.ModuleList
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("module_%d", i)
+		if err := mm.registry.Add(id, newTestModuleConfig(id, "1.0.0"), &loader.ModuleState{}); err != nil {
+			t.Fatal(err)
+		}
+		list.List = append(list.List, &agent.Module{Name: proto.String(id)})
+	}
+	data, err := proto.Marshal(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		// The socket isn't initialized so only status sending fails here
+		mm.serveStopModules(newRequest("", "", "STOP_MODULES"), data)
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			for _, ms := range mm.getStatusModules().GetList() {
+				if ms.GetName() == "" || ms.GetConfig().GetName() != ms.GetName() {
+					t.Errorf("inconsistent module status %v", ms)
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := mm.registry.Close(context.Background(), time.Second); err != nil {
+			t.Errorf("failed to close registry: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	if n := len(mm.getStatusModules().GetList()); n != 0 {
+		t.Errorf("all modules should be released, got %d", n)
+	}
+}
+
+// newTestHungModuleState is function which create lua state of module which doesn't stop
+// until release function will be called
+func newTestHungModuleState(t *testing.T, p vxproto.IVXProto, mc *loader.ModuleConfig) (*loader.ModuleState, func() error, func()) {
+	ms, start := newTestModuleState(t, p, mc, `__hang.wait() return "done"`)
+	hang := make(chan struct{})
+	luar.Register(ms.GetState().L, "__hang", luar.Map{
+		"wait": func() { <-hang },
+	})
+	var once sync.Once
+	return ms, start, func() { once.Do(func() { close(hang) }) }
+}
+
+func TestRegistryHungStopDoesNotBlock(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	p := vxproto.New(mm)
+	r := newRegistry(loader.New())
+
+	hmc := newTestModuleConfig("module_hung", "1.0.0")
+	hms, hstart, release := newTestHungModuleState(t, p, hmc)
+	defer release()
+	mc := newTestModuleConfig("module_a", "1.0.0")
+	ms, start := newTestModuleState(t, p, mc, `__api.await(-1) return "done"`)
+	if err := r.Add("module_hung", hmc, hms); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("module_a", mc, ms); err != nil {
+		t.Fatal(err)
+	}
+	if err := hstart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := start(); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- r.Stop("module_hung")
+	}()
+	waitCondition(t, 5*time.Second, "module wasn't marked as busy", func() bool {
+		r.mutex.RLock()
+		defer r.mutex.RUnlock()
+		_, ok := r.busy["module_hung"]
+		return ok
+	})
+	if err := r.Stop("module_hung"); getCommandError(err).Code != errCodeConflict {
+		t.Fatalf("busy module should be rejected with conflict: %v", err)
+	}
+
+	// Other modules are available while one module is stopping
+	if entries := r.Snapshot(); len(entries) != 2 {
+		t.Fatalf("unexpected registry snapshot %v", entries)
+	}
+	if err := r.Stop("module_a"); err != nil {
+		t.Fatal(err)
+	}
+
+	begin := time.Now()
+	report, err := r.Close(context.Background(), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(begin) > 2*time.Second {
+		t.Fatalf("registry closing took %s", time.Since(begin))
+	}
+	if len(report.Forced) != 1 || report.Forced[0] != "module_hung" {
+		t.Fatalf("unexpected forced modules %v", report.Forced)
+	}
+	if len(report.Stopped) != 1 || report.Stopped[0] != "module_a" {
+		t.Fatalf("unexpected stopped modules %v", report.Stopped)
+	}
+
+	release()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hung module wasn't stopped after release")
+	}
+}
+
+func TestRegistrySnapshotConfigCopy(t *testing.T) {
+	r := newRegistry(newFakeLoader())
+
+	mc := newTestModuleConfig("module_a", "1.0.0")
+	if err := r.Add("module_a", mc, &loader.ModuleState{}); err != nil {
+		t.Fatal(err)
+	}
+	entries := r.Snapshot()
+
+	nmc := newTestModuleConfig("module_a", "1.0.0")
+	nmc.IConfigItem = newModuleConfigItem(loader.ModuleConfigItem{CurrentConfig: `{"key": "value"}`})
+	if _, err := r.UpdateConfig("module_a", nmc); err != nil {
+		t.Fatal(err)
+	}
+
+	if config := entries[0].Config.GetCurrentConfig(); config != "{}" {
+		t.Fatalf("snapshot config was changed to %s", config)
+	}
+	// Lua state keeps the first config item so it should be updated in place
+	if config := mc.GetCurrentConfig(); config != `{"key": "value"}` {
+		t.Fatalf("module config item wasn't updated: %s", config)
+	}
+	if config := r.Snapshot()[0].Config.GetCurrentConfig(); config != `{"key": "value"}` {
+		t.Fatalf("unexpected config %s", config)
+	}
+}
+
+func TestRegistryReleaseAbandonedModule(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	r := newRegistry(loader.New())
+
+	mc := newTestModuleConfig("module_hung", "1.0.0")
+	ms, start, release := newTestHungModuleState(t, vxproto.New(mm), mc)
+	defer release()
+	if err := r.Add("module_hung", mc, ms); err != nil {
+		t.Fatal(err)
+	}
+	if err := start(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := r.Close(context.Background(), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Forced) != 1 || report.Forced[0] != "module_hung" {
+		t.Fatalf("unexpected forced modules %v", report.Forced)
+	}
+
+	// New version of abandoned module is rejected while the old one is stopping
+	r.Open()
+	if err := r.Add("module_hung", newTestModuleConfig("module_hung", "1.0.1"), &loader.ModuleState{}); err == nil {
+		t.Fatal("abandoned module was replaced before releasing")
+	} else if code := getCommandError(err).Code; code != errCodeConflict {
+		t.Fatalf("unexpected error code %s", code)
+	}
+	if list := r.List(); len(list) != 0 {
+		t.Fatalf("abandoned module is listed %v", list)
+	}
+
+	release()
+	waitCondition(t, 5*time.Second, "abandoned module wasn't released", func() bool {
+		return r.Add("module_hung", newTestModuleConfig("module_hung", "1.0.1"), &loader.ModuleState{}) == nil
+	})
+}
+
+func TestRegistryReleaseAbandonedBusyModule(t *testing.T) {
+	l := newFakeLoader()
+	r := newRegistry(l)
+	if err := r.Add("module_a", newTestModuleConfig("module_a", "1.0.0"), &loader.ModuleState{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other command holds the module during registry closing
+	if _, err := r.acquire("module_a"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := r.Close(context.Background(), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Forced) != 1 || report.Forced[0] != "module_a" {
+		t.Fatalf("unexpected forced modules %v", report.Forced)
+	}
+	if l.Get("module_a") == nil {
+		t.Fatal("busy module was deleted from loader")
+	}
+
+	r.release("module_a")
+	waitCondition(t, 5*time.Second, "abandoned module wasn't deleted from loader", func() bool {
+		return l.Get("module_a") == nil
+	})
+	r.Open()
+	waitCondition(t, 5*time.Second, "abandoned module wasn't released", func() bool {
+		return r.Add("module_a", newTestModuleConfig("module_a", "1.0.1"), &loader.ModuleState{}) == nil
+	})
+}
@@ -0,0 +1,58 @@
+package mmodule
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+// request is struct which describes server command in progress
+// ID is correlation ID which is echoed on all responses, it's empty if server didn't set it
+// Empty src means that responses are sent to all connected servers
+type request struct {
+	src     string
+	id      string
+	command string
+	logger  *logrus.Entry
+}
+
+// newRequest is function which constructed request object with logger for the command
+func newRequest(src, id, command string) *request {
+	fields := logrus.Fields{
+		"module": "main",
+	}
+	if src != "" {
+		fields["src"] = src
+	}
+	if command != "" {
+		fields["command"] = command
+	}
+	if id != "" {
+		fields["request_id"] = id
+	}
+
+	return &request{
+		src:     src,
+		id:      id,
+		command: command,
+		logger:  logrus.WithFields(fields),
+	}
+}
+
+// getRequest is function which constructed request object from message of server
+func getRequest(src string, message *agent.Message) *request {
+	id, _ := getUnknownString(message.XXX_unrecognized, fieldMessageRequestID)
+	return newRequest(src, id, getMessageTypeName(message.GetType()))
+}
+
+// newMessage is function which constructed message to server with correlation ID of the request
+func (r *request) newMessage(msgType agent.Message_Type, payload []byte) *agent.Message {
+	message := &agent.Message{
+		Type:    msgType.Enum(),
+		Payload: payload,
+	}
+	if r.id != "" {
+		message.XXX_unrecognized = appendUnknownString(nil, fieldMessageRequestID, r.id)
+	}
+
+	return message
+}
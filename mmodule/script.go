@@ -0,0 +1,304 @@
+package mmodule
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/golua/lua"
+)
+
+// scriptHookInstructions is amount of lua instructions between checks of script limits
+const scriptHookInstructions = 1000
+
+// scriptPatternSteps is maximum estimated amount of matching steps of one pattern function call
+// Pattern matching is executed by C code without hooks calls, so its time is bounded by the estimation
+const scriptPatternSteps = 1e8
+
+// Reasons of script interruption which are returned by limit function to the sandbox
+const (
+	scriptLimitTimeout  = 1
+	scriptLimitStopping = 2
+)
+
+// Statuses of ad-hoc script execution which are reported to server
+const (
+	scriptStatusOK    = "ok"
+	scriptStatusError = "error"
+)
+
+// scriptSandboxLua is lua code which restricts global environment and runs the script
+// Limits are checked by count hook, so JIT is disabled to call the hook from any code
+// and functions which can break the sandbox or catch limits errors are removed.
+// Heap size is limited by allocator of the state, the hook collects garbage before reaching it.
+// Pattern functions estimate matching complexity before the call because the hook isn't called inside it.
+const scriptSandboxLua = `
+local script, memory, hook, steps = __script, __memory, __hook, __steps
+local limit, write, maxResult = __limit, __write, __max_result
+local sethook, collect, loadstring = debug.sethook, collectgarbage, loadstring
+local tostring, tonumber, select, error = tostring, tonumber, select, error
+local concat, rep, byte, sub = table.concat, string.rep, string.byte, string.sub
+local find, match, gmatch, gsub = string.find, string.match, string.gmatch, string.gsub
+
+if jit then
+	jit.off()
+end
+for _, name in ipairs({
+	"__script", "__memory", "__hook", "__steps", "__limit", "__write", "__max_result",
+	"io", "os", "debug", "package", "require", "module", "ffi", "jit",
+	"dofile", "loadfile", "load", "loadstring", "getfenv", "setfenv", "newproxy",
+	"coroutine", "collectgarbage", "gcinfo", "pcall", "xpcall", "unsafe_pcall", "unsafe_xpcall",
+}) do
+	_G[name] = nil
+end
+string.dump = nil
+
+local function pack(...)
+	local values = {}
+	for i = 1, select("#", ...) do
+		values[i] = tostring((select(i, ...)))
+	end
+	return concat(values, "\t")
+end
+
+-- getPatternItems returns amount of pattern items with quantifiers which cause backtracking
+local function getPatternItems(p)
+	local items, i, n = 0, 1, #p
+	while i <= n do
+		local c = byte(p, i)
+		if c == 37 then
+			-- %bxy is balanced match, other escapes are single class
+			i = i + (byte(p, i + 1) == 98 and 4 or 2)
+		elseif c == 91 then
+			-- first ] of the set is literal
+			i = i + 1
+			if byte(p, i) == 94 then
+				i = i + 1
+			end
+			repeat
+				if byte(p, i) == 37 then
+					i = i + 1
+				end
+				i = i + 1
+			until i > n or byte(p, i) == 93
+			i = i + 1
+		else
+			i = i + 1
+		end
+		local q = byte(p, i)
+		if q == 42 or q == 43 or q == 45 or q == 63 then
+			items, i = items + 1, i + 1
+		end
+	end
+	return items
+end
+
+-- checkPattern raises error if matching can exceed steps limit in the worst case
+-- Any search compares pattern at each position of subject, items with quantifiers also backtrack
+local function checkPattern(s, p, plain)
+	local size, pattern = #tostring(s), tostring(p)
+	local items = plain and 0 or getPatternItems(pattern)
+	if size * (#pattern + 1) > steps or (items ~= 0 and size ^ (items + 1) > steps) then
+		error("pattern is too complex for subject size, use shorter pattern or subject", 0)
+	end
+end
+
+string.find = function(s, p, init, plain)
+	checkPattern(s, p, plain)
+	return find(s, p, init, plain)
+end
+string.match = function(s, p, ...)
+	checkPattern(s, p)
+	return match(s, p, ...)
+end
+string.gmatch = function(s, p)
+	checkPattern(s, p)
+	return gmatch(s, p)
+end
+string.gsub = function(s, p, ...)
+	checkPattern(s, p)
+	return gsub(s, p, ...)
+end
+string.rep = function(s, n, sep)
+	local size = #tostring(s)
+	if sep ~= nil then
+		size = size + #tostring(sep)
+	end
+	if size * (tonumber(n) or 0) > memory then
+		error("memory limit exceeded", 0)
+	end
+	return rep(s, n, sep)
+end
+print = function(...)
+	write(pack(...) .. "\n")
+end
+
+local chunk, err = loadstring(script, "=script")
+if not chunk then
+	error(err, 0)
+end
+
+sethook(function()
+	if collect("count") * 1024 > memory * 0.75 then
+		collect("collect")
+	end
+	local reason = limit()
+	if reason == 1 then
+		error("time limit exceeded", 0)
+	elseif reason == 2 then
+		error("main module is stopping", 0)
+	end
+end, "", hook)
+
+return sub(pack(chunk()), 1, maxResult + 1)
+`
+
+// scriptRequest is struct of request to run ad-hoc lua script
+// Timeout is in milliseconds, it can't exceed local limit and zero value means local limit
+type scriptRequest struct {
+	Script  string `json:"script"`
+	Timeout int64  `json:"timeout,omitempty"`
+}
+
+// scriptResult is struct of report about ad-hoc lua script execution
+// Truncated is flag that stdout or result was cut by output limit
+type scriptResult struct {
+	Status    string `json:"status"`
+	Stdout    string `json:"stdout"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Result    string `json:"result,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Duration  int64  `json:"duration"`
+}
+
+// scriptOutput is struct which collects printed output of the script up to limit
+type scriptOutput struct {
+	data      strings.Builder
+	limit     int
+	truncated bool
+}
+
+// write is function which append text to the output and cut it by limit
+func (so *scriptOutput) write(text string) {
+	if rest := so.limit - so.data.Len(); len(text) > rest {
+		text = text[:rest]
+		so.truncated = true
+	}
+	so.data.WriteString(text)
+}
+
+// runScript is function which execute lua script in ephemeral sandboxed state
+// The state is closed after execution so nothing is kept between scripts
+func (mm *MainModule) runScript(script string, timeout time.Duration, config ScriptConfig) *scriptResult {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	output := &scriptOutput{limit: config.MaxOutput}
+	result := &scriptResult{Status: scriptStatusOK}
+	defer func() {
+		result.Stdout = output.data.String()
+		result.Truncated = result.Truncated || output.truncated
+		result.Duration = int64(time.Since(start) / time.Millisecond)
+	}()
+
+	if strings.HasPrefix(script, "\x1b") {
+		result.Status, result.Error = scriptStatusError, "precompiled scripts aren't allowed"
+		return result
+	}
+
+	L := lua.NewState()
+	if L == nil {
+		result.Status, result.Error = scriptStatusError, "failed to create lua state"
+		return result
+	}
+	var alloc *scriptAllocator
+	defer func() {
+		L.Close()
+		if alloc != nil {
+			alloc.free()
+		}
+	}()
+	L.OpenLibs()
+
+	L.PushString(script)
+	L.SetGlobal("__script")
+	L.PushInteger(config.Memory)
+	L.SetGlobal("__memory")
+	L.PushInteger(scriptHookInstructions)
+	L.SetGlobal("__hook")
+	L.PushNumber(scriptPatternSteps)
+	L.SetGlobal("__steps")
+	L.PushInteger(int64(config.MaxOutput))
+	L.SetGlobal("__max_result")
+	L.Register("__write", func(L *lua.State) int {
+		output.write(L.ToString(1))
+		return 0
+	})
+	// Callbacks don't allocate lua memory so the allocator can't fail inside Go code
+	L.Register("__limit", func(L *lua.State) int {
+		if time.Now().After(deadline) {
+			L.PushInteger(scriptLimitTimeout)
+		} else if mm.getContext().Err() != nil {
+			L.PushInteger(scriptLimitStopping)
+		} else {
+			L.PushNil()
+		}
+		return 1
+	})
+
+	var err error
+	if alloc, err = newScriptAllocator(L, config.Memory); err != nil {
+		result.Status, result.Error = scriptStatusError, err.Error()
+		return result
+	}
+	if err = L.DoString(scriptSandboxLua); err != nil {
+		result.Status, result.Error = scriptStatusError, err.Error()
+		if alloc.exceeded() {
+			result.Error = "memory limit exceeded"
+		}
+		return result
+	}
+	if result.Result = L.ToString(-1); len(result.Result) > config.MaxOutput {
+		result.Result = result.Result[:config.MaxOutput]
+		result.Truncated = true
+	}
+
+	return result
+}
+
+// serveScript is function which handle request to run ad-hoc lua script and report its result
+func (mm *MainModule) serveScript(req *request, data []byte) error {
+	config := mm.GetConfig().Script
+	if !config.Enabled {
+		return newCommandError(errCodePolicyDenied, "ad-hoc scripts aren't enabled by local configuration")
+	}
+
+	var sreq scriptRequest
+	if err := json.Unmarshal(data, &sreq); err != nil {
+		return newCommandError(errCodeBadRequest, "error unmarshal of script request: "+err.Error())
+	}
+	if sreq.Script == "" {
+		return newCommandError(errCodeBadRequest, "script request doesn't contain script")
+	}
+	timeout := time.Second * time.Duration(config.Timeout)
+	if sreq.Timeout > 0 && time.Duration(sreq.Timeout)*time.Millisecond < timeout {
+		timeout = time.Duration(sreq.Timeout) * time.Millisecond
+	}
+
+	result := mm.runScript(sreq.Script, timeout, config)
+	logger := req.logger.WithFields(logrus.Fields{
+		"status":   result.Status,
+		"duration": result.Duration,
+	})
+	if result.Error != "" {
+		logger = logger.WithField("reason", result.Error)
+	}
+	logger.Info("vxagent: ad-hoc script was executed")
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return mm.responseAgent(req, messageScriptResult, payload)
+}
@@ -0,0 +1,90 @@
+package mmodule
+
+/*
+#include <stdlib.h>
+
+typedef struct lua_State lua_State;
+typedef void *(*lua_Alloc)(void *ud, void *ptr, size_t osize, size_t nsize);
+extern lua_Alloc lua_getallocf(lua_State *L, void **ud);
+extern void lua_setallocf(lua_State *L, lua_Alloc f, void *ud);
+extern int lua_gc(lua_State *L, int what, int data);
+
+#define SCRIPT_GCCOUNT 3
+#define SCRIPT_GCCOUNTB 4
+
+// script_allocator wraps allocation function of the state so LuaJIT keeps own memory layout
+typedef struct {
+	lua_Alloc allocf;
+	void *ud;
+	size_t used;
+	size_t limit;
+	int exceeded;
+} script_allocator;
+
+static void *script_allocf(void *ud, void *ptr, size_t osize, size_t nsize) {
+	script_allocator *a = (script_allocator *)ud;
+	void *res;
+	if (ptr == NULL) {
+		osize = 0;
+	}
+	if (nsize > osize && a->used + (nsize - osize) > a->limit) {
+		a->exceeded = 1;
+		return NULL;
+	}
+	res = a->allocf(a->ud, ptr, osize, nsize);
+	if (res == NULL && nsize != 0) {
+		return NULL;
+	}
+	a->used = a->used - osize + nsize;
+	return res;
+}
+
+static script_allocator *script_set_allocator(lua_State *L, size_t limit) {
+	script_allocator *a = (script_allocator *)malloc(sizeof(script_allocator));
+	if (a == NULL) {
+		return NULL;
+	}
+	a->allocf = lua_getallocf(L, &a->ud);
+	a->used = (size_t)lua_gc(L, SCRIPT_GCCOUNT, 0) * 1024 + (size_t)lua_gc(L, SCRIPT_GCCOUNTB, 0);
+	a->limit = limit;
+	a->exceeded = 0;
+	lua_setallocf(L, script_allocf, a);
+	return a;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/vxcontrol/golua/lua"
+)
+
+// scriptAllocator is struct which limits heap of lua state by its allocation function
+// Allocation over the limit fails so lua raises memory error even inside C functions
+type scriptAllocator struct {
+	a *C.script_allocator
+}
+
+// newScriptAllocator is function which set allocation function with limit to the state
+// The allocator should be released by free after closing of the state
+func newScriptAllocator(L *lua.State, limit int64) (*scriptAllocator, error) {
+	a := C.script_set_allocator((*C.lua_State)(unsafe.Pointer(L.CmainCo)), C.size_t(limit))
+	if a == nil {
+		return nil, errors.New("failed to set allocator of lua state")
+	}
+
+	return &scriptAllocator{a: a}, nil
+}
+
+// exceeded is function which return flag that allocation was failed by the limit
+func (sa *scriptAllocator) exceeded() bool {
+	return sa.a.exceeded != 0
+}
+
+// free is function which release allocator, it can't be used by the state after that
+func (sa *scriptAllocator) free() {
+	C.free(unsafe.Pointer(sa.a))
+	sa.a = nil
+}
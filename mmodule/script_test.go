@@ -0,0 +1,151 @@
+package mmodule
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestScriptConfig() ScriptConfig {
+	return ScriptConfig{
+		Enabled:   true,
+		Timeout:   5,
+		Memory:    16 << 20,
+		MaxOutput: 100,
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	result := mm.runScript(`print("line", 1) return 1 + 1, ("a b"):match("(%a+) (%a+)")`,
+		time.Second, newTestScriptConfig())
+	if result.Status != scriptStatusOK || result.Error != "" {
+		t.Fatalf("script failed: %+v", result)
+	}
+	if result.Stdout != "line\t1\n" || result.Result != "2\ta\tb" || result.Truncated {
+		t.Fatalf("unexpected script result %+v", result)
+	}
+
+	// Plain search isn't limited by pattern complexity
+	result = mm.runScript(`return string.find(string.rep("a", 1e6), "b", 1, true)`,
+		time.Second, newTestScriptConfig())
+	if result.Status != scriptStatusOK || result.Result != "nil" {
+		t.Fatalf("unexpected result of plain search %+v", result)
+	}
+}
+
+func TestRunScriptSandbox(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	for _, script := range []string{
+		`os.execute("id")`,
+		`io.open("/etc/passwd")`,
+		`require("os")`,
+		`debug.getregistry()`,
+		`loadstring("return 1")()`,
+		`load(function() end)`,
+		`dofile("/etc/passwd")`,
+		`getfenv(print).os.exit()`,
+		`setfenv(1, {})`,
+		`pcall(error)`,
+		`coroutine.wrap(print)()`,
+		`collectgarbage("stop")`,
+		`newproxy(true)`,
+		`string.dump(print)`,
+		`getmetatable("").__index.dump(print)`,
+		`rawget(_G, "package").loaded.os.exit()`,
+		`ffi.C.system("id")`,
+		`jit.on()`,
+		"\x1bLJ",
+	} {
+		if result := mm.runScript(script, time.Second, newTestScriptConfig()); result.Status != scriptStatusError {
+			t.Errorf("script %q wasn't failed: %+v", script, result)
+		}
+	}
+}
+
+func TestRunScriptLimits(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		script string
+		reason string
+	}{
+		{"infinite loop", `while true do end`, "time limit exceeded"},
+		{"table growth", `local t = {} for i = 1, 1e9 do t[i] = i end`, "memory limit exceeded"},
+		{"string growth", `local s = "x" while true do s = s .. s end`, "memory limit exceeded"},
+		{"repeat of separator", `return string.rep("", 1e9, "xxxxxxxx")`, "memory limit exceeded"},
+		{"pattern backtracking", `return string.find(string.rep("a", 1e5), ".-.-.-b")`, "pattern is too complex"},
+		{"method of string", `return (string.rep("a", 1e5)):match("a*a*b")`, "pattern is too complex"},
+		{"iterator", `for _ in string.rep("a", 1e5):gmatch("[%a]-b") do end`, "pattern is too complex"},
+		{"plain search of long needle", `local s = string.rep("a", 4e6)
+			return string.find(s, string.rep("a", 2e6) .. "b", 1, true)`, "pattern is too complex"},
+		{"pattern without quantifiers", `return string.match(string.rep("a", 4e6), string.rep("a", 2e6) .. "b")`,
+			"pattern is too complex"},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		result := mm.runScript(tt.script, 500*time.Millisecond, newTestScriptConfig())
+		if result.Status != scriptStatusError || !strings.Contains(result.Error, tt.reason) {
+			t.Errorf("%s: unexpected result %+v", tt.name, result)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: script was interrupted after %s", tt.name, elapsed)
+		}
+	}
+
+	// State is created again after exceeding of the limits
+	if result := mm.runScript(`return 1`, time.Second, newTestScriptConfig()); result.Result != "1" {
+		t.Fatalf("unexpected script result %+v", result)
+	}
+}
+
+func TestRunScriptOutputLimit(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+	config := newTestScriptConfig()
+
+	result := mm.runScript(`for i = 1, 100 do print("line") end`, time.Second, config)
+	if result.Status != scriptStatusOK || len(result.Stdout) != config.MaxOutput || !result.Truncated {
+		t.Fatalf("output wasn't truncated: %+v", result)
+	}
+
+	result = mm.runScript(`return string.rep("a", 1e6)`, time.Second, config)
+	if result.Status != scriptStatusOK || len(result.Result) != config.MaxOutput || !result.Truncated {
+		t.Fatalf("result wasn't truncated: %d %+v", len(result.Result), result.Truncated)
+	}
+}
+
+func TestServeScript(t *testing.T) {
+	mm, socket, cleanup := newTestConnectedModule(t)
+	defer cleanup()
+	req := newRequest("server", "req", "SCRIPT_RUN")
+	data := []byte(`{"script": "print('ok')", "timeout": 1000}`)
+
+	// Scripts are rejected by default configuration
+	if err := mm.serveScript(req, data); getCommandError(err).Code != errCodePolicyDenied {
+		t.Fatalf("script was run without enabling: %v", err)
+	}
+
+	mm.GetConfig().Script.Enabled = true
+	if err := mm.serveScript(req, data); err != nil {
+		t.Fatal(err)
+	}
+	messages := socket.getMessages(messageScriptResult)
+	if len(messages) != 1 {
+		t.Fatalf("unexpected amount of script results %d", len(messages))
+	}
+	var result scriptResult
+	if err := json.Unmarshal(messages[0].Payload, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != scriptStatusOK || result.Stdout != "ok\n" {
+		t.Fatalf("unexpected script result %+v", result)
+	}
+}
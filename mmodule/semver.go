@@ -0,0 +1,122 @@
+package mmodule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// semVersion is struct which contains parsed semantic version
+// Build metadata is ignored because it doesn't affect versions precedence
+type semVersion struct {
+	major      uint64
+	minor      uint64
+	patch      uint64
+	prerelease []string
+}
+
+// parseVersion is function which parse semantic version with optional "v" prefix
+// Missing minor and patch parts are treated as zero values
+func parseVersion(version string) (*semVersion, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexByte(v, '+'); i != -1 {
+		v = v[:i]
+	}
+
+	sv := &semVersion{}
+	if i := strings.IndexByte(v, '-'); i != -1 {
+		sv.prerelease = strings.Split(v[i+1:], ".")
+		v = v[:i]
+		for _, id := range sv.prerelease {
+			if id == "" {
+				return nil, errors.New("invalid prerelease part of version " + version)
+			}
+		}
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 || parts[0] == "" {
+		return nil, errors.New("invalid version " + version)
+	}
+	nums := []*uint64{&sv.major, &sv.minor, &sv.patch}
+	for i, part := range parts {
+		num, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid version " + version)
+		}
+		*nums[i] = num
+	}
+
+	return sv, nil
+}
+
+// compareInt is function which compare two numbers and return -1, 0 or 1
+func compareInt(a, b uint64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// compare is function which compare versions by semantic versioning precedence
+// Result is -1 if v less than o, 0 if they are equal and 1 if v greater than o
+func (v *semVersion) compare(o *semVersion) int {
+	if c := compareInt(v.major, o.major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.minor, o.minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.patch, o.patch); c != 0 {
+		return c
+	}
+
+	// Version without prerelease part has higher precedence
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		a, b := v.prerelease[i], o.prerelease[i]
+		an, aerr := strconv.ParseUint(a, 10, 64)
+		bn, berr := strconv.ParseUint(b, 10, 64)
+		switch {
+		case aerr == nil && berr == nil:
+			if c := compareInt(an, bn); c != 0 {
+				return c
+			}
+		case aerr == nil:
+			return -1
+		case berr == nil:
+			return 1
+		case a != b:
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return compareInt(uint64(len(v.prerelease)), uint64(len(o.prerelease)))
+}
+
+// compareVersions is function which parse and compare two semantic versions
+func compareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return va.compare(vb), nil
+}
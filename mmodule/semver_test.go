@@ -0,0 +1,120 @@
+package mmodule
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		result int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.0.0", "1.0.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"1", "1.0.0", 0},
+		{"1.0.0+build.1", "1.0.0+build.2", 0},
+		{"1.0.1", "1.0.0", 1},
+		{"1.1.0", "1.0.9", 1},
+		{"2.0.0", "1.9.9", 1},
+		{"1.10.0", "1.9.0", 1},
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+	}
+	for _, tt := range tests {
+		c, err := compareVersions(tt.a, tt.b)
+		if err != nil {
+			t.Errorf("compare %s and %s: %v", tt.a, tt.b, err)
+		} else if c != tt.result {
+			t.Errorf("compare %s and %s: got %d instead of %d", tt.a, tt.b, c, tt.result)
+		}
+		if c, err = compareVersions(tt.b, tt.a); err == nil && c != -tt.result {
+			t.Errorf("compare %s and %s: got %d instead of %d", tt.b, tt.a, c, -tt.result)
+		}
+	}
+}
+
+func TestParseVersionInvalid(t *testing.T) {
+	for _, version := range []string{"", "v", "1.2.3.4", "1.x.0", "-1.0.0", "1.0.0-", "1.0.0-alpha..1", "1..0"} {
+		if _, err := parseVersion(version); err == nil {
+			t.Errorf("invalid version %q was parsed", version)
+		}
+	}
+}
+
+func newTestAgentModule(name, version string, args map[string][]string) *agent.Module {
+	m := &agent.Module{
+		Name:   proto.String(name),
+		Config: &agent.Config{Version: proto.String(version)},
+		Files: []*agent.Module_File{
+			{Path: proto.String("main.lua"), Data: []byte("return 'ok'")},
+		},
+	}
+	for key, value := range args {
+		m.Args = append(m.Args, &agent.Module_Arg{Key: proto.String(key), Value: value})
+	}
+	return m
+}
+
+func TestCheckVersionAfterStop(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	// Module 1.2.0 was accepted, stopped and agent was restarted
+	if err := mm.store.SetVersion("module_a", "1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newStore(mm.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm.store = store
+
+	if err := mm.checkVersion(newTestAgentModule("module_a", "1.1.0", nil)); err == nil {
+		t.Fatal("downgrade of stopped module was accepted")
+	} else if code := getCommandError(err).Code; code != errCodeConflict {
+		t.Fatalf("unexpected error code %s", code)
+	}
+	if err := mm.checkVersion(newTestAgentModule("module_a", "1.2.1", nil)); err != nil {
+		t.Fatalf("upgrade was rejected: %v", err)
+	}
+
+	forced := newTestAgentModule("module_a", "1.1.0", map[string][]string{
+		moduleForceArg: {"true"},
+		"option":       {"value"},
+	})
+	if err := mm.checkVersion(forced); err != nil {
+		t.Fatalf("forced downgrade was rejected: %v", err)
+	}
+	mi, err := mm.getModuleItem(forced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mi.GetArgs()[moduleForceArg]; ok {
+		t.Fatal("force flag was passed to the module")
+	}
+	if value := mi.GetArgs()["option"]; len(value) != 1 || value[0] != "value" {
+		t.Fatalf("module arguments were lost: %v", mi.GetArgs())
+	}
+}
+
+func TestCheckVersionMinimal(t *testing.T) {
+	mm, cleanup := newTestMainModule(t)
+	defer cleanup()
+
+	mm.GetConfig().Versions.Min = map[string]string{"module_a": "2.0.0"}
+	if err := mm.checkVersion(newTestAgentModule("module_a", "1.9.0", map[string][]string{moduleForceArg: {"true"}})); err == nil {
+		t.Fatal("version less than minimal was accepted with force flag")
+	}
+	if err := mm.checkVersion(newTestAgentModule("module_a", "2.0.0", nil)); err != nil {
+		t.Fatalf("minimal version was rejected: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package mmodule
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/vxcontrol/vxcommon/agent"
+)
+
+// statusPushMaxDelay is maximum time of changes collecting when modules change status continuously
+const statusPushMaxDelay = 10 * time.Second
+
+// getModuleStatusState is function which return comparable state of module status
+// Resources usage is excluded because it's changed every accounting interval
+func getModuleStatusState(status *agent.ModuleStatus) string {
+	extended, _ := getUnknownString(status.XXX_unrecognized, fieldModuleStatusExtended)
+	reason, _ := getUnknownString(status.XXX_unrecognized, fieldModuleStatusReason)
+	return getModuleStatusName(status.GetStatus()) + "|" + extended + "|" + reason
+}
+
+// newRemovedModuleStatus is function which return status entry of module which was removed
+// Config of module is taken from last status which server knows, so the entry is valid
+func newRemovedModuleStatus(status *agent.ModuleStatus) *agent.ModuleStatus {
+	return &agent.ModuleStatus{
+		Name:             status.Name,
+		Config:           status.Config,
+		ConfigItem:       status.ConfigItem,
+		Status:           agent.ModuleStatus_FREED.Enum(),
+		XXX_unrecognized: appendUnknownString(nil, fieldModuleStatusRemoved, "true"),
+	}
+}
+
+// isModuleStatusRemoved is function which check that status entry is about removed module
+func isModuleStatusRemoved(status *agent.ModuleStatus) bool {
+	value, _ := getUnknownString(status.XXX_unrecognized, fieldModuleStatusRemoved)
+	return value == "true"
+}
+
+// statusKey is struct which identifies module status known by a server
+type statusKey struct {
+	dst  string
+	name string
+}
+
+// statusWatcher is struct which tracks modules status known by each server
+// to push only modules which changed status since last report to this server
+type statusWatcher struct {
+	known   map[string]map[string]*agent.ModuleStatus
+	first   time.Time
+	last    time.Time
+	pending map[statusKey]string
+	mutex   *sync.Mutex
+}
+
+// newStatusWatcher is function which constructed statusWatcher object
+func newStatusWatcher() *statusWatcher {
+	return &statusWatcher{
+		known: make(map[string]map[string]*agent.ModuleStatus),
+		mutex: &sync.Mutex{},
+	}
+}
+
+// seen is function which store modules status which was sent to the server as full list
+func (sw *statusWatcher) seen(dst string, list *agent.ModuleStatusList) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	known := make(map[string]*agent.ModuleStatus)
+	for _, status := range list.GetList() {
+		known[status.GetName()] = status
+	}
+	sw.known[dst] = known
+}
+
+// forget is function which drop modules status known by disconnected server
+func (sw *statusWatcher) forget(dst string) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	delete(sw.known, dst)
+}
+
+// check is function which compare current modules status with status known by the servers
+// Result is status updates of changed modules for each server when changes were quiet
+// during debounce period or they are collected longer than maximum delay
+// Removed modules are reported as entries which are marked by removed field
+func (sw *statusWatcher) check(dsts []string, list *agent.ModuleStatusList,
+	debounce time.Duration) map[string]*agent.ModuleStatusList {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	now := time.Now()
+	current := make(map[string]*agent.ModuleStatus)
+	for _, status := range list.GetList() {
+		current[status.GetName()] = status
+	}
+	changed := make(map[statusKey]string)
+	updates := make(map[string]*agent.ModuleStatusList)
+	for _, dst := range dsts {
+		var update agent.ModuleStatusList
+		for name, status := range current {
+			state := getModuleStatusState(status)
+			if known, ok := sw.known[dst][name]; !ok || getModuleStatusState(known) != state {
+				changed[statusKey{dst, name}] = state
+				update.List = append(update.List, status)
+			}
+		}
+		for name, status := range sw.known[dst] {
+			if _, ok := current[name]; !ok {
+				// removed module hasn't state so it differs from any status
+				changed[statusKey{dst, name}] = ""
+				update.List = append(update.List, newRemovedModuleStatus(status))
+			}
+		}
+		if len(update.List) != 0 {
+			updates[dst] = &update
+		}
+	}
+	if len(changed) == 0 {
+		sw.pending, sw.first, sw.last = nil, time.Time{}, time.Time{}
+		return nil
+	}
+
+	if sw.first.IsZero() {
+		sw.first = now
+	}
+	if len(changed) != len(sw.pending) {
+		sw.last = now
+	}
+	for key, state := range changed {
+		if sw.pending[key] != state {
+			sw.last = now
+		}
+	}
+	sw.pending = changed
+	if now.Sub(sw.last) < debounce && now.Sub(sw.first) < statusPushMaxDelay {
+		return nil
+	}
+
+	return updates
+}
+
+// commit is function which store status of modules which was pushed to the server
+func (sw *statusWatcher) commit(dst string, list *agent.ModuleStatusList) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	known, ok := sw.known[dst]
+	if !ok {
+		known = make(map[string]*agent.ModuleStatus)
+		sw.known[dst] = known
+	}
+	for _, status := range list.GetList() {
+		if isModuleStatusRemoved(status) {
+			delete(known, status.GetName())
+		} else {
+			known[status.GetName()] = status
+		}
+	}
+	sw.pending, sw.first, sw.last = nil, time.Time{}, time.Time{}
+}
+
+// getStatusModulesNames is function which return names of modules into status list
+func getStatusModulesNames(list *agent.ModuleStatusList) []string {
+	var names []string
+	for _, status := range list.GetList() {
+		names = append(names, status.GetName())
+	}
+
+	return names
+}
+
+// pushStatusModules is function which send status updates of changed modules to the servers
+// Server which failed to get update keeps old known status so it will get update next time
+func (mm *MainModule) pushStatusModules(updates map[string]*agent.ModuleStatusList) error {
+	var errPush error
+	for dst, list := range updates {
+		data, err := proto.Marshal(list)
+		if err != nil {
+			return err
+		}
+		if err = mm.responseAgent(newRequest(dst, "", ""), messageStatusModulesChanged, data); err != nil {
+			errPush = err
+			continue
+		}
+		mm.status.commit(dst, list)
+	}
+
+	return errPush
+}
+
+// watchStatusModules is function which periodically check modules status
+// and push changed modules to server after debounce period
+func (mm *MainModule) watchStatusModules(ctx context.Context) {
+	for {
+		config := mm.GetConfig().StatusPush
+		select {
+		case <-time.After(time.Millisecond * time.Duration(config.Interval)):
+		case <-ctx.Done():
+			return
+		}
+		if config.Disabled || !mm.receiver.isReady() {
+			continue
+		}
+
+		dsts := mm.getCapableAgents(mm.getAgentList(), capabilityStatusPush)
+		updates := mm.status.check(dsts, mm.getStatusModules(), time.Millisecond*time.Duration(config.Debounce))
+		if len(updates) == 0 {
+			continue
+		}
+		changed := make(map[string][]string)
+		for dst, list := range updates {
+			changed[dst] = getStatusModulesNames(list)
+		}
+		logger := logrus.WithFields(logrus.Fields{
+			"module":  "main",
+			"changed": changed,
+		})
+		if err := mm.pushStatusModules(updates); err != nil {
+			logger.WithError(err).Warn("vxagent: failed to push changed modules status")
+		} else {
+			logger.Debug("vxagent: changed modules status was pushed to servers")
+		}
+	}
+}
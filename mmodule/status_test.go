@@ -0,0 +1,176 @@
+package mmodule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vxcontrol/vxcommon/agent"
+	"github.com/vxcontrol/vxcommon/loader"
+	"github.com/vxcontrol/vxcommon/vxproto"
+)
+
+func newTestStatusList(statuses map[string]agent.ModuleStatus_Status) *agent.ModuleStatusList {
+	var list agent.ModuleStatusList
+	for name, status := range statuses {
+		name := name
+		list.List = append(list.List, &agent.ModuleStatus{
+			Name:   &name,
+			Status: status.Enum(),
+		})
+	}
+	return &list
+}
+
+func TestStatusWatcherChangedModules(t *testing.T) {
+	sw := newStatusWatcher()
+	dsts := []string{"server"}
+	sw.seen("server", newTestStatusList(map[string]agent.ModuleStatus_Status{
+		"module_a": agent.ModuleStatus_RUNNING,
+		"module_b": agent.ModuleStatus_RUNNING,
+	}))
+
+	debounce := 50 * time.Millisecond
+	list := newTestStatusList(map[string]agent.ModuleStatus_Status{
+		"module_a": agent.ModuleStatus_RUNNING,
+		"module_b": agent.ModuleStatus_STOPPED,
+	})
+	if updates := sw.check(dsts, list, debounce); len(updates) != 0 {
+		t.Fatalf("change was pushed before debounce period: %v", updates)
+	}
+
+	// the next change of other module restarts debounce period
+	time.Sleep(30 * time.Millisecond)
+	list = newTestStatusList(map[string]agent.ModuleStatus_Status{
+		"module_a": agent.ModuleStatus_FREED,
+		"module_b": agent.ModuleStatus_STOPPED,
+	})
+	if updates := sw.check(dsts, list, debounce); len(updates) != 0 {
+		t.Fatalf("change was pushed before debounce period: %v", updates)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if updates := sw.check(dsts, list, debounce); len(updates) != 0 {
+		t.Fatalf("debounce period wasn't restarted by new change: %v", updates)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	updates := sw.check(dsts, list, debounce)
+	if len(updates) != 1 || len(updates["server"].GetList()) != 2 {
+		t.Fatalf("unexpected changed modules: %v", updates)
+	}
+	sw.commit("server", updates["server"])
+	if updates = sw.check(dsts, list, debounce); len(updates) != 0 {
+		t.Fatalf("pushed modules were reported again: %v", updates)
+	}
+
+	list = newTestStatusList(map[string]agent.ModuleStatus_Status{
+		"module_a": agent.ModuleStatus_FREED,
+		"module_b": agent.ModuleStatus_RUNNING,
+	})
+	updates = sw.check(dsts, list, 0)
+	if names := getStatusModulesNames(updates["server"]); len(names) != 1 || names[0] != "module_b" {
+		t.Fatalf("unchanged modules were reported: %v", names)
+	}
+}
+
+func TestStatusWatcherMembership(t *testing.T) {
+	sw := newStatusWatcher()
+	dsts := []string{"server_a", "server_b"}
+	list := newTestStatusList(map[string]agent.ModuleStatus_Status{
+		"module_a": agent.ModuleStatus_RUNNING,
+		"module_b": agent.ModuleStatus_RUNNING,
+	})
+	sw.seen("server_a", list)
+	sw.seen("server_b", list)
+
+	// removed module is reported by marked entry instead of full list
+	list = newTestStatusList(map[string]agent.ModuleStatus_Status{
+		"module_a": agent.ModuleStatus_RUNNING,
+	})
+	updates := sw.check(dsts, list, 0)
+	for _, dst := range dsts {
+		update := updates[dst].GetList()
+		if len(update) != 1 || update[0].GetName() != "module_b" || !isModuleStatusRemoved(update[0]) {
+			t.Fatalf("removed module wasn't reported to %s: %v", dst, update)
+		}
+	}
+
+	// full list requested by one server doesn't reset module status known by other one
+	sw.seen("server_a", list)
+	updates = sw.check(dsts, list, 0)
+	if len(updates) != 1 || len(updates["server_b"].GetList()) != 1 {
+		t.Fatalf("unexpected status updates after full list of one server: %v", updates)
+	}
+	sw.commit("server_b", updates["server_b"])
+	if updates = sw.check(dsts, list, 0); len(updates) != 0 {
+		t.Fatalf("removed module was reported again: %v", updates)
+	}
+
+	list = newTestStatusList(map[string]agent.ModuleStatus_Status{
+		"module_a": agent.ModuleStatus_RUNNING,
+		"module_c": agent.ModuleStatus_RUNNING,
+	})
+	updates = sw.check(dsts, list, 0)
+	for _, dst := range dsts {
+		update := updates[dst].GetList()
+		if len(update) != 1 || update[0].GetName() != "module_c" || isModuleStatusRemoved(update[0]) {
+			t.Fatalf("added module wasn't reported to %s: %v", dst, update)
+		}
+	}
+
+	sw.forget("server_b")
+	if names := getStatusModulesNames(sw.check(dsts, list, 0)["server_b"]); len(names) != 2 {
+		t.Fatalf("status of reconnected server wasn't forgotten: %v", names)
+	}
+}
+
+// testAgentsProto is VXProto which has fixed list of connected servers
+type testAgentsProto struct {
+	vxproto.IVXProto
+	agents map[string]*vxproto.AgentInfo
+}
+
+func (p *testAgentsProto) GetAgentList() map[string]*vxproto.AgentInfo { return p.agents }
+
+func TestPushStatusModules(t *testing.T) {
+	mm, socket, cleanup := newTestConnectedModule(t)
+	defer cleanup()
+	mm.setState(&testAgentsProto{agents: map[string]*vxproto.AgentInfo{"old": {}, "new": {}}}, socket)
+	mm.capabilities.set("new", &agent.Message{
+		XXX_unrecognized: appendUnknownString(nil, fieldMessageCapabilities, "status_push"),
+	})
+
+	if err := mm.registry.Add("module_a", newTestModuleConfig("module_a", "1.0.0"), &loader.ModuleState{}); err != nil {
+		t.Fatal(err)
+	}
+	list := mm.getStatusModules()
+	dsts := mm.getCapableAgents(mm.getAgentList(), capabilityStatusPush)
+	if err := mm.pushStatusModules(mm.status.check(dsts, list, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if updates := mm.status.check(dsts, list, 0); len(updates) != 0 {
+		t.Fatalf("pushed modules weren't stored as known: %v", updates)
+	}
+
+	if _, err := mm.registry.Del("module_a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.pushStatusModules(mm.status.check(dsts, mm.getStatusModules(), 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := socket.getMessages(messageStatusModulesChanged)
+	if len(messages) != 2 || len(socket.dsts) != 2 || socket.dsts[0] != "new" || socket.dsts[1] != "new" {
+		t.Fatalf("status was pushed to server without capability: %v", socket.dsts)
+	}
+	for i, removed := range []bool{false, true} {
+		var pushed agent.ModuleStatusList
+		if err := proto.Unmarshal(messages[i].Payload, &pushed); err != nil {
+			t.Fatal(err)
+		}
+		update := pushed.GetList()
+		if len(update) != 1 || update[0].GetName() != "module_a" || isModuleStatusRemoved(update[0]) != removed {
+			t.Fatalf("unexpected pushed list %v", update)
+		}
+	}
+}
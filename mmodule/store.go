@@ -0,0 +1,344 @@
+package mmodule
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	storeDirName       = "store"
+	storeObjectsDir    = "objects"
+	storeIndexFileName = "index.json"
+)
+
+// storeIndex is struct which persists modules manifests of the store
+// Each manifest maps module file path to SHA-256 hash of its content,
+// versions map module name to last accepted version to prevent downgrade
+// after module was stopped or agent was restarted
+type storeIndex struct {
+	Modules  map[string]map[string]string `json:"modules"`
+	Versions map[string]string            `json:"versions,omitempty"`
+}
+
+// moduleStore is content-addressable storage of module files on the disk
+// Objects are keyed by SHA-256 of content and shared between module versions,
+// reference counter of object is amount of manifests which point to it
+type moduleStore struct {
+	path  string
+	index storeIndex
+	refs  map[string]int
+	mutex *sync.Mutex
+}
+
+// getStoreModuleKey is function which return manifest key for module version
+func getStoreModuleKey(name, version string) string {
+	return name + "@" + version
+}
+
+// getStoreHash is function which return hex SHA-256 hash of data
+func getStoreHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// newStore is function which constructed moduleStore object in the data directory
+func newStore(dataDir string) (*moduleStore, error) {
+	s := &moduleStore{
+		path: filepath.Join(dataDir, storeDirName),
+		index: storeIndex{
+			Modules:  make(map[string]map[string]string),
+			Versions: make(map[string]string),
+		},
+		refs:  make(map[string]int),
+		mutex: &sync.Mutex{},
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.path, storeObjectsDir), 0700); err != nil {
+		return nil, errors.New("failed to create store directory: " + err.Error())
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.path, storeIndexFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("failed to read store index: " + err.Error())
+	} else if err == nil {
+		if err = json.Unmarshal(data, &s.index); err != nil {
+			logrus.WithError(err).Warn("vxagent: store index was corrupted and will be reset")
+			s.index.Modules = make(map[string]map[string]string)
+		}
+		if s.index.Modules == nil {
+			s.index.Modules = make(map[string]map[string]string)
+		}
+		if s.index.Versions == nil {
+			s.index.Versions = make(map[string]string)
+		}
+	}
+	s.rebuildRefs()
+
+	return s, nil
+}
+
+// rebuildRefs is internal function which recalculate reference counters by manifests
+func (s *moduleStore) rebuildRefs() {
+	s.refs = make(map[string]int)
+	for _, manifest := range s.index.Modules {
+		for _, hash := range manifest {
+			s.refs[hash]++
+		}
+	}
+}
+
+// getObjectPath is internal function which return path to object file by hash
+func (s *moduleStore) getObjectPath(hash string) string {
+	return filepath.Join(s.path, storeObjectsDir, hash[:2], hash)
+}
+
+// writeFileAtomic is function which write data to temporary file and rename it
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// saveIndex is internal function which store manifests to the disk
+func (s *moduleStore) saveIndex() error {
+	data, err := json.Marshal(&s.index)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(s.path, storeIndexFileName), data, 0600)
+}
+
+// putObject is internal function which write object if it doesn't exist or was corrupted
+func (s *moduleStore) putObject(data []byte) (string, error) {
+	hash := getStoreHash(data)
+	path := s.getObjectPath(hash)
+	if odata, err := ioutil.ReadFile(path); err == nil && getStoreHash(odata) == hash {
+		return hash, nil
+	}
+
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return "", errors.New("failed to write object " + hash + ": " + err.Error())
+	}
+
+	return hash, nil
+}
+
+// getObject is internal function which read object and check its integrity
+func (s *moduleStore) getObject(hash string) ([]byte, error) {
+	if len(hash) != sha256.Size*2 {
+		return nil, errors.New("invalid object hash " + hash)
+	}
+
+	data, err := ioutil.ReadFile(s.getObjectPath(hash))
+	if err != nil {
+		return nil, errors.New("failed to read object " + hash + ": " + err.Error())
+	}
+	if getStoreHash(data) != hash {
+		return nil, errors.New("object " + hash + " integrity check failed")
+	}
+
+	return data, nil
+}
+
+// AddModule is function which store files of module version and reference it
+// Manifests of other versions of the module are released because agent runs
+// only one version of each module, their objects are removed by next GC
+func (s *moduleStore) AddModule(name, version string, files map[string][]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	manifest := make(map[string]string)
+	for path, data := range files {
+		hash, err := s.putObject(data)
+		if err != nil {
+			return err
+		}
+		manifest[path] = hash
+	}
+
+	key := getStoreModuleKey(name, version)
+	for okey := range s.index.Modules {
+		if okey != key && strings.HasPrefix(okey, getStoreModuleKey(name, "")) {
+			delete(s.index.Modules, okey)
+		}
+	}
+	s.index.Modules[key] = manifest
+	s.rebuildRefs()
+
+	return s.saveIndex()
+}
+
+// DelModule is function which remove reference to files of module version
+func (s *moduleStore) DelModule(name, version string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := getStoreModuleKey(name, version)
+	if _, ok := s.index.Modules[key]; !ok {
+		return nil
+	}
+	delete(s.index.Modules, key)
+	s.rebuildRefs()
+
+	return s.saveIndex()
+}
+
+// GetModule is function which read files of module version with integrity check
+func (s *moduleStore) GetModule(name, version string) (map[string][]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := getStoreModuleKey(name, version)
+	manifest, ok := s.index.Modules[key]
+	if !ok {
+		return nil, errors.New("module " + key + " not found in the store")
+	}
+
+	files := make(map[string][]byte)
+	for path, hash := range manifest {
+		data, err := s.getObject(hash)
+		if err != nil {
+			return nil, errors.New("module " + key + " file " + path + ": " + err.Error())
+		}
+		files[path] = data
+	}
+
+	return files, nil
+}
+
+// GetManifest is function which return copy of module version manifest
+func (s *moduleStore) GetManifest(name, version string) (map[string]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := getStoreModuleKey(name, version)
+	manifest, ok := s.index.Modules[key]
+	if !ok {
+		return nil, errors.New("module " + key + " not found in the store")
+	}
+
+	result := make(map[string]string)
+	for path, hash := range manifest {
+		result[path] = hash
+	}
+
+	return result, nil
+}
+
+// GetVersion is function which return last accepted version of module
+func (s *moduleStore) GetVersion(name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.index.Versions[name]
+}
+
+// SetVersion is function which store last accepted version of module
+func (s *moduleStore) SetVersion(name, version string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.index.Versions[name] == version {
+		return nil
+	}
+	s.index.Versions[name] = version
+
+	return s.saveIndex()
+}
+
+// HasModule is function which check that module version manifest exists
+func (s *moduleStore) HasModule(name, version string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.index.Modules[getStoreModuleKey(name, version)]
+	return ok
+}
+
+// ListModules is function which return sorted list of stored module versions
+func (s *moduleStore) ListModules() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var list []string
+	for key := range s.index.Modules {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// GetRefs is function which return reference counter of object by hash
+func (s *moduleStore) GetRefs(hash string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.refs[hash]
+}
+
+// GC is function which remove all objects without references
+// Result is amount of removed objects
+func (s *moduleStore) GC() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var removed int
+	root := filepath.Join(s.path, storeObjectsDir)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if strings.HasPrefix(name, ".tmp-") || s.refs[name] == 0 {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, errors.New("failed to collect garbage in the store: " + err.Error())
+	}
+
+	return removed, nil
+}
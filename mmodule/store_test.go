@@ -0,0 +1,115 @@
+package mmodule
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestStore(t *testing.T) (*moduleStore, string) {
+	dataDir, err := ioutil.TempDir("", "vxagent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newStore(dataDir)
+	if err != nil {
+		os.RemoveAll(dataDir)
+		t.Fatal(err)
+	}
+	return s, dataDir
+}
+
+func countStoreObjects(t *testing.T, s *moduleStore) int {
+	var count int
+	err := filepath.Walk(filepath.Join(s.path, storeObjectsDir), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestStoreRefsAndGC(t *testing.T) {
+	s, dataDir := newTestStore(t)
+	defer os.RemoveAll(dataDir)
+
+	shared, own := []byte("shared"), []byte("own")
+	if err := s.AddModule("module_a", "1.0.0", map[string][]byte{"main.lua": shared}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddModule("module_b", "1.0.0", map[string][]byte{"main.lua": shared, "lib.lua": own}); err != nil {
+		t.Fatal(err)
+	}
+	if refs := s.GetRefs(getStoreHash(shared)); refs != 2 {
+		t.Fatalf("shared object has %d references instead of 2", refs)
+	}
+
+	if err := s.DelModule("module_b", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if refs := s.GetRefs(getStoreHash(own)); refs != 0 {
+		t.Fatalf("released object has %d references", refs)
+	}
+	if removed, err := s.GC(); err != nil || removed != 1 {
+		t.Fatalf("GC removed %d objects instead of 1: %v", removed, err)
+	}
+	if files, err := s.GetModule("module_a", "1.0.0"); err != nil || string(files["main.lua"]) != "shared" {
+		t.Fatalf("module lost its files after GC: %v", err)
+	}
+	if s.HasModule("module_b", "1.0.0") {
+		t.Fatal("deleted module is still in the store")
+	}
+}
+
+func TestStoreReleasePreviousVersion(t *testing.T) {
+	s, dataDir := newTestStore(t)
+	defer os.RemoveAll(dataDir)
+
+	if err := s.AddModule("module_a", "1.0.0", map[string][]byte{"main.lua": []byte("v1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddModule("module_ab", "1.0.0", map[string][]byte{"main.lua": []byte("other")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Old manifest must be released after restart when version is updated
+	s, err := newStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddModule("module_a", "1.1.0", map[string][]byte{"main.lua": []byte("v2")}); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := s.GC(); err != nil || removed != 1 {
+		t.Fatalf("GC removed %d objects instead of 1: %v", removed, err)
+	}
+	expected := []string{"module_a@1.1.0", "module_ab@1.0.0"}
+	if list := s.ListModules(); !reflect.DeepEqual(list, expected) {
+		t.Fatalf("unexpected store modules %v instead of %v", list, expected)
+	}
+	if count := countStoreObjects(t, s); count != 2 {
+		t.Fatalf("store has %d objects instead of 2", count)
+	}
+}
+
+func TestStoreIntegrityCheck(t *testing.T) {
+	s, dataDir := newTestStore(t)
+	defer os.RemoveAll(dataDir)
+
+	data := []byte("code")
+	if err := s.AddModule("module_a", "1.0.0", map[string][]byte{"main.lua": data}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.getObjectPath(getStoreHash(data)), []byte("evil"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetModule("module_a", "1.0.0"); err == nil {
+		t.Fatal("corrupted object was loaded from the store")
+	}
+}
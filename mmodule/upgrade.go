@@ -0,0 +1,540 @@
+package mmodule
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// upgradeStateFileName is name of file into data directory which keeps state of agent upgrade
+const upgradeStateFileName = "upgrade.json"
+
+// upgradeMaxAttempts is amount of new binary starts before rollback if it crashes before healthy connection
+const upgradeMaxAttempts = 3
+
+// upgradeDownloadTimeout is deadline of new binary downloading by reference
+const upgradeDownloadTimeout = 5 * time.Minute
+
+// upgradeCheckTimeout is deadline of new binary running to check its version before replacing
+const upgradeCheckTimeout = 30 * time.Second
+
+// upgradeExecutable is function which return path to current executable, it's replaced by tests
+var upgradeExecutable = os.Executable
+
+// Stages of agent upgrade which are reported to server
+const (
+	upgradeStatusRejected   = "rejected"
+	upgradeStatusStaged     = "staged"
+	upgradeStatusPending    = "pending"
+	upgradeStatusCommitted  = "committed"
+	upgradeStatusRolledBack = "rolled_back"
+)
+
+// agentUpgrade is struct of request to replace agent binary
+// Binary contains new executable or URL references to it, signature is ed25519 signature of the binary
+type agentUpgrade struct {
+	Version   string `json:"version"`
+	URL       string `json:"url,omitempty"`
+	Binary    []byte `json:"binary,omitempty"`
+	SHA256    string `json:"sha256"`
+	Signature []byte `json:"signature"`
+}
+
+// upgradeResult is struct of report about agent upgrade stage
+type upgradeResult struct {
+	Version string `json:"version"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// upgradeState is struct which is stored between agent restarts to commit or rollback upgrade
+type upgradeState struct {
+	Version    string    `json:"version"`
+	Status     string    `json:"status"`
+	Executable string    `json:"executable"`
+	Backup     string    `json:"backup"`
+	Deadline   time.Time `json:"deadline"`
+	Attempts   int       `json:"attempts"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// upgradeLock guards upgrade state file from concurrent changing
+// It isn't held while new binary is waiting for connection, the stored state rejects other upgrades
+var upgradeLock sync.Mutex
+
+// getUpgradeStatePath is function which return path to upgrade state file
+func (mm *MainModule) getUpgradeStatePath() string {
+	return filepath.Join(mm.dataDir, upgradeStateFileName)
+}
+
+// loadUpgradeState is function which read upgrade state, result is nil if there isn't upgrade in progress
+func (mm *MainModule) loadUpgradeState() (*upgradeState, error) {
+	data, err := ioutil.ReadFile(mm.getUpgradeStatePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state upgradeState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, errors.New("failed to parse upgrade state: " + err.Error())
+	}
+
+	return &state, nil
+}
+
+// saveUpgradeState is function which store upgrade state to data directory
+func (mm *MainModule) saveUpgradeState(state *upgradeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(mm.getUpgradeStatePath(), data, 0600)
+}
+
+// SetRestartHandler is function which set callback to restart agent process after binary replacing
+// It should be set only if service manager starts the agent again after exit with failure code,
+// agent upgrade is rejected without the handler
+func (mm *MainModule) SetRestartHandler(handler func()) {
+	mm.mutexConfig.Lock()
+	defer mm.mutexConfig.Unlock()
+
+	mm.restartHandler = handler
+}
+
+// getRestartHandler is function which return callback to restart agent process or nil
+func (mm *MainModule) getRestartHandler() func() {
+	mm.mutexConfig.RLock()
+	defer mm.mutexConfig.RUnlock()
+
+	return mm.restartHandler
+}
+
+// restart is function which request agent process restarting through service manager
+func (mm *MainModule) restart() {
+	handler := mm.getRestartHandler()
+	if handler == nil {
+		logrus.WithField("module", "main").Error("vxagent: restart handler isn't defined, new binary will be used after next start")
+		return
+	}
+	go handler()
+}
+
+// sendUpgradeResult is function which report stage of agent upgrade to server
+func (mm *MainModule) sendUpgradeResult(req *request, result *upgradeResult) {
+	logger := req.logger.WithFields(logrus.Fields{
+		"version": result.Version,
+		"status":  result.Status,
+	})
+	if result.Error != "" {
+		logger = logger.WithField("reason", result.Error)
+	}
+	logger.Info("vxagent: agent upgrade stage")
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+
+	var reqs []*request
+	if req.src != "" {
+		reqs = append(reqs, req)
+	} else if p := mm.getProto(); p != nil {
+		for dst := range p.GetAgentList() {
+			reqs = append(reqs, newRequest(dst, req.id, req.command))
+		}
+	}
+	for _, req := range reqs {
+		if err = mm.responseAgent(req, messageAgentUpgradeResult, data); err != nil {
+			logger.WithError(err).Warn("vxagent: failed to send agent upgrade result")
+		}
+	}
+}
+
+// getUpgradeBinary is function which return new binary from the request or download it by reference
+func getUpgradeBinary(ctx context.Context, upgrade *agentUpgrade, maxSize int64) ([]byte, error) {
+	if len(upgrade.Binary) != 0 {
+		if int64(len(upgrade.Binary)) > maxSize {
+			return nil, errors.New("binary exceeds maximum size " + strconv.FormatInt(maxSize, 10))
+		}
+		return upgrade.Binary, nil
+	}
+	if upgrade.URL == "" {
+		return nil, errors.New("upgrade request doesn't contain binary or reference to it")
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, upgrade.URL, nil)
+	if err != nil {
+		return nil, errors.New("failed to download binary: " + err.Error())
+	}
+	client := http.Client{Timeout: upgradeDownloadTimeout}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, errors.New("failed to download binary: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("failed to download binary: " + resp.Status)
+	}
+
+	binary, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, errors.New("failed to download binary: " + err.Error())
+	}
+	if int64(len(binary)) > maxSize {
+		return nil, errors.New("binary exceeds maximum size " + strconv.FormatInt(maxSize, 10))
+	}
+
+	return binary, nil
+}
+
+// verifyUpgradeBinary is function which check hash of binary and its signature by one of trusted keys
+func verifyUpgradeBinary(binary []byte, hash string, signature []byte, keys []ed25519.PublicKey) error {
+	sum := sha256.Sum256(binary)
+	if hex.EncodeToString(sum[:]) != hash {
+		return errors.New("hash of binary mismatch")
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, binary, signature) {
+			return nil
+		}
+	}
+
+	return errors.New("signature of binary isn't valid for trusted keys")
+}
+
+// checkExecutable is function which run new binary to get its version before replacing
+// It prevents replacing by binary which can't be started on this system
+func checkExecutable(ctx context.Context, path, version string) error {
+	ctx, cancel := context.WithTimeout(ctx, upgradeCheckTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return errors.New("failed to run new binary: " + err.Error())
+	}
+	const prefix = "vxagent version is "
+	output := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(output, prefix) {
+		return errors.New("new binary isn't vxagent")
+	}
+	if version != "" && !strings.HasPrefix(strings.TrimPrefix(output, prefix), version) {
+		return errors.New("new binary has version " + strings.TrimPrefix(output, prefix) + " instead of " + version)
+	}
+
+	return nil
+}
+
+// copyExecutable is function which copy executable file with its mode and sync it to the disk
+func copyExecutable(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// replaceExecutable is function which put new file on executable path and keep current one as backup
+// Current file is linked or copied to backup before, so the executable path is replaced by one rename
+// and it always contains a binary even if the agent is interrupted in the middle
+func replaceExecutable(exe, replacement, backup string) error {
+	os.Remove(backup)
+	if err := os.Link(exe, backup); err != nil {
+		if err = copyExecutable(exe, backup); err != nil {
+			os.Remove(backup)
+			return errors.New("failed to backup current executable: " + err.Error())
+		}
+	}
+	err := os.Rename(replacement, exe)
+	if err != nil && runtime.GOOS == "windows" {
+		// Windows doesn't replace running executable but allows to rename it,
+		// the renamed file is removed on next upgrade when it isn't running
+		running := exe + ".run"
+		os.Remove(running)
+		if err = os.Rename(exe, running); err == nil {
+			if err = os.Rename(replacement, exe); err != nil {
+				os.Rename(running, exe)
+			}
+		}
+	}
+	if err != nil {
+		os.Remove(backup)
+		return errors.New("failed to replace executable: " + err.Error())
+	}
+
+	return nil
+}
+
+// stageUpgrade is function which verify new binary and put it instead of current executable
+// Upgrade is rejected if the agent can't be restarted by service manager to roll back failed binary
+func (mm *MainModule) stageUpgrade(ctx context.Context, req *request, upgrade *agentUpgrade) error {
+	config := mm.GetConfig()
+	keys, err := config.GetUpgradeKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("agent upgrade is disabled because trusted keys aren't configured")
+	}
+	if mm.getRestartHandler() == nil {
+		return errors.New("agent upgrade isn't supported because service manager doesn't restart the agent")
+	}
+
+	binary, err := getUpgradeBinary(ctx, upgrade, config.Upgrade.MaxSize)
+	if err != nil {
+		return err
+	}
+	if err = verifyUpgradeBinary(binary, upgrade.SHA256, upgrade.Signature, keys); err != nil {
+		return err
+	}
+
+	exe, err := upgradeExecutable()
+	if err != nil {
+		return errors.New("failed to get path to executable: " + err.Error())
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return errors.New("failed to get path to executable: " + err.Error())
+	}
+
+	staged := exe + ".new"
+	if err = writeFileAtomic(staged, binary, 0755); err != nil {
+		return errors.New("failed to stage new binary: " + err.Error())
+	}
+	if err = checkExecutable(ctx, staged, upgrade.Version); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	state := &upgradeState{
+		Version:    upgrade.Version,
+		Status:     upgradeStatusPending,
+		Executable: exe,
+		Backup:     exe + ".old",
+		Deadline:   time.Now().Add(config.GetUpgradeHealthTimeout()),
+		RequestID:  req.id,
+	}
+	if err = mm.saveUpgradeState(state); err != nil {
+		os.Remove(staged)
+		return errors.New("failed to store upgrade state: " + err.Error())
+	}
+	if err = replaceExecutable(exe, staged, state.Backup); err != nil {
+		os.Remove(staged)
+		os.Remove(mm.getUpgradeStatePath())
+		return err
+	}
+
+	return nil
+}
+
+// serveAgentUpgrade is function which handle request to replace agent binary
+// The binary is downloaded and verified in background worker to not block packets receiver
+func (mm *MainModule) serveAgentUpgrade(req *request, data []byte) error {
+	var upgrade agentUpgrade
+	if err := json.Unmarshal(data, &upgrade); err != nil {
+		return newCommandError(errCodeBadRequest, "error unmarshal of agent upgrade request: "+err.Error())
+	}
+
+	started := mm.runWorker(func(ctx context.Context) {
+		if err := mm.upgrade(ctx, req, &upgrade); err != nil {
+			mm.sendUpgradeResult(req, &upgradeResult{
+				Version: upgrade.Version,
+				Status:  upgradeStatusRejected,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		mm.sendUpgradeResult(req, &upgradeResult{
+			Version: upgrade.Version,
+			Status:  upgradeStatusStaged,
+		})
+		if ctx.Err() == nil {
+			mm.restart()
+		}
+	})
+	if !started {
+		return newCommandError(errCodeConflict, "main module is stopping")
+	}
+
+	return nil
+}
+
+// upgrade is function which stage new binary if there isn't other upgrade in progress
+func (mm *MainModule) upgrade(ctx context.Context, req *request, upgrade *agentUpgrade) error {
+	upgradeLock.Lock()
+	defer upgradeLock.Unlock()
+
+	if state, err := mm.loadUpgradeState(); err != nil || state != nil {
+		return errors.New("another agent upgrade is in progress")
+	}
+
+	return mm.stageUpgrade(ctx, req, upgrade)
+}
+
+// rollbackUpgrade is function which return previous binary back and store the reason into upgrade state
+// Previous binary reports the result to server after its restarting
+func (mm *MainModule) rollbackUpgrade(state *upgradeState, reason string) error {
+	logger := logrus.WithFields(logrus.Fields{
+		"module":  "main",
+		"version": state.Version,
+		"reason":  reason,
+	})
+	logger.Error("vxagent: new agent binary isn't healthy, rolling back")
+
+	failed := state.Executable + ".failed"
+	if err := replaceExecutable(state.Executable, state.Backup, failed); err != nil {
+		logger.WithError(err).Error("vxagent: failed to rollback agent binary")
+		return err
+	}
+	os.Remove(failed)
+
+	state.Status = upgradeStatusRolledBack
+	state.Error = reason
+	if err := mm.saveUpgradeState(state); err != nil {
+		logger.WithError(err).Error("vxagent: failed to store upgrade state")
+	}
+
+	return nil
+}
+
+// countUpgradeAttempt is function which count start of new binary before its connection to server
+// It's called on main module starting, so the binary which fails before connection is rolled back too,
+// the error is returned after rollback to exit and be started again by service manager
+func (mm *MainModule) countUpgradeAttempt() error {
+	upgradeLock.Lock()
+	defer upgradeLock.Unlock()
+
+	state, err := mm.loadUpgradeState()
+	if err != nil {
+		logrus.WithError(err).Error("vxagent: failed to load upgrade state")
+		return nil
+	} else if state == nil || state.Status != upgradeStatusPending {
+		return nil
+	}
+
+	state.Attempts++
+	if state.Attempts > upgradeMaxAttempts {
+		if err = mm.rollbackUpgrade(state, "new binary was restarted too many times"); err != nil {
+			return nil
+		}
+		return errors.New("agent binary was rolled back to previous version, restart is required")
+	}
+	if err = mm.saveUpgradeState(state); err != nil {
+		logrus.WithError(err).Error("vxagent: failed to store upgrade state")
+	}
+
+	return nil
+}
+
+// finishUpgrade is function which remove upgrade state and report final result to server
+func (mm *MainModule) finishUpgrade(state *upgradeState) {
+	upgradeLock.Lock()
+	os.Remove(state.Backup)
+	os.Remove(mm.getUpgradeStatePath())
+	upgradeLock.Unlock()
+
+	mm.sendUpgradeResult(newRequest("", state.RequestID, "AGENT_UPGRADE"), &upgradeResult{
+		Version: state.Version,
+		Status:  state.Status,
+		Error:   state.Error,
+	})
+}
+
+// waitConnection is function which wait healthy connection to server until deadline
+func (mm *MainModule) waitConnection(ctx context.Context, deadline time.Time) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		if health := mm.GetHealth(); health.Connected && health.Handshake {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// watchUpgrade is function which commit or rollback agent upgrade after restarting
+// New binary should reach healthy connection to server before deadline, else previous one is restored
+func (mm *MainModule) watchUpgrade(ctx context.Context) {
+	upgradeLock.Lock()
+	state, err := mm.loadUpgradeState()
+	upgradeLock.Unlock()
+	if err != nil {
+		logrus.WithError(err).Error("vxagent: failed to load upgrade state")
+		return
+	} else if state == nil {
+		return
+	}
+
+	switch state.Status {
+	case upgradeStatusPending:
+		if !mm.waitConnection(ctx, state.Deadline) {
+			if ctx.Err() != nil {
+				return
+			}
+			upgradeLock.Lock()
+			err = mm.rollbackUpgrade(state, "new binary didn't connect to server in time")
+			upgradeLock.Unlock()
+			if err == nil {
+				mm.restart()
+			}
+			return
+		}
+		state.Status = upgradeStatusCommitted
+		mm.finishUpgrade(state)
+	case upgradeStatusRolledBack:
+		if !mm.waitConnection(ctx, time.Now().Add(mm.GetConfig().GetUpgradeHealthTimeout())) {
+			return
+		}
+		mm.finishUpgrade(state)
+	default:
+		logrus.WithField("status", state.Status).Warn("vxagent: unknown upgrade state was dropped")
+		upgradeLock.Lock()
+		os.Remove(mm.getUpgradeStatePath())
+		upgradeLock.Unlock()
+	}
+}
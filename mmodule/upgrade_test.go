@@ -0,0 +1,258 @@
+package mmodule
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testUpgrade is environment of agent upgrade with fake executable which prints its version
+type testUpgrade struct {
+	mm       *MainModule
+	exe      string
+	private  ed25519.PrivateKey
+	restarts chan struct{}
+}
+
+func getTestBinary(version string) []byte {
+	return []byte("#!/bin/sh\necho 'vxagent version is " + version + "'\n")
+}
+
+func newTestUpgrade(t *testing.T) (*testUpgrade, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake executable is shell script")
+	}
+	mm, cleanup := newTestMainModule(t)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	mm.GetConfig().Upgrade.PublicKeys = []string{base64.StdEncoding.EncodeToString(public)}
+
+	tu := &testUpgrade{
+		mm:       mm,
+		exe:      filepath.Join(mm.dataDir, "vxagent"),
+		private:  private,
+		restarts: make(chan struct{}, 1),
+	}
+	if err = ioutil.WriteFile(tu.exe, getTestBinary("1.0.0"), 0755); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	mm.SetRestartHandler(func() { tu.restarts <- struct{}{} })
+	upgradeExecutable = func() (string, error) { return tu.exe, nil }
+
+	return tu, func() {
+		upgradeExecutable = os.Executable
+		cleanup()
+	}
+}
+
+func (tu *testUpgrade) newUpgrade(version string, binary []byte) *agentUpgrade {
+	sum := sha256.Sum256(binary)
+	return &agentUpgrade{
+		Version:   version,
+		Binary:    binary,
+		SHA256:    hex.EncodeToString(sum[:]),
+		Signature: ed25519.Sign(tu.private, binary),
+	}
+}
+
+func (tu *testUpgrade) checkExecutable(t *testing.T, version string) {
+	data, err := ioutil.ReadFile(tu.exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(getTestBinary(version)) {
+		t.Fatalf("executable contains %q instead of version %s", data, version)
+	}
+}
+
+func (tu *testUpgrade) stage(t *testing.T) *upgradeState {
+	if err := tu.mm.upgrade(context.Background(), newRequest("", "req", "AGENT_UPGRADE"),
+		tu.newUpgrade("1.1.0", getTestBinary("1.1.0"))); err != nil {
+		t.Fatal(err)
+	}
+	state, err := tu.mm.loadUpgradeState()
+	if err != nil || state == nil {
+		t.Fatalf("upgrade state wasn't stored: %v", err)
+	}
+	return state
+}
+
+func TestStageUpgradeRejected(t *testing.T) {
+	tu, cleanup := newTestUpgrade(t)
+	defer cleanup()
+	req := newRequest("", "req", "AGENT_UPGRADE")
+
+	corrupted := tu.newUpgrade("1.1.0", getTestBinary("1.1.0"))
+	corrupted.Binary = getTestBinary("6.6.6")
+	tests := []struct {
+		name    string
+		upgrade *agentUpgrade
+		reason  string
+	}{
+		{"corrupted binary", corrupted, "hash of binary mismatch"},
+		{"failed binary", tu.newUpgrade("1.1.0", []byte("#!/bin/sh\nexit 1\n")), "failed to run new binary"},
+		{"other program", tu.newUpgrade("1.1.0", []byte("#!/bin/sh\necho hello\n")), "isn't vxagent"},
+		{"other version", tu.newUpgrade("1.1.0", getTestBinary("1.2.0")), "instead of 1.1.0"},
+	}
+	for _, tt := range tests {
+		err := tu.mm.upgrade(context.Background(), req, tt.upgrade)
+		if err == nil || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		tu.checkExecutable(t, "1.0.0")
+		if _, err := os.Stat(tu.exe + ".new"); !os.IsNotExist(err) {
+			t.Errorf("%s: staged binary was left", tt.name)
+		}
+	}
+
+	tu.mm.GetConfig().Upgrade.MaxSize = 16
+	err := tu.mm.upgrade(context.Background(), req, tu.newUpgrade("1.1.0", getTestBinary("1.1.0")))
+	if err == nil || !strings.Contains(err.Error(), "maximum size") {
+		t.Fatalf("inline binary over maximum size: %v", err)
+	}
+	tu.mm.GetConfig().Upgrade.MaxSize = DefaultConfig().Upgrade.MaxSize
+
+	// Service manager which doesn't restart the agent can't roll back failed binary
+	tu.mm.SetRestartHandler(nil)
+	err = tu.mm.upgrade(context.Background(), req, tu.newUpgrade("1.1.0", getTestBinary("1.1.0")))
+	if err == nil || !strings.Contains(err.Error(), "service manager") {
+		t.Fatalf("upgrade without restart handler: %v", err)
+	}
+	tu.checkExecutable(t, "1.0.0")
+
+	if err := tu.mm.serveAgentUpgrade(req, []byte("{}")); getCommandError(err).Code != errCodeConflict {
+		t.Fatalf("upgrade was accepted by stopped main module: %v", err)
+	}
+}
+
+func TestStageUpgrade(t *testing.T) {
+	tu, cleanup := newTestUpgrade(t)
+	defer cleanup()
+
+	state := tu.stage(t)
+	if state.Status != upgradeStatusPending || state.Version != "1.1.0" || state.RequestID != "req" {
+		t.Fatalf("unexpected upgrade state %+v", state)
+	}
+	tu.checkExecutable(t, "1.1.0")
+	if data, err := ioutil.ReadFile(state.Backup); err != nil || string(data) != string(getTestBinary("1.0.0")) {
+		t.Fatalf("previous binary wasn't kept: %v", err)
+	}
+
+	err := tu.mm.upgrade(context.Background(), newRequest("", "", "AGENT_UPGRADE"),
+		tu.newUpgrade("1.2.0", getTestBinary("1.2.0")))
+	if err == nil || !strings.Contains(err.Error(), "in progress") {
+		t.Fatalf("concurrent upgrade wasn't rejected: %v", err)
+	}
+}
+
+func TestReplaceExecutableFailed(t *testing.T) {
+	tu, cleanup := newTestUpgrade(t)
+	defer cleanup()
+
+	// Executable path keeps current binary when replacement can't be moved there
+	if err := replaceExecutable(tu.exe, tu.exe+".new", tu.exe+".old"); err == nil {
+		t.Fatal("executable was replaced by missing file")
+	}
+	tu.checkExecutable(t, "1.0.0")
+	if _, err := os.Stat(tu.exe + ".old"); !os.IsNotExist(err) {
+		t.Fatal("backup of executable was left after failed replacing")
+	}
+}
+
+func TestUpgradeRollbackOnRestarts(t *testing.T) {
+	tu, cleanup := newTestUpgrade(t)
+	defer cleanup()
+	tu.stage(t)
+
+	// New binary fails before connection to server and it's started again by service manager
+	for i := 0; i < upgradeMaxAttempts; i++ {
+		if err := tu.mm.countUpgradeAttempt(); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+	}
+	if err := tu.mm.countUpgradeAttempt(); err == nil {
+		t.Fatal("new binary wasn't rolled back after too many restarts")
+	}
+	tu.checkExecutable(t, "1.0.0")
+	state, err := tu.mm.loadUpgradeState()
+	if err != nil || state.Status != upgradeStatusRolledBack || state.Error == "" {
+		t.Fatalf("unexpected upgrade state %+v: %v", state, err)
+	}
+
+	// Previous binary starts normally
+	if err := tu.mm.countUpgradeAttempt(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchUpgradeCommit(t *testing.T) {
+	tu, cleanup := newTestUpgrade(t)
+	defer cleanup()
+	state := tu.stage(t)
+
+	tu.mm.receiver.setRunning(true)
+	tu.mm.receiver.setAgent("server", true)
+	tu.mm.receiver.setHandshake(true)
+	tu.mm.watchUpgrade(context.Background())
+
+	tu.checkExecutable(t, "1.1.0")
+	if state, err := tu.mm.loadUpgradeState(); err != nil || state != nil {
+		t.Fatalf("upgrade state wasn't removed: %+v %v", state, err)
+	}
+	if _, err := os.Stat(state.Backup); !os.IsNotExist(err) {
+		t.Fatal("previous binary wasn't removed")
+	}
+}
+
+func TestWatchUpgradeRollbackOnTimeout(t *testing.T) {
+	tu, cleanup := newTestUpgrade(t)
+	defer cleanup()
+	state := tu.stage(t)
+	state.Deadline = time.Now().Add(time.Second)
+	if err := tu.mm.saveUpgradeState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tu.mm.watchUpgrade(context.Background())
+	}()
+	// Upgrade lock isn't held while new binary waits for connection
+	err := tu.mm.upgrade(context.Background(), newRequest("", "", "AGENT_UPGRADE"),
+		tu.newUpgrade("1.2.0", getTestBinary("1.2.0")))
+	if err == nil || !strings.Contains(err.Error(), "in progress") {
+		t.Fatalf("concurrent upgrade wasn't rejected: %v", err)
+	}
+	select {
+	case <-tu.restarts:
+		t.Fatal("agent was restarted before deadline")
+	default:
+	}
+	select {
+	case <-tu.restarts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent wasn't restarted after rollback")
+	}
+	<-done
+
+	tu.checkExecutable(t, "1.0.0")
+	if state, err := tu.mm.loadUpgradeState(); err != nil || state.Status != upgradeStatusRolledBack {
+		t.Fatalf("unexpected upgrade state %+v: %v", state, err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// flattenJSON is function which convert JSON object to map of dotted keys to values
+func flattenJSON(prefix string, value interface{}, result map[string]interface{}) {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		result[prefix] = value
+		return
+	}
+	for key, v := range obj {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		flattenJSON(key, v, result)
+	}
+}
+
+// getFlatConfig is function which return flat representation of JSON document
+func getFlatConfig(data []byte) (map[string]interface{}, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{})
+	flattenJSON("", doc, result)
+
+	return result, nil
+}
+
+// getOptionSource is function which return source of agent option value
+func (a *Agent) getOptionSource(name string) string {
+	if source, ok := a.sources[name]; ok {
+		return source
+	}
+	return "default"
+}
+
+// showConfig is function which print effective configuration with source of every value
+func (a *Agent) showConfig() (string, error) {
+	var out bytes.Buffer
+	tw := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE")
+
+	options := []struct {
+		name  string
+		value interface{}
+	}{
+		{"agent", a.agentID},
+		{"connect", a.connect},
+		{"logdir", a.logDir},
+		{"datadir", a.dataDir},
+		{"config", a.cfgPath},
+		{"debug", a.debug},
+	}
+	for _, o := range options {
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", o.name, o.value, a.getOptionSource(o.name))
+	}
+
+	effective, err := json.Marshal(a.config)
+	if err != nil {
+		return "failed to show configuration", err
+	}
+	values, err := getFlatConfig(effective)
+	if err != nil {
+		return "failed to show configuration", err
+	}
+	// Empty optional values are omitted from JSON so they are shown with derived defaults
+	defaults := map[string]interface{}{
+		"policy.path":         a.config.GetPolicyPath(a.dataDir),
+		"control.socket":      a.config.GetControlSocketPath(a.dataDir),
+		"http.listen":         "",
+		"http.metrics":        false,
+		"inbox.dir":           a.config.GetInboxDir(a.dataDir),
+		"inbox.allowed_paths": []string{},
+	}
+	for key, value := range defaults {
+		if _, ok := values[key]; !ok {
+			values[key] = value
+		}
+	}
+
+	fileValues := make(map[string]interface{})
+	if a.cfgPath != "" {
+		data, err := ioutil.ReadFile(a.cfgPath)
+		if err != nil {
+			return "failed to show configuration", err
+		}
+		if fileValues, err = getFlatConfig(data); err != nil {
+			return "failed to show configuration", err
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		source := "default"
+		if key == "http.listen" && a.httpAddr != "" {
+			source = a.getOptionSource("http")
+		} else if _, ok := fileValues[key]; ok {
+			source = "file " + a.cfgPath
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", key, values[key], source)
+	}
+	tw.Flush()
+
+	return strings.TrimRight(out.String(), "\n"), nil
+}
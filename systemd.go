@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// watchdogSec is watchdog timeout of systemd unit in seconds
+	watchdogSec = 30
+	// notifyStatusInterval is period of status sending when watchdog isn't enabled
+	notifyStatusInterval = 10 * time.Second
+)
+
+// systemdUnit is template of systemd unit with notify and watchdog support
+// TimeoutStopSec is filled from shutdown budget of the agent
+const systemdUnit = `[Unit]
+Description={{.Description}}
+Requires={{.Dependencies}}
+After={{.Dependencies}}
+
+[Service]
+Type=notify
+NotifyAccess=main
+WatchdogSec=%d
+TimeoutStopSec=%d
+ExecStart={{.Path}} {{.Args}}
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// getSystemdUnit is function which return systemd unit template for the agent
+func getSystemdUnit(shutdownTimeout time.Duration) string {
+	return fmt.Sprintf(systemdUnit, watchdogSec, int(shutdownTimeout.Seconds())+watchdogSec)
+}
+
+// sdNotify is function which send state to systemd through notification socket
+// It does nothing if the agent wasn't started by systemd with notify support
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return errors.New("failed to connect to notify socket: " + err.Error())
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return errors.New("failed to send notify state: " + err.Error())
+	}
+
+	return nil
+}
+
+// sdWatchdogInterval is function which return watchdog timeout requested by systemd
+// Result is zero if watchdog isn't enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notify is function which send agent state to systemd until the context will be canceled
+// Watchdog pings are sent only while packets receiver loop of main module answers liveness probe
+func (a *Agent) notify(ctx context.Context) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	watchdog := sdWatchdogInterval()
+	interval := notifyStatusInterval
+	if watchdog != 0 {
+		interval = watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		health := a.module.GetHealth()
+		state := []string{"STATUS=" + health.String()}
+		if watchdog != 0 {
+			if err := a.module.CheckLiveness(interval / 2); err != nil {
+				logrus.WithError(err).Warn("vxagent: main module isn't alive, skip watchdog ping")
+			} else {
+				state = append(state, "WATCHDOG=1")
+			}
+		}
+		if err := sdNotify(strings.Join(state, "\n")); err != nil {
+			logrus.WithError(err).Warn("vxagent: failed to notify systemd")
+		}
+	}
+}